@@ -27,7 +27,7 @@ func shutdown() {
 }
 
 func setup() {
-	s, _, _ := utils.InitFlag("../../config-dev/config.yml")
+	s, _, _, _ := utils.InitFlag("../../config-dev/config.yml")
 	utils.InitViper(s)
 
 	log.Info("Set up")
@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionAuditLog = "auditLog"
+
+const AuditTimeField = "time"
+const AuditExpiresField = "expires"
+const AuditActorIdField = "actorid"
+const auditAction = "action"
+
+// AuditDto is written once and never updated
+type AuditDto struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty"`
+	Time       time.Time
+	ActorId    int64
+	ActorLogin string `bson:",omitempty"`
+	Action     string
+	TargetType string `bson:",omitempty"`
+	TargetId   string `bson:",omitempty"`
+	// only changed fields
+	Before    bson.M `bson:",omitempty"`
+	After     bson.M `bson:",omitempty"`
+	Status    int
+	Ip        string
+	RequestId string `bson:",omitempty"`
+	// removed by TTL index, nil means kept forever
+	Expires *time.Time `bson:",omitempty"`
+}
+
+// AuditQuery has optional filters, zero values match everything
+type AuditQuery struct {
+	ActorId *int64
+	Action  string
+	From    time.Time
+	To      time.Time
+	Limit   int64
+}
+
+type AuditRepository struct {
+	mongo *mongo.Client
+}
+
+func NewAuditRepository(mongo *mongo.Client) *AuditRepository {
+	return &AuditRepository{mongo: mongo}
+}
+
+func (r *AuditRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionAuditLog)
+}
+
+func (r *AuditRepository) Insert(entry AuditDto) error {
+	_, err := r.collection().InsertOne(context.TODO(), entry)
+	return err
+}
+
+// Find returns newest entries first
+func (r *AuditRepository) Find(q AuditQuery) ([]AuditDto, error) {
+	filter := bson.D{}
+	if q.ActorId != nil {
+		filter = append(filter, bson.E{Key: AuditActorIdField, Value: *q.ActorId})
+	}
+	if len(q.Action) != 0 {
+		filter = append(filter, bson.E{Key: auditAction, Value: q.Action})
+	}
+	period := bson.M{}
+	if !q.From.IsZero() {
+		period["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		period["$lt"] = q.To
+	}
+	if len(period) != 0 {
+		filter = append(filter, bson.E{Key: AuditTimeField, Value: period})
+	}
+
+	cursor, err := r.collection().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: AuditTimeField, Value: -1}}).SetLimit(q.Limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]AuditDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem AuditDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
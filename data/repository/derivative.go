@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const CollectionDerivatives = "derivatives"
+
+const DerivativeFileIdField = "fileid"
+
+// DerivativeDto tracks cached resized image, its id is key of object in derivatives bucket
+type DerivativeDto struct {
+	Id      string `bson:"_id"`
+	FileId  primitive.ObjectID
+	Size    int64
+	Created time.Time
+}
+
+type DerivativeRepository struct {
+	mongo *mongo.Client
+}
+
+func NewDerivativeRepository(mongo *mongo.Client) *DerivativeRepository {
+	return &DerivativeRepository{mongo: mongo}
+}
+
+func (r *DerivativeRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionDerivatives)
+}
+
+func (r *DerivativeRepository) Save(key string, fileId primitive.ObjectID, sizeVal int64) error {
+	var upsert = true
+	dto := DerivativeDto{Id: key, FileId: fileId, Size: sizeVal, Created: time.Now()}
+	_, err := r.collection().ReplaceOne(context.TODO(), bson.D{{Key: Id, Value: key}}, dto, &options.ReplaceOptions{Upsert: &upsert})
+	return err
+}
+
+func (r *DerivativeRepository) FindByFile(fileId primitive.ObjectID) ([]DerivativeDto, error) {
+	cursor, err := r.collection().Find(context.TODO(), bson.D{{Key: DerivativeFileIdField, Value: fileId}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]DerivativeDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem DerivativeDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+func (r *DerivativeRepository) Delete(key string) error {
+	_, err := r.collection().DeleteOne(context.TODO(), bson.D{{Key: Id, Value: key}})
+	return err
+}
@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const CollectionDownloadStats = "downloadStats"
+
+const DownloadKindPublic = "public"
+const DownloadKindPrivate = "private"
+const DownloadKindShared = "shared"
+
+const StatsFileIdField = "fileid"
+const StatsUserIdField = "userid"
+const StatsDayField = "day"
+const StatsKindField = "kind"
+const StatsReferrerField = "referrer"
+const statsDownloads = "downloads"
+const statsBytes = "bytes"
+
+// DownloadStatsDto aggregates downloads of file during day by kind of download and referrer host
+type DownloadStatsDto struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty"`
+	FileId    primitive.ObjectID
+	UserId    int64 // owner of file
+	Day       time.Time
+	Kind      string
+	Referrer  string
+	Downloads int64
+	Bytes     int64
+}
+
+// DownloadStatsTotalDto is result of grouping stats by Key
+type DownloadStatsTotalDto struct {
+	Key       interface{} `bson:"_id"`
+	Downloads int64
+	Bytes     int64
+}
+
+type DownloadStatsRepository struct {
+	mongo *mongo.Client
+}
+
+func NewDownloadStatsRepository(mongo *mongo.Client) *DownloadStatsRepository {
+	return &DownloadStatsRepository{mongo: mongo}
+}
+
+func (r *DownloadStatsRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionDownloadStats)
+}
+
+func StatsDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// Record adds downloads and bytes to stats of today, downloads is 0 when only part of file is served
+func (r *DownloadStatsRepository) Record(fileId primitive.ObjectID, ownerId int64, kind, referrer string, downloads, bytes int64) error {
+	filter := bson.D{
+		{Key: StatsFileIdField, Value: fileId},
+		{Key: StatsDayField, Value: StatsDay(time.Now())},
+		{Key: StatsKindField, Value: kind},
+		{Key: StatsReferrerField, Value: referrer},
+	}
+	update := bson.M{
+		"$setOnInsert": bson.M{StatsUserIdField: ownerId},
+		"$inc":         bson.M{statsDownloads: downloads, statsBytes: bytes},
+	}
+	var upsert = true
+	_, err := r.collection().UpdateOne(context.TODO(), filter, update, &options.UpdateOptions{Upsert: &upsert})
+	if err != nil {
+		// concurrent upsert may fail on unique index, document exists anyway
+		Logger.Infof("Retrying recording download of %v after error: %v", fileId.Hex(), err)
+		_, err = r.collection().UpdateOne(context.TODO(), filter, update, &options.UpdateOptions{Upsert: &upsert})
+	}
+	return err
+}
+
+func periodFilter(from, to time.Time) bson.E {
+	return bson.E{Key: StatsDayField, Value: bson.M{"$gte": StatsDay(from), "$lte": StatsDay(to)}}
+}
+
+// Totals groups stats matched by filter by field, biggest count of downloads first. Zero limit means all groups.
+func (r *DownloadStatsRepository) Totals(filter bson.D, from, to time.Time, field string, limit int64) ([]DownloadStatsTotalDto, error) {
+	pipeline := bson.A{
+		bson.M{"$match": append(filter, periodFilter(from, to))},
+		bson.M{"$group": bson.M{"_id": "$" + field, statsDownloads: bson.M{"$sum": "$" + statsDownloads}, statsBytes: bson.M{"$sum": "$" + statsBytes}}},
+		bson.M{"$sort": bson.D{{Key: statsDownloads, Value: -1}, {Key: "_id", Value: 1}}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+	cursor, err := r.collection().Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]DownloadStatsTotalDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem DownloadStatsTotalDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+func (r *DownloadStatsRepository) DeleteByFile(fileId primitive.ObjectID) error {
+	_, err := r.collection().DeleteMany(context.TODO(), bson.D{{Key: StatsFileIdField, Value: fileId}})
+	return err
+}
+
+// FindFilesByIds returns files regardless of owner, it's used to name files in statistics
+func (r *UserFileRepository) FindFilesByIds(ids []primitive.ObjectID) (map[primitive.ObjectID]UserFileDto, error) {
+	cursor, err := r.collection().Find(context.TODO(), bson.D{{Key: Id, Value: bson.M{"$in": ids}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var files = map[primitive.ObjectID]UserFileDto{}
+	for cursor.Next(context.TODO()) {
+		var elem UserFileDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		files[elem.Id] = elem
+	}
+	return files, cursor.Err()
+}
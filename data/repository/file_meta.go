@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+const altText = "alttext"
+const attributes = "attributes"
+
+// FileMetaPatch changes only non-nil fields, empty value removes field
+type FileMetaPatch struct {
+	Tags        *[]string
+	Description *string
+	AltText     *string
+	Attributes  *map[string]string
+}
+
+func setOrUnset(set, unset bson.M, field string, value interface{}, empty bool) {
+	if empty {
+		unset[field] = ""
+	} else {
+		set[field] = value
+	}
+}
+
+func (r *UserFileRepository) PatchMeta(objId string, userIdInt int, patch FileMetaPatch) error {
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
+	if err != nil {
+		return err
+	}
+	var set = bson.M{updated: time.Now()}
+	var unset = bson.M{}
+	if patch.Tags != nil {
+		setOrUnset(set, unset, TagsField, *patch.Tags, len(*patch.Tags) == 0)
+	}
+	if patch.Description != nil {
+		setOrUnset(set, unset, DescriptionField, *patch.Description, len(*patch.Description) == 0)
+	}
+	if patch.AltText != nil {
+		setOrUnset(set, unset, altText, *patch.AltText, len(*patch.AltText) == 0)
+	}
+	if patch.Attributes != nil {
+		setOrUnset(set, unset, attributes, *patch.Attributes, len(*patch.Attributes) == 0)
+	}
+	update := bson.M{"$set": set}
+	if len(unset) != 0 {
+		update["$unset"] = unset
+	}
+	result, err := r.collection().UpdateOne(context.TODO(), append(*findDocument, notTrashed), update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package repository
+
+import (
+	"context"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const CollectionFolders = "folders"
+
+const FolderUserIdField = "userid"
+const FolderParentIdField = "parentid"
+const FolderNameField = "name"
+const folderId = "folderid"
+
+// FolderDto is folder of user's files, folders in root have nil ParentId
+type FolderDto struct {
+	Id       primitive.ObjectID `bson:"_id,omitempty"`
+	UserId   int64
+	Name     string
+	ParentId *primitive.ObjectID
+	Created  time.Time
+}
+
+type FolderRepository struct {
+	mongo *mongo.Client
+}
+
+func NewFolderRepository(mongo *mongo.Client) *FolderRepository {
+	return &FolderRepository{mongo: mongo}
+}
+
+func (r *FolderRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionFolders)
+}
+
+// IsDuplicateKey tells whether write has been rejected by unique index
+func IsDuplicateKey(err error) bool {
+	if we, ok := err.(mongo.WriteException); ok {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func nameFilter(userIdInt int, parentId *primitive.ObjectID, name string) bson.D {
+	return bson.D{{Key: FolderUserIdField, Value: int64(userIdInt)}, {Key: FolderParentIdField, Value: parentId}, {Key: FolderNameField, Value: name}}
+}
+
+// Create returns error which satisfies IsDuplicateKey if parent already has folder with such name
+func (r *FolderRepository) Create(userIdInt int, name string, parentId *primitive.ObjectID) (*FolderDto, error) {
+	dto := FolderDto{Id: primitive.NewObjectID(), UserId: int64(userIdInt), Name: name, ParentId: parentId, Created: time.Now()}
+	if _, err := r.collection().InsertOne(context.TODO(), dto); err != nil {
+		return nil, err
+	}
+	return &dto, nil
+}
+
+// FindOrCreate returns existing folder with name in parent or creates it, it's used to keep structure of uploaded directories
+func (r *FolderRepository) FindOrCreate(userIdInt int, name string, parentId *primitive.ObjectID) (*FolderDto, error) {
+	filter := nameFilter(userIdInt, parentId, name)
+	update := bson.M{"$setOnInsert": bson.M{"created": time.Now()}}
+	var upsert = true
+	if _, err := r.collection().UpdateOne(context.TODO(), filter, update, &options.UpdateOptions{Upsert: &upsert}); err != nil {
+		if !IsDuplicateKey(err) {
+			return nil, err
+		}
+		// concurrent upload has created the same folder
+		Logger.Infof("Folder %v has been created concurrently", name)
+	}
+	return r.findOne(filter)
+}
+
+func (r *FolderRepository) findOne(filter bson.D) (*FolderDto, error) {
+	one := r.collection().FindOne(context.TODO(), filter)
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem FolderDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
+
+// GetUserFolder returns mongo.ErrNoDocuments if folder doesn't exist or belongs to another user
+func (r *FolderRepository) GetUserFolder(objId string, userIdInt int) (*FolderDto, error) {
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
+	if err != nil {
+		return nil, err
+	}
+	return r.findOne(*findDocument)
+}
+
+func (r *FolderRepository) FindChildren(userIdInt int, parentId *primitive.ObjectID) ([]FolderDto, error) {
+	filter := bson.D{{Key: FolderUserIdField, Value: int64(userIdInt)}, {Key: FolderParentIdField, Value: parentId}}
+	cursor, err := r.collection().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: FolderNameField, Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]FolderDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem FolderDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+func (r *FolderRepository) update(objId string, userIdInt int, set bson.M) error {
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
+	if err != nil {
+		return err
+	}
+	result, err := r.collection().UpdateOne(context.TODO(), *findDocument, GetUpdateDoc(set))
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (r *FolderRepository) Rename(objId string, userIdInt int, name string) error {
+	return r.update(objId, userIdInt, bson.M{FolderNameField: name})
+}
+
+func (r *FolderRepository) Move(objId string, userIdInt int, parentId *primitive.ObjectID) error {
+	return r.update(objId, userIdInt, bson.M{FolderParentIdField: parentId})
+}
+
+func (r *FolderRepository) Delete(id primitive.ObjectID) error {
+	_, err := r.collection().DeleteOne(context.TODO(), bson.D{{Key: Id, Value: id}})
+	return err
+}
+
+// FindFilesInFolder returns not trashed files in any state, nil folder means root
+func (r *UserFileRepository) FindFilesInFolder(userIdInt int, folder *primitive.ObjectID) ([]UserFileDto, error) {
+	filter := bson.D{{Key: userId, Value: int64(userIdInt)}, {Key: folderId, Value: folder}, notTrashed}
+	cursor, err := r.collection().Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]UserFileDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem UserFileDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+// SetFolder moves file to folder, nil folder means root
+func (r *UserFileRepository) SetFolder(objId string, userIdInt int, folder *primitive.ObjectID) error {
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
+	if err != nil {
+		return err
+	}
+	var update bson.M
+	if folder == nil {
+		update = bson.M{"$unset": bson.M{folderId: ""}}
+	} else {
+		update = GetUpdateDoc(bson.M{folderId: folder})
+	}
+	result, err := r.collection().UpdateOne(context.TODO(), append(*findDocument, notTrashed), update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
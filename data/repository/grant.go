@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const CollectionFileGrants = "fileGrants"
+
+const GrantFileIdField = "fileid"
+const GrantGranteeIdField = "granteeid"
+
+// FileGrantDto gives user access to file of another user. Grantee may always read file and, if Write is set, rename and replace it.
+type FileGrantDto struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty"`
+	FileId    primitive.ObjectID
+	OwnerId   int64
+	GranteeId int64
+	Write     bool
+	Created   time.Time
+}
+
+type FileGrantRepository struct {
+	mongo *mongo.Client
+}
+
+func NewFileGrantRepository(mongo *mongo.Client) *FileGrantRepository {
+	return &FileGrantRepository{mongo: mongo}
+}
+
+func (r *FileGrantRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionFileGrants)
+}
+
+func (r *FileGrantRepository) find(filter bson.D) ([]FileGrantDto, error) {
+	cursor, err := r.collection().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "created", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]FileGrantDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem FileGrantDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+// Grant creates grant or changes write access of existing one
+func (r *FileGrantRepository) Grant(fileId primitive.ObjectID, ownerIdInt int, granteeIdInt int, write bool) error {
+	filter := bson.D{{Key: GrantFileIdField, Value: fileId}, {Key: GrantGranteeIdField, Value: int64(granteeIdInt)}}
+	update := bson.M{
+		"$set":         bson.M{"write": write},
+		"$setOnInsert": bson.M{"ownerid": int64(ownerIdInt), "created": time.Now()},
+	}
+	var upsert = true
+	_, err := r.collection().UpdateOne(context.TODO(), filter, update, &options.UpdateOptions{Upsert: &upsert})
+	return err
+}
+
+// GetGrant returns mongo.ErrNoDocuments if file isn't shared with user
+func (r *FileGrantRepository) GetGrant(fileIdStr string, granteeIdInt int) (*FileGrantDto, error) {
+	fileId, err := primitive.ObjectIDFromHex(fileIdStr)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	one := r.collection().FindOne(context.TODO(), bson.D{{Key: GrantFileIdField, Value: fileId}, {Key: GrantGranteeIdField, Value: int64(granteeIdInt)}})
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem FileGrantDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
+
+func (r *FileGrantRepository) FindGrantsOfFile(fileId primitive.ObjectID) ([]FileGrantDto, error) {
+	return r.find(bson.D{{Key: GrantFileIdField, Value: fileId}})
+}
+
+func (r *FileGrantRepository) FindGrantsForUser(granteeIdInt int) ([]FileGrantDto, error) {
+	return r.find(bson.D{{Key: GrantGranteeIdField, Value: int64(granteeIdInt)}})
+}
+
+// Revoke returns mongo.ErrNoDocuments if there was no such grant
+func (r *FileGrantRepository) Revoke(fileId primitive.ObjectID, granteeIdInt int) error {
+	result, err := r.collection().DeleteOne(context.TODO(), bson.D{{Key: GrantFileIdField, Value: fileId}, {Key: GrantGranteeIdField, Value: int64(granteeIdInt)}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (r *FileGrantRepository) DeleteByFile(fileId primitive.ObjectID) error {
+	_, err := r.collection().DeleteMany(context.TODO(), bson.D{{Key: GrantFileIdField, Value: fileId}})
+	return err
+}
@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"time"
+)
+
+const SortByName = "name"
+const SortBySize = "size"
+const SortByCreated = "created"
+const SortByUpdated = "updated"
+
+// sortFields maps sort parameter to field of UserFileDto
+var sortFields = map[string]string{
+	SortByName:    filename,
+	SortBySize:    size,
+	SortByCreated: "created",
+	SortByUpdated: updated,
+}
+
+// IndexedSortFields are fields listing can be sorted by, each of them needs index
+func IndexedSortFields() []string {
+	return []string{filename, size, "created", updated}
+}
+
+func IsValidSort(sort string) bool {
+	_, ok := sortFields[sort]
+	return ok
+}
+
+// FileCursor points to last file of previous page, only value of field which listing is sorted by is set
+type FileCursor struct {
+	Id      primitive.ObjectID `json:"id"`
+	Name    string             `json:"n,omitempty"`
+	Size    int64              `json:"s,omitempty"`
+	Created time.Time          `json:"c,omitempty"`
+	Updated time.Time          `json:"u,omitempty"`
+}
+
+func NewFileCursor(sort string, dto *UserFileDto) FileCursor {
+	cursor := FileCursor{Id: dto.Id}
+	switch sort {
+	case SortByName:
+		cursor.Name = dto.Filename
+	case SortBySize:
+		cursor.Size = dto.Size
+	case SortByCreated:
+		cursor.Created = dto.Created
+	case SortByUpdated:
+		cursor.Updated = dto.Updated
+	}
+	return cursor
+}
+
+func (c *FileCursor) value(sort string) interface{} {
+	switch sort {
+	case SortBySize:
+		return c.Size
+	case SortByCreated:
+		return c.Created
+	case SortByUpdated:
+		return c.Updated
+	default:
+		return c.Name
+	}
+}
+
+// FileQuery selects ready and not trashed files of user in folder, nil FolderId means root
+type FileQuery struct {
+	UserId      int
+	FolderId    *primitive.ObjectID
+	Filename    string // case insensitive substring
+	ContentType string // prefix, e. g. "image/"
+	Published   *bool
+	Sort        string
+	Descending  bool
+	Limit       int64 // 0 means all files
+	After       *FileCursor
+}
+
+func (q *FileQuery) filter() bson.D {
+	filter := bson.D{{Key: userId, Value: int64(q.UserId)}, {Key: folderId, Value: q.FolderId}, {Key: state, Value: UploadStateReady}, notTrashed}
+	if len(q.Filename) != 0 {
+		filter = append(filter, bson.E{Key: filename, Value: primitive.Regex{Pattern: regexp.QuoteMeta(q.Filename), Options: "i"}})
+	}
+	if len(q.ContentType) != 0 {
+		filter = append(filter, bson.E{Key: contentType, Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.ContentType)}})
+	}
+	if q.Published != nil {
+		if *q.Published {
+			filter = append(filter, bson.E{Key: published, Value: true})
+		} else {
+			filter = append(filter, bson.E{Key: published, Value: bson.M{"$ne": true}})
+		}
+	}
+	return filter
+}
+
+// CountFiles counts all files matching query regardless of page
+func (r *UserFileRepository) CountFiles(q FileQuery) (int64, error) {
+	return r.collection().CountDocuments(context.TODO(), q.filter())
+}
+
+// FindFilesPage returns Limit files after cursor ordered by sort field and id, so files with equal values aren't skipped
+func (r *UserFileRepository) FindFilesPage(q FileQuery) ([]UserFileDto, error) {
+	sortField := sortFields[q.Sort]
+	filter := q.filter()
+	direction, comparison := 1, "$gt"
+	if q.Descending {
+		direction, comparison = -1, "$lt"
+	}
+	if q.After != nil {
+		value := q.After.value(q.Sort)
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.M{sortField: bson.M{comparison: value}},
+			bson.M{sortField: value, Id: bson.M{comparison: q.After.Id}},
+		}})
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: sortField, Value: direction}, {Key: Id, Value: direction}}).SetLimit(q.Limit)
+	cursor, err := r.collection().Find(context.TODO(), filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]UserFileDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem UserFileDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
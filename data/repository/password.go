@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const CollectionPasswordAttempts = "passwordAttempts"
+
+const failures = "failures"
+const PasswordAttemptsExpiresField = "expires"
+
+// PasswordAttemptsDto counts wrong passwords entered for file during window which ends at Expires
+type PasswordAttemptsDto struct {
+	Id       string `bson:"_id"` // file id
+	Failures int64
+	Expires  time.Time
+}
+
+type PasswordAttemptRepository struct {
+	mongo *mongo.Client
+}
+
+func NewPasswordAttemptRepository(mongo *mongo.Client) *PasswordAttemptRepository {
+	return &PasswordAttemptRepository{mongo: mongo}
+}
+
+func (r *PasswordAttemptRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionPasswordAttempts)
+}
+
+// GetLockedUntil returns end of window if there were max or more failures during it, otherwise nil
+func (r *PasswordAttemptRepository) GetLockedUntil(fileId string, max int64) (*time.Time, error) {
+	filter := bson.D{{Key: Id, Value: fileId}, {Key: failures, Value: bson.M{"$gte": max}}, {Key: PasswordAttemptsExpiresField, Value: bson.M{"$gt": time.Now()}}}
+	one := r.collection().FindOne(context.TODO(), filter)
+	if one.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem PasswordAttemptsDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem.Expires, nil
+}
+
+// RegisterFailure counts wrong password in current window or starts new window
+func (r *PasswordAttemptRepository) RegisterFailure(fileId string, window time.Duration) error {
+	now := time.Now()
+	filter := bson.D{{Key: Id, Value: fileId}, {Key: PasswordAttemptsExpiresField, Value: bson.M{"$gt": now}}}
+	result, err := r.collection().UpdateOne(context.TODO(), filter, bson.M{"$inc": bson.M{failures: int64(1)}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 1 {
+		return nil
+	}
+	var upsert = true
+	_, err = r.collection().ReplaceOne(context.TODO(), bson.D{{Key: Id, Value: fileId}}, PasswordAttemptsDto{Id: fileId, Failures: 1, Expires: now.Add(window)}, &options.ReplaceOptions{Upsert: &upsert})
+	if err != nil {
+		Logger.Errorf("Error during starting password attempts window for file %v: %v", fileId, err)
+	}
+	return err
+}
+
+// SetPassword sets bcrypt hash of file's password, empty hash removes password
+func (r *UserFileRepository) SetPassword(objId string, userIdInt int, hash string) error {
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
+	if err != nil {
+		return err
+	}
+	var update bson.M
+	if len(hash) == 0 {
+		update = bson.M{"$unset": bson.M{passwordHash: ""}}
+	} else {
+		update = GetUpdateDoc(bson.M{passwordHash: hash})
+	}
+	result, err := r.collection().UpdateOne(context.TODO(), append(*findDocument, notTrashed), update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const quarantineReason = "quarantinereason"
+const QuarantinedAtField = "quarantinedat"
+
+// Quarantine fills metadata like MarkUploaded does, but file stays hidden
+func (r *UserFileRepository) Quarantine(objId string, userIdInt int, sizeVal int64, sha256Val, contentTypeVal, reason string) error {
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	updateDocument := GetUpdateDoc(bson.M{size: sizeVal, sha256: sha256Val, contentType: contentTypeVal, state: UploadStateQuarantined, quarantineReason: reason, QuarantinedAtField: now, updated: now})
+	result, err := r.collection().UpdateOne(context.TODO(), findDocument, updateDocument)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// FindQuarantined returns files of all users, recently quarantined first
+func (r *UserFileRepository) FindQuarantined() ([]UserFileDto, error) {
+	cursor, err := r.collection().Find(context.TODO(), bson.D{{Key: state, Value: UploadStateQuarantined}}, options.Find().SetSort(bson.D{{Key: QuarantinedAtField, Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]UserFileDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem UserFileDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+func (r *UserFileRepository) GetQuarantined(objId string) (*UserFileDto, error) {
+	fileId, err := primitive.ObjectIDFromHex(objId)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	one := r.collection().FindOne(context.TODO(), bson.D{{Key: Id, Value: fileId}, {Key: state, Value: UploadStateQuarantined}})
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem UserFileDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
+
+// DeleteQuarantined removes file only if it's still quarantined, returns false if it has been released or removed concurrently
+func (r *UserFileRepository) DeleteQuarantined(fileId primitive.ObjectID) (bool, error) {
+	result, err := r.collection().DeleteOne(context.TODO(), bson.D{{Key: Id, Value: fileId}, {Key: state, Value: UploadStateQuarantined}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+// Release makes quarantined file visible, admin takes responsibility for false positive
+func (r *UserFileRepository) Release(fileId primitive.ObjectID) error {
+	result, err := r.collection().UpdateOne(context.TODO(),
+		bson.D{{Key: Id, Value: fileId}, {Key: state, Value: UploadStateQuarantined}},
+		bson.M{"$set": bson.M{state: UploadStateReady}, "$unset": bson.M{quarantineReason: "", QuarantinedAtField: ""}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
@@ -10,22 +10,69 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
 )
 
 const Id = "_id"
 const filename = "filename"
 const published = "published"
 const userId = "userid"
-
-const collectionLimits = "limits"
+const size = "size"
+const contentType = "contenttype"
+const sha256 = "sha256"
+const updated = "updated"
+const state = "state"
+const trashed = "trashed"
+const trashedAt = "trashedat"
+const trashCounted = "trashcounted"
+const linkGeneration = "linkgeneration"
+const passwordHash = "passwordhash"
+const sanitized = "sanitized"
+
+// file is visible in listing only in ready state
+const UploadStateUploading = "uploading"
+const UploadStateReady = "ready"
+
+// infected file stays hidden until admin releases or deletes it
+const UploadStateQuarantined = "quarantined"
+
+const CollectionLimits = "limits"
 const CollectionUserFiles = "userFiles"
 
 // https://vkt.sh/go-mongodb-driver-cookbook/
 type UserFileDto struct {
-	Id        primitive.ObjectID `bson:"_id,omitempty"` // mongo document id equal to minio object jd
-	Filename  string
-	Published bool
-	UserId    int64
+	Id          primitive.ObjectID `bson:"_id,omitempty"` // mongo document id equal to minio object jd
+	Filename    string
+	Published   bool
+	UserId      int64
+	Size        int64
+	ContentType string
+	Sha256      string
+	Created     time.Time
+	Updated     time.Time
+	State       string
+	// file in trash isn't listed and downloadable until restore
+	Trashed   bool
+	TrashedAt time.Time
+	// whether trashed file still takes space from quota
+	TrashCounted bool
+	// share links signed with another generation are revoked
+	LinkGeneration int64
+	// bcrypt hash, published file with password is downloadable only after unlock
+	PasswordHash string
+	// nil for files in root
+	FolderId *primitive.ObjectID `bson:",omitempty"`
+	// user-assigned, searchable together with filename
+	Tags        []string `bson:",omitempty"`
+	Description string   `bson:",omitempty"`
+	// for images embedded into blog posts
+	AltText    string            `bson:",omitempty"`
+	Attributes map[string]string `bson:",omitempty"`
+	// metadata like GPS has been stripped from stored original or from published copy, depending on policy
+	Sanitized bool
+	// name of found malware or failure of scanner
+	QuarantineReason string    `bson:",omitempty"`
+	QuarantinedAt    time.Time `bson:",omitempty"`
 }
 
 type UserFileRepository struct {
@@ -36,6 +83,27 @@ func NewUserFileRepository(mongo *mongo.Client) *UserFileRepository {
 	return &UserFileRepository{mongo: mongo}
 }
 
+const unlimited = "unlimited"
+const plan = "plan"
+const maxBytes = "maxbytes"
+const maxFiles = "maxfiles"
+
+// LimitsDto is admin-defined quota of user. Explicit MaxBytes and MaxFiles take precedence over plan's ones.
+type LimitsDto struct {
+	Id        int `bson:"_id"`
+	Unlimited bool
+	Plan      string `bson:",omitempty"`
+	MaxBytes  int64  `bson:",omitempty"`
+	MaxFiles  int64  `bson:",omitempty"`
+}
+
+type LimitsPatch struct {
+	Unlimited *bool
+	Plan      *string
+	MaxBytes  *int64
+	MaxFiles  *int64
+}
+
 type LimitsRepository struct {
 	mongo *mongo.Client
 }
@@ -44,15 +112,6 @@ func NewLimitsRepository(mongo *mongo.Client) *LimitsRepository {
 	return &LimitsRepository{mongo: mongo}
 }
 
-func ToFileMongoDto(c *mongo.Cursor) (*UserFileDto, error) {
-	var elem UserFileDto
-	err := c.Decode(&elem)
-	if err != nil {
-		return nil, err
-	}
-	return &elem, nil
-}
-
 func GetIdDoc(objectId string) (*bson.D, error) {
 	ids, e := primitive.ObjectIDFromHex(objectId)
 	if e != nil {
@@ -62,6 +121,20 @@ func GetIdDoc(objectId string) (*bson.D, error) {
 	return &ds, nil
 }
 
+// notTrashed matches both files which were restored and ones which were created before trash appeared
+var notTrashed = bson.E{Key: trashed, Value: bson.M{"$ne": true}}
+
+// GetIdAndUserDoc makes filter which matches only document owned by user. Malformed id is reported as absent document
+func GetIdAndUserDoc(objectId string, userIdInt int) (*bson.D, error) {
+	ids, e := primitive.ObjectIDFromHex(objectId)
+	if e != nil {
+		Logger.Infof("Malformed id %v: %v", objectId, e)
+		return nil, mongo.ErrNoDocuments
+	}
+	ds := bson.D{{Id, ids}, {userId, int64(userIdInt)}}
+	return &ds, nil
+}
+
 func GetUpdateDoc(p bson.M) bson.M {
 	update := bson.M{"$set": p}
 	return update
@@ -91,10 +164,21 @@ func (r *UserFileRepository) GetUserIdByGlobalId(objectId string) (int, error) {
 	return int(elem.UserId), nil
 }
 
-func (r *UserFileRepository) InsertMetaInfoToMongo(filename string, userId int) (*string, error) {
+func (r *UserFileRepository) InsertMetaInfoToMongo(filename string, userId int, contentType string, folderId *primitive.ObjectID) (*string, error) {
 	database := utils.GetMongoDatabase(r.mongo)
 
-	inserted, err := database.Collection(CollectionUserFiles).InsertOne(context.TODO(), UserFileDto{Filename: filename, Published: false, UserId: int64(userId)})
+	now := time.Now()
+	dto := UserFileDto{
+		Filename:    filename,
+		Published:   false,
+		UserId:      int64(userId),
+		ContentType: contentType,
+		Created:     now,
+		Updated:     now,
+		State:       UploadStateUploading,
+		FolderId:    folderId,
+	}
+	inserted, err := database.Collection(CollectionUserFiles).InsertOne(context.TODO(), dto)
 	if err != nil {
 		Logger.Errorf("Error during create mongo metadata document: %v", err)
 		return nil, err
@@ -132,17 +216,44 @@ func (r *UserFileRepository) GetMetainfoFromMongo(objectId string) (*UserFileDto
 	return &elem, nil
 }
 
-func (r *UserFileRepository) RenameUserFile(objId string, newname string) error {
+// GetUserFile returns metadata of file only if it's owned by user, otherwise mongo.ErrNoDocuments
+func (r *UserFileRepository) GetUserFile(objectId string, userIdInt int) (*UserFileDto, error) {
+	database := utils.GetMongoDatabase(r.mongo)
+	var userFilesCollection *mongo.Collection = database.Collection(CollectionUserFiles)
+
+	ds, err := GetIdAndUserDoc(objectId, userIdInt)
+	if err != nil {
+		return nil, err
+	}
+
+	one := userFilesCollection.FindOne(context.TODO(), ds)
+	if one.Err() != nil {
+		if one.Err() == mongo.ErrNoDocuments {
+			logger.Logger.Infof("No documents found by key %v for user %v", objectId, userIdInt)
+		} else {
+			logger.Logger.Errorf("Error during querying record from mongo by key %v", objectId)
+		}
+		return nil, one.Err()
+	}
+
+	var elem UserFileDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
+
+func (r *UserFileRepository) RenameUserFile(objId string, userIdInt int, newname string) error {
 	database := utils.GetMongoDatabase(r.mongo)
 	var userFilesCollection *mongo.Collection = database.Collection(CollectionUserFiles)
 
-	findDocument, err := GetIdDoc(objId)
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
 	if err != nil {
 		return err
 	}
-	updateDocument := GetUpdateDoc(primitive.M{filename: newname})
+	updateDocument := GetUpdateDoc(primitive.M{filename: newname, updated: time.Now()})
 
-	one := userFilesCollection.FindOneAndUpdate(context.TODO(), findDocument, updateDocument)
+	one := userFilesCollection.FindOneAndUpdate(context.TODO(), append(*findDocument, notTrashed), updateDocument)
 	if one == nil {
 		return errors.New("Unexpected nil result during update")
 	}
@@ -152,18 +263,51 @@ func (r *UserFileRepository) RenameUserFile(objId string, newname string) error
 	return nil
 }
 
-func (r *UserFileRepository) UpdatePublished(objId string, setValPublished bool) (*UserFileDto, error) {
+// MarkUploaded fills metadata which is known only after object is stored and makes file visible
+func (r *UserFileRepository) MarkUploaded(objId string, userIdInt int, sizeVal int64, sha256Val string, contentTypeVal string, sanitizedVal bool) error {
+	database := utils.GetMongoDatabase(r.mongo)
+	var collection *mongo.Collection = database.Collection(CollectionUserFiles)
+
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
+	if err != nil {
+		return err
+	}
+
+	// content could replace quarantined one, so quarantine details are dropped too
+	updateDocument := GetUpdateDoc(primitive.M{size: sizeVal, sha256: sha256Val, contentType: contentTypeVal, sanitized: sanitizedVal, state: UploadStateReady, updated: time.Now()})
+	updateDocument["$unset"] = bson.M{quarantineReason: "", QuarantinedAtField: ""}
+	result, err := collection.UpdateOne(context.TODO(), findDocument, updateDocument)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// SetSanitized marks that published copy of current content has been stripped of metadata
+func (r *UserFileRepository) SetSanitized(objId primitive.ObjectID, sha256Val string) error {
 	database := utils.GetMongoDatabase(r.mongo)
 	var collection *mongo.Collection = database.Collection(CollectionUserFiles)
 
-	findDocument, err := GetIdDoc(objId)
+	// content could be replaced meanwhile
+	_, err := collection.UpdateOne(context.TODO(), bson.D{{Key: Id, Value: objId}, {Key: sha256, Value: sha256Val}}, GetUpdateDoc(primitive.M{sanitized: true}))
+	return err
+}
+
+func (r *UserFileRepository) UpdatePublished(objId string, userIdInt int, setValPublished bool) (*UserFileDto, error) {
+	database := utils.GetMongoDatabase(r.mongo)
+	var collection *mongo.Collection = database.Collection(CollectionUserFiles)
+
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
 	if err != nil {
 		return nil, err
 	}
 
 	updateDocument := GetUpdateDoc(primitive.M{published: setValPublished})
 
-	one := collection.FindOneAndUpdate(context.TODO(), findDocument, updateDocument)
+	one := collection.FindOneAndUpdate(context.TODO(), append(*findDocument, notTrashed), updateDocument)
 	if one == nil {
 		return nil, errors.New("Unexpected nil result during update")
 	}
@@ -177,22 +321,31 @@ func (r *UserFileRepository) UpdatePublished(objId string, setValPublished bool)
 	return &elem, nil
 }
 
-func (r *UserFileRepository) FindUserFiles(userIdInt int) (*mongo.Cursor, error) {
+// CountUserFiles counts all files of user including ones which are still uploading
+func (r *UserFileRepository) CountUserFiles(userIdInt int, includeTrashed bool) (int64, error) {
 	database := utils.GetMongoDatabase(r.mongo)
-	var collection *mongo.Collection = database.Collection(CollectionUserFiles)
-	return collection.Find(context.TODO(), bson.D{{userId, userIdInt}})
+	filter := bson.D{{userId, userIdInt}}
+	if !includeTrashed {
+		filter = append(filter, notTrashed)
+	}
+	return database.Collection(CollectionUserFiles).CountDocuments(context.TODO(), filter)
 }
 
-func (r *UserFileRepository) Delete(objId string) error {
+func (r *UserFileRepository) Delete(objId string, userIdInt int) error {
 	database := utils.GetMongoDatabase(r.mongo)
 	var collection *mongo.Collection = database.Collection(CollectionUserFiles)
-	d, e := GetIdDoc(objId)
+	d, e := GetIdAndUserDoc(objId, userIdInt)
 	if e != nil {
 		return e
 	}
-	_, e = collection.DeleteOne(context.TODO(), d)
-	return e
-
+	result, e := collection.DeleteOne(context.TODO(), d)
+	if e != nil {
+		return e
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
 }
 
 func IsDocumentExists(mongoC *mongo.Client, collection string, request interface{}, opts ...*options.FindOneOptions) (bool, error) {
@@ -218,23 +371,64 @@ func IsDocumentExists(mongoC *mongo.Client, collection string, request interface
 	}
 }
 
-func (r *LimitsRepository) IsStorageUnlimitedForUser(userId int) (bool, error) {
-	return IsDocumentExists(r.mongo, collectionLimits, bson.D{{Id, userId}})
+// GetUserLimits returns admin-defined limits of user or empty LimitsDto if nothing is defined
+func (r *LimitsRepository) GetUserLimits(userIdInt int) (*LimitsDto, error) {
+	database := utils.GetMongoDatabase(r.mongo)
+	one := database.Collection(CollectionLimits).FindOne(context.TODO(), bson.D{{Id, userIdInt}})
+	if one.Err() == mongo.ErrNoDocuments {
+		return &LimitsDto{Id: userIdInt}, nil
+	}
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem LimitsDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
 }
 
-func (r *LimitsRepository) Patch(userId int, limited bool) error {
+// Patch changes only not nil fields of patch. Empty Plan and zero MaxBytes, MaxFiles remove corresponding value.
+func (r *LimitsRepository) Patch(userIdInt int, patch LimitsPatch) error {
 	database := utils.GetMongoDatabase(r.mongo)
-	if limited {
-		_, e := database.Collection(collectionLimits).DeleteOne(context.TODO(), bson.D{{Id, userId}})
-		if e != nil {
-			return e
+	var set = bson.M{}
+	var unset = bson.M{}
+	if patch.Unlimited != nil {
+		set[unlimited] = *patch.Unlimited
+	}
+	if patch.Plan != nil {
+		if len(*patch.Plan) == 0 {
+			unset[plan] = ""
+		} else {
+			set[plan] = *patch.Plan
 		}
-	} else {
-		// unlimited
-		_, e := database.Collection(collectionLimits).InsertOne(context.TODO(), bson.D{{Id, userId}})
-		if e != nil {
-			return e
+	}
+	if patch.MaxBytes != nil {
+		if *patch.MaxBytes == 0 {
+			unset[maxBytes] = ""
+		} else {
+			set[maxBytes] = *patch.MaxBytes
 		}
 	}
-	return nil
+	if patch.MaxFiles != nil {
+		if *patch.MaxFiles == 0 {
+			unset[maxFiles] = ""
+		} else {
+			set[maxFiles] = *patch.MaxFiles
+		}
+	}
+
+	var update = bson.M{}
+	if len(set) != 0 {
+		update["$set"] = set
+	}
+	if len(unset) != 0 {
+		update["$unset"] = unset
+	}
+	if len(update) == 0 {
+		return nil
+	}
+	var upsert = true
+	_, e := database.Collection(CollectionLimits).UpdateOne(context.TODO(), bson.D{{Id, userIdInt}}, update, &options.UpdateOptions{Upsert: &upsert})
+	return e
 }
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"strings"
+)
+
+const SearchIndexName = "search"
+const TagsField = "tags"
+const DescriptionField = "description"
+
+// SearchableFields are covered by text index, filename weighs most
+var SearchableFields = map[string]int32{filename: 10, TagsField: 5, DescriptionField: 1}
+
+// SearchQuery looks for files of user or, if UserId is nil, of all users
+type SearchQuery struct {
+	UserId *int
+	Terms  []string
+	Limit  int64
+}
+
+type SearchResultDto struct {
+	UserFileDto `bson:",inline"`
+	Score       float64
+}
+
+func (q *SearchQuery) scope() bson.D {
+	filter := bson.D{{Key: state, Value: UploadStateReady}, notTrashed}
+	if q.UserId != nil {
+		filter = append(filter, bson.E{Key: userId, Value: int64(*q.UserId)})
+	}
+	return filter
+}
+
+func (r *UserFileRepository) findSearchResults(filter bson.D, findOptions *options.FindOptions) ([]SearchResultDto, error) {
+	cursor, err := r.collection().Find(context.TODO(), filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]SearchResultDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem SearchResultDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+// SearchText finds files containing whole words using text index, most relevant first
+func (r *UserFileRepository) SearchText(q SearchQuery) ([]SearchResultDto, error) {
+	filter := append(q.scope(), bson.E{Key: "$text", Value: bson.M{"$search": strings.Join(q.Terms, " ")}})
+	score := bson.M{"score": bson.M{"$meta": "textScore"}}
+	return r.findSearchResults(filter, options.Find().SetProjection(score).SetSort(score).SetLimit(q.Limit))
+}
+
+// SearchPrefix finds files having words which start with every term, text index doesn't support it
+func (r *UserFileRepository) SearchPrefix(q SearchQuery) ([]SearchResultDto, error) {
+	var allTerms = bson.A{}
+	for _, term := range q.Terms {
+		wordStart := primitive.Regex{Pattern: `(^|[^\p{L}\p{N}])` + regexp.QuoteMeta(term), Options: "i"}
+		var anyField = bson.A{}
+		for field := range SearchableFields {
+			anyField = append(anyField, bson.M{field: wordStart})
+		}
+		allTerms = append(allTerms, bson.M{"$or": anyField})
+	}
+	filter := append(q.scope(), bson.E{Key: "$and", Value: allTerms})
+	return r.findSearchResults(filter, options.Find().SetSort(bson.D{{Key: filename, Value: 1}}).SetLimit(q.Limit))
+}
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const CollectionShareLinkDownloads = "shareLinkDownloads"
+
+const downloads = "downloads"
+const ShareLinkExpiresField = "expires"
+
+// ShareLinkDownloadsDto counts downloads by share link with limited count of downloads.
+// Links themselves aren't stored, document is created on first download and removed by ttl index after expiration.
+type ShareLinkDownloadsDto struct {
+	Id        string `bson:"_id"` // nonce of link
+	FileId    primitive.ObjectID
+	Downloads int64
+	Expires   time.Time
+}
+
+type ShareLinkRepository struct {
+	mongo *mongo.Client
+}
+
+func NewShareLinkRepository(mongo *mongo.Client) *ShareLinkRepository {
+	return &ShareLinkRepository{mongo: mongo}
+}
+
+func (r *ShareLinkRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionShareLinkDownloads)
+}
+
+// TryConsume atomically counts download if link has not exhausted max downloads. Returns false if it has.
+func (r *ShareLinkRepository) TryConsume(nonce string, fileId primitive.ObjectID, max int64, expires time.Time) (bool, error) {
+	var upsert = true
+	setOnInsert := bson.M{"$setOnInsert": bson.M{"fileid": fileId, downloads: int64(0), ShareLinkExpiresField: expires}}
+	_, err := r.collection().UpdateOne(context.TODO(), bson.D{{Key: Id, Value: nonce}}, setOnInsert, &options.UpdateOptions{Upsert: &upsert})
+	if err != nil {
+		// concurrent upsert may fail on unique _id, document exists anyway
+		Logger.Infof("Retrying creating downloads document for link %v after error: %v", nonce, err)
+		_, err = r.collection().UpdateOne(context.TODO(), bson.D{{Key: Id, Value: nonce}}, setOnInsert, &options.UpdateOptions{Upsert: &upsert})
+		if err != nil {
+			return false, err
+		}
+	}
+	filter := bson.D{{Key: Id, Value: nonce}, {Key: downloads, Value: bson.M{"$lt": max}}}
+	result, err := r.collection().UpdateOne(context.TODO(), filter, bson.M{"$inc": bson.M{downloads: int64(1)}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// RevokeLinks invalidates all share links of file issued before
+func (r *UserFileRepository) RevokeLinks(objId string, userIdInt int) (*UserFileDto, error) {
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
+	if err != nil {
+		return nil, err
+	}
+	var after = options.After
+	one := r.collection().FindOneAndUpdate(context.TODO(), append(*findDocument, notTrashed), bson.M{"$inc": bson.M{linkGeneration: int64(1)}}, &options.FindOneAndUpdateOptions{ReturnDocument: &after})
+	if one == nil {
+		return nil, errors.New("Unexpected nil result during update")
+	}
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem UserFileDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
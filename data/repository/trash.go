@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"context"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+func (r *UserFileRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionUserFiles)
+}
+
+// DeleteTrashed removes file only if it's still in trash, returns false if it has been restored or removed concurrently
+func (r *UserFileRepository) DeleteTrashed(fileId primitive.ObjectID, userIdInt int) (bool, error) {
+	result, err := r.collection().DeleteOne(context.TODO(), bson.D{{Key: Id, Value: fileId}, {Key: userId, Value: int64(userIdInt)}, {Key: trashed, Value: true}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+// MoveToTrash returns file as it was before moving
+func (r *UserFileRepository) MoveToTrash(objId string, userIdInt int, counted bool) (*UserFileDto, error) {
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
+	if err != nil {
+		return nil, err
+	}
+	update := GetUpdateDoc(bson.M{trashed: true, trashedAt: time.Now(), trashCounted: counted})
+	one := r.collection().FindOneAndUpdate(context.TODO(), append(*findDocument, notTrashed), update)
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem UserFileDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
+
+// Restore returns file as it was in trash
+func (r *UserFileRepository) Restore(objId string, userIdInt int) (*UserFileDto, error) {
+	findDocument, err := GetIdAndUserDoc(objId, userIdInt)
+	if err != nil {
+		return nil, err
+	}
+	update := bson.M{
+		"$set":   bson.M{trashed: false},
+		"$unset": bson.M{trashedAt: "", trashCounted: ""},
+	}
+	one := r.collection().FindOneAndUpdate(context.TODO(), append(*findDocument, bson.E{Key: trashed, Value: true}), update)
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem UserFileDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
+
+func (r *UserFileRepository) findTrashed(filter bson.D) ([]UserFileDto, error) {
+	cursor, err := r.collection().Find(context.TODO(), append(filter, bson.E{Key: trashed, Value: true}), options.Find().SetSort(bson.D{{Key: trashedAt, Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]UserFileDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem UserFileDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+func (r *UserFileRepository) FindTrashed(userIdInt int) ([]UserFileDto, error) {
+	return r.findTrashed(bson.D{{Key: userId, Value: userIdInt}})
+}
+
+// FindTrashedBefore returns files of all users which were trashed before given time
+func (r *UserFileRepository) FindTrashedBefore(before time.Time) ([]UserFileDto, error) {
+	return r.findTrashed(bson.D{{Key: trashedAt, Value: bson.M{"$lt": before}}})
+}
+
+// SumTrashedUncounted returns size of trashed files which don't take space from quota
+func (r *UserFileRepository) SumTrashedUncounted(userIdInt int) (int64, error) {
+	list, err := r.findTrashed(bson.D{{Key: userId, Value: userIdInt}, {Key: trashCounted, Value: false}})
+	if err != nil {
+		return 0, err
+	}
+	var sum int64
+	for _, elem := range list {
+		sum += elem.Size
+	}
+	return sum, nil
+}
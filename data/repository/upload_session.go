@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"context"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+const CollectionUploadSessions = "uploadSessions"
+
+const offset = "offset"
+const parts = "parts"
+const expires = "expires"
+const fileId = "fileid"
+
+// UploadPartDto is one PATCH request of resumable upload stored as separate object in uploads bucket
+type UploadPartDto struct {
+	Key  string
+	Size int64
+}
+
+type UploadSessionDto struct {
+	Id          primitive.ObjectID `bson:"_id,omitempty"`
+	UserId      int64
+	Filename    string
+	ContentType string
+	Length      int64
+	Offset      int64
+	Parts       []UploadPartDto
+	Expires     time.Time
+	// folder of created file, nil for root
+	FolderId *primitive.ObjectID `bson:",omitempty"`
+	// id of created UserFileDto, empty until upload is completed
+	FileId string
+}
+
+func (s *UploadSessionDto) IsCompleted() bool {
+	return len(s.FileId) != 0
+}
+
+type UploadSessionRepository struct {
+	mongo *mongo.Client
+}
+
+func NewUploadSessionRepository(mongo *mongo.Client) *UploadSessionRepository {
+	return &UploadSessionRepository{mongo: mongo}
+}
+
+func (r *UploadSessionRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionUploadSessions)
+}
+
+func (r *UploadSessionRepository) Create(session UploadSessionDto) (*string, error) {
+	session.Parts = make([]UploadPartDto, 0)
+	inserted, err := r.collection().InsertOne(context.TODO(), session)
+	if err != nil {
+		Logger.Errorf("Error during create upload session: %v", err)
+		return nil, err
+	}
+	id := inserted.InsertedID.(primitive.ObjectID).Hex()
+	return &id, nil
+}
+
+func (r *UploadSessionRepository) GetUserSession(sessionId string, userIdInt int) (*UploadSessionDto, error) {
+	ds, err := GetIdAndUserDoc(sessionId, userIdInt)
+	if err != nil {
+		return nil, err
+	}
+	one := r.collection().FindOne(context.TODO(), ds)
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem UploadSessionDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
+
+// AppendPart moves offset only if nobody has moved it concurrently. Returns false if offset has been changed.
+func (r *UploadSessionRepository) AppendPart(sessionId string, userIdInt int, expectedOffset int64, part UploadPartDto, newExpires time.Time) (bool, error) {
+	ds, err := GetIdAndUserDoc(sessionId, userIdInt)
+	if err != nil {
+		return false, err
+	}
+	filter := append(*ds, bson.E{Key: offset, Value: expectedOffset}, bson.E{Key: fileId, Value: ""})
+	update := bson.M{
+		"$set":  bson.M{offset: expectedOffset + part.Size, expires: newExpires},
+		"$push": bson.M{parts: part},
+	}
+	result, err := r.collection().UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// Complete marks session as finished, parts aren't needed anymore. Returns false if session has already been completed by concurrent request.
+func (r *UploadSessionRepository) Complete(sessionId string, userIdInt int, createdFileId string) (bool, error) {
+	ds, err := GetIdAndUserDoc(sessionId, userIdInt)
+	if err != nil {
+		return false, err
+	}
+	filter := append(*ds, bson.E{Key: fileId, Value: ""})
+	result, err := r.collection().UpdateOne(context.TODO(), filter, GetUpdateDoc(bson.M{fileId: createdFileId, parts: []UploadPartDto{}}))
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// Delete returns false if session has already been removed by someone else
+func (r *UploadSessionRepository) Delete(sessionId primitive.ObjectID) (bool, error) {
+	result, err := r.collection().DeleteOne(context.TODO(), bson.D{{Key: Id, Value: sessionId}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+func (r *UploadSessionRepository) FindExpired(now time.Time) ([]UploadSessionDto, error) {
+	cursor, err := r.collection().Find(context.TODO(), bson.M{expires: bson.M{"$lt": now}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]UploadSessionDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem UploadSessionDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+func (r *UploadSessionRepository) CountPending(userIdInt int) (int64, error) {
+	return r.collection().CountDocuments(context.TODO(), bson.M{userId: int64(userIdInt), fileId: ""})
+}
+
+// CountPendingInFolders counts not yet completed uploads of user into any of folders
+func (r *UploadSessionRepository) CountPendingInFolders(userIdInt int, folders []primitive.ObjectID) (int64, error) {
+	return r.collection().CountDocuments(context.TODO(), bson.M{userId: int64(userIdInt), fileId: "", folderId: bson.M{"$in": folders}})
+}
+
+// SumPendingLength returns bytes which are reserved by not yet completed uploads of user
+func (r *UploadSessionRepository) SumPendingLength(userIdInt int) (int64, error) {
+	cursor, err := r.collection().Find(context.TODO(), bson.M{userId: int64(userIdInt), fileId: ""})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.TODO())
+	var sum int64
+	for cursor.Next(context.TODO()) {
+		var elem UploadSessionDto
+		if err := cursor.Decode(&elem); err != nil {
+			return 0, err
+		}
+		sum += elem.Length
+	}
+	return sum, cursor.Err()
+}
@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionUsage = "usage"
+
+const used = "used"
+
+// UsageDto holds bytes consumed by user including space reserved by unfinished uploads
+type UsageDto struct {
+	Id   int `bson:"_id"`
+	Used int64
+}
+
+type UsageRepository struct {
+	mongo *mongo.Client
+}
+
+func NewUsageRepository(mongo *mongo.Client) *UsageRepository {
+	return &UsageRepository{mongo: mongo}
+}
+
+func (r *UsageRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionUsage)
+}
+
+func (r *UsageRepository) GetUsed(userIdInt int) (int64, error) {
+	one := r.collection().FindOne(context.TODO(), bson.D{{Key: Id, Value: userIdInt}})
+	if one.Err() == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if one.Err() != nil {
+		return 0, one.Err()
+	}
+	var elem UsageDto
+	if err := one.Decode(&elem); err != nil {
+		return 0, err
+	}
+	return elem.Used, nil
+}
+
+// FindAll returns usage of every user who has ever uploaded something
+func (r *UsageRepository) FindAll() ([]UsageDto, error) {
+	cursor, err := r.collection().Find(context.TODO(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]UsageDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem UsageDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+func (r *UsageRepository) ensureDocument(userIdInt int) error {
+	var upsert = true
+	_, err := r.collection().UpdateOne(context.TODO(), bson.D{{Key: Id, Value: userIdInt}}, bson.M{"$setOnInsert": bson.M{used: int64(0)}}, &options.UpdateOptions{Upsert: &upsert})
+	if err != nil {
+		// concurrent upsert may fail on unique _id, document exists anyway
+		Logger.Infof("Retrying creating usage document for user %v after error: %v", userIdInt, err)
+		_, err = r.collection().UpdateOne(context.TODO(), bson.D{{Key: Id, Value: userIdInt}}, bson.M{"$setOnInsert": bson.M{used: int64(0)}}, &options.UpdateOptions{Upsert: &upsert})
+	}
+	return err
+}
+
+// Reserve atomically increases usage only if it remains within max. Returns false if there is no enough space.
+func (r *UsageRepository) Reserve(userIdInt int, sizeVal int64, max int64) (bool, error) {
+	if err := r.ensureDocument(userIdInt); err != nil {
+		return false, err
+	}
+	filter := bson.D{{Key: Id, Value: userIdInt}, {Key: used, Value: bson.M{"$lte": max - sizeVal}}}
+	result, err := r.collection().UpdateOne(context.TODO(), filter, bson.M{"$inc": bson.M{used: sizeVal}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// Add changes usage unconditionally, negative delta releases space
+func (r *UsageRepository) Add(userIdInt int, delta int64) error {
+	if err := r.ensureDocument(userIdInt); err != nil {
+		return err
+	}
+	_, err := r.collection().UpdateOne(context.TODO(), bson.D{{Key: Id, Value: userIdInt}}, bson.M{"$inc": bson.M{used: delta}})
+	return err
+}
+
+// Set overwrites usage, it's used by reconciliation
+func (r *UsageRepository) Set(userIdInt int, usedVal int64) error {
+	var upsert = true
+	_, err := r.collection().UpdateOne(context.TODO(), bson.D{{Key: Id, Value: userIdInt}}, GetUpdateDoc(bson.M{used: usedVal}), &options.UpdateOptions{Upsert: &upsert})
+	return err
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"context"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const CollectionFileVersions = "fileVersions"
+
+const fileIdField = "fileid"
+
+// FileVersionDto is previous content of file. Its id is key of object in user's bucket.
+type FileVersionDto struct {
+	Id          primitive.ObjectID `bson:"_id,omitempty"`
+	FileId      primitive.ObjectID
+	UserId      int64
+	Size        int64
+	ContentType string
+	Sha256      string
+	Sanitized   bool
+	// when this content was uploaded
+	Created time.Time
+	// when this content was replaced
+	Replaced time.Time
+}
+
+type FileVersionRepository struct {
+	mongo *mongo.Client
+}
+
+func NewFileVersionRepository(mongo *mongo.Client) *FileVersionRepository {
+	return &FileVersionRepository{mongo: mongo}
+}
+
+func (r *FileVersionRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionFileVersions)
+}
+
+// NewVersionOf makes version from current state of file, it should be inserted after content is copied
+func NewVersionOf(file *UserFileDto) FileVersionDto {
+	return FileVersionDto{
+		Id:          primitive.NewObjectID(),
+		FileId:      file.Id,
+		UserId:      file.UserId,
+		Size:        file.Size,
+		ContentType: file.ContentType,
+		Sha256:      file.Sha256,
+		Sanitized:   file.Sanitized,
+		Created:     file.Updated,
+		Replaced:    time.Now(),
+	}
+}
+
+func (r *FileVersionRepository) Insert(version FileVersionDto) error {
+	_, err := r.collection().InsertOne(context.TODO(), version)
+	return err
+}
+
+func (r *FileVersionRepository) getFilter(fileIdStr, versionIdStr string, userIdInt int) (bson.D, error) {
+	ds, err := GetIdAndUserDoc(versionIdStr, userIdInt)
+	if err != nil {
+		return nil, err
+	}
+	fileObjectId, err := primitive.ObjectIDFromHex(fileIdStr)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	return append(*ds, bson.E{Key: fileIdField, Value: fileObjectId}), nil
+}
+
+func (r *FileVersionRepository) GetUserVersion(fileIdStr, versionIdStr string, userIdInt int) (*FileVersionDto, error) {
+	filter, err := r.getFilter(fileIdStr, versionIdStr, userIdInt)
+	if err != nil {
+		return nil, err
+	}
+	one := r.collection().FindOne(context.TODO(), filter)
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem FileVersionDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
+
+// FindVersions returns versions of file newest first
+func (r *FileVersionRepository) FindVersions(fileObjectId primitive.ObjectID) ([]FileVersionDto, error) {
+	cursor, err := r.collection().Find(context.TODO(), bson.D{{Key: fileIdField, Value: fileObjectId}}, options.Find().SetSort(bson.D{{Key: "replaced", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]FileVersionDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem FileVersionDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
+
+// Delete returns false if version has already been removed
+func (r *FileVersionRepository) Delete(versionId primitive.ObjectID) (bool, error) {
+	result, err := r.collection().DeleteOne(context.TODO(), bson.D{{Key: Id, Value: versionId}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
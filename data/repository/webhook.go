@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionWebhookDeliveries = "webhookDeliveries"
+
+const WebhookStatusPending = "pending"
+const WebhookStatusDelivered = "delivered"
+const WebhookStatusFailed = "failed"
+
+const WebhookStatusField = "status"
+const WebhookNextAttemptField = "nextattempt"
+const WebhookCreatedField = "created"
+const WebhookExpiresField = "expires"
+const webhookEvent = "event"
+
+// WebhookDeliveryDto is outbox entry, one per event and subscription. Pending entries survive restart and are picked up by any replica.
+type WebhookDeliveryDto struct {
+	Id    primitive.ObjectID `bson:"_id,omitempty"`
+	Url   string
+	Event string
+	// signed body, kept as is so replay sends identical bytes
+	Payload     string
+	Status      string
+	Attempts    int
+	NextAttempt time.Time
+	LastStatus  int    `bson:",omitempty"`
+	LastError   string `bson:",omitempty"`
+	Created     time.Time
+	Delivered   *time.Time `bson:",omitempty"`
+	// set when delivery is finished either way, removed by TTL index
+	Expires *time.Time `bson:",omitempty"`
+}
+
+type WebhookDeliveryRepository struct {
+	mongo *mongo.Client
+}
+
+func NewWebhookDeliveryRepository(mongo *mongo.Client) *WebhookDeliveryRepository {
+	return &WebhookDeliveryRepository{mongo: mongo}
+}
+
+func (r *WebhookDeliveryRepository) collection() *mongo.Collection {
+	return utils.GetMongoDatabase(r.mongo).Collection(CollectionWebhookDeliveries)
+}
+
+func (r *WebhookDeliveryRepository) Insert(dto WebhookDeliveryDto) error {
+	_, err := r.collection().InsertOne(context.TODO(), dto)
+	return err
+}
+
+// ClaimDue takes one pending delivery whose time has come and postpones it by lease,
+// so other replica doesn't send it concurrently. Returns mongo.ErrNoDocuments when there is nothing to send.
+func (r *WebhookDeliveryRepository) ClaimDue(now time.Time, lease time.Duration) (*WebhookDeliveryDto, error) {
+	filter := bson.D{{Key: WebhookStatusField, Value: WebhookStatusPending}, {Key: WebhookNextAttemptField, Value: bson.M{"$lte": now}}}
+	var before = options.Before
+	one := r.collection().FindOneAndUpdate(context.TODO(), filter, GetUpdateDoc(bson.M{WebhookNextAttemptField: now.Add(lease)}),
+		&options.FindOneAndUpdateOptions{ReturnDocument: &before, Sort: bson.D{{Key: WebhookNextAttemptField, Value: 1}}})
+	if one == nil {
+		return nil, errors.New("Unexpected nil result during update")
+	}
+	if one.Err() != nil {
+		return nil, one.Err()
+	}
+	var elem WebhookDeliveryDto
+	if err := one.Decode(&elem); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
+
+func (r *WebhookDeliveryRepository) MarkDelivered(id primitive.ObjectID, httpStatus int, expires time.Time) error {
+	now := time.Now()
+	_, err := r.collection().UpdateOne(context.TODO(), bson.D{{Key: Id, Value: id}}, bson.M{
+		"$set":   bson.M{WebhookStatusField: WebhookStatusDelivered, "laststatus": httpStatus, "delivered": now, WebhookExpiresField: expires},
+		"$unset": bson.M{"lasterror": ""},
+		"$inc":   bson.M{"attempts": 1},
+	})
+	return err
+}
+
+// MarkAttemptFailed schedules next attempt, or gives up when nextAttempt is nil
+func (r *WebhookDeliveryRepository) MarkAttemptFailed(id primitive.ObjectID, httpStatus int, reason string, nextAttempt *time.Time, expires time.Time) error {
+	set := bson.M{"laststatus": httpStatus, "lasterror": reason}
+	if nextAttempt != nil {
+		set[WebhookNextAttemptField] = *nextAttempt
+	} else {
+		set[WebhookStatusField] = WebhookStatusFailed
+		set[WebhookExpiresField] = expires
+	}
+	_, err := r.collection().UpdateOne(context.TODO(), bson.D{{Key: Id, Value: id}}, bson.M{"$set": set, "$inc": bson.M{"attempts": 1}})
+	return err
+}
+
+// Replay puts failed delivery back to outbox with fresh count of attempts
+func (r *WebhookDeliveryRepository) Replay(deliveryId string) error {
+	id, err := primitive.ObjectIDFromHex(deliveryId)
+	if err != nil {
+		return mongo.ErrNoDocuments
+	}
+	result, err := r.collection().UpdateOne(context.TODO(), bson.D{{Key: Id, Value: id}, {Key: WebhookStatusField, Value: WebhookStatusFailed}}, bson.M{
+		"$set":   bson.M{WebhookStatusField: WebhookStatusPending, "attempts": 0, WebhookNextAttemptField: time.Now()},
+		"$unset": bson.M{WebhookExpiresField: ""},
+	})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// ReplayFailed puts all failed deliveries back to outbox
+func (r *WebhookDeliveryRepository) ReplayFailed() (int64, error) {
+	result, err := r.collection().UpdateMany(context.TODO(), bson.D{{Key: WebhookStatusField, Value: WebhookStatusFailed}}, bson.M{
+		"$set":   bson.M{WebhookStatusField: WebhookStatusPending, "attempts": 0, WebhookNextAttemptField: time.Now()},
+		"$unset": bson.M{WebhookExpiresField: ""},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// Find returns newest deliveries first, empty status or event match everything
+func (r *WebhookDeliveryRepository) Find(status, event string, limit int64) ([]WebhookDeliveryDto, error) {
+	filter := bson.D{}
+	if len(status) != 0 {
+		filter = append(filter, bson.E{Key: WebhookStatusField, Value: status})
+	}
+	if len(event) != 0 {
+		filter = append(filter, bson.E{Key: webhookEvent, Value: event})
+	}
+	cursor, err := r.collection().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: WebhookCreatedField, Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	var list = make([]WebhookDeliveryDto, 0)
+	for cursor.Next(context.TODO()) {
+		var elem WebhookDeliveryDto
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+	return list, cursor.Err()
+}
@@ -0,0 +1,394 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const AuditTargetFile = "file"
+const AuditTargetFolder = "folder"
+const AuditTargetUser = "user"
+const AuditTargetUpload = "upload"
+const AuditTargetWebhook = "webhook"
+
+const defaultAuditLimit = 100
+const maxAuditLimit = 1000
+
+// fields which values never get into audit log
+var auditRedactedFields = map[string]bool{
+	"passwordhash": true,
+}
+
+type AuditEntryDto struct {
+	Id         string                 `json:"id"`
+	Time       time.Time              `json:"time"`
+	ActorId    int64                  `json:"actorId"`
+	ActorLogin string                 `json:"actorLogin"`
+	Action     string                 `json:"action"`
+	TargetType string                 `json:"targetType"`
+	TargetId   string                 `json:"targetId"`
+	Before     map[string]interface{} `json:"before"`
+	After      map[string]interface{} `json:"after"`
+	Status     int                    `json:"status"`
+	Ip         string                 `json:"ip"`
+	RequestId  string                 `json:"requestId"`
+}
+
+// auditState is filled by handler when middleware cannot determine target or changes itself
+type auditState struct {
+	targetType string
+	targetId   string
+	before     bson.M
+	after      bson.M
+	skip       bool
+}
+
+// getTrustedProxies reads server.trustedProxies, entry is either address or CIDR
+func getTrustedProxies() []*net.IPNet {
+	var list []*net.IPNet
+	for _, entry := range viper.GetStringSlice("server.trustedProxies") {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			Logger.Warnf("Skipping wrong trusted proxy %v: %v", entry, err)
+			continue
+		}
+		list = append(list, network)
+	}
+	return list
+}
+
+func isTrustedProxy(trusted []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIp returns address of peer. Forwarded headers are honoured only when peer is trusted proxy, otherwise client could put any address there.
+func getClientIp(c echo.Context) string {
+	remoteIp, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		remoteIp = c.Request().RemoteAddr
+	}
+	trusted := getTrustedProxies()
+	if !isTrustedProxy(trusted, remoteIp) {
+		return remoteIp
+	}
+	if forwarded := c.Request().Header.Values(echo.HeaderXForwardedFor); len(forwarded) != 0 {
+		// each proxy appends address of its peer, so nearest untrusted one is the client, entries before it could be forged
+		addresses := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(addresses) - 1; i >= 0; i-- {
+			address := strings.TrimSpace(addresses[i])
+			if i == 0 || !isTrustedProxy(trusted, address) {
+				return address
+			}
+		}
+	}
+	if realIp := c.Request().Header.Get(echo.HeaderXRealIP); len(realIp) != 0 {
+		return realIp
+	}
+	return remoteIp
+}
+
+func getAuditRetention() time.Duration {
+	viper.SetDefault("audit.retention", "2160h")
+	return viper.GetDuration("audit.retention")
+}
+
+func getAuditState(c echo.Context) *auditState {
+	state, ok := c.Get(utils.AUDIT).(*auditState)
+	if !ok {
+		// route isn't audited
+		return &auditState{}
+	}
+	return state
+}
+
+func setAuditTarget(c echo.Context, targetType, targetId string) {
+	state := getAuditState(c)
+	state.targetType = targetType
+	state.targetId = targetId
+}
+
+// setAuditChange is for targets which middleware cannot snapshot itself
+func setAuditChange(c echo.Context, before, after interface{}) {
+	state := getAuditState(c)
+	state.before = toAuditValue(before)
+	state.after = toAuditValue(after)
+}
+
+// skipAudit is used when request hasn't changed anything worth recording, like intermediate chunk of resumable upload
+func skipAudit(c echo.Context) {
+	getAuditState(c).skip = true
+}
+
+// toAuditValue keeps json names of dto fields
+func toAuditValue(value interface{}) bson.M {
+	if value == nil || (reflect.ValueOf(value).Kind() == reflect.Ptr && reflect.ValueOf(value).IsNil()) {
+		return nil
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		Logger.Errorf("Error during marshalling audit value: %v", err)
+		return nil
+	}
+	var m bson.M
+	if err := json.Unmarshal(bytes, &m); err != nil {
+		return bson.M{"value": string(bytes)}
+	}
+	return m
+}
+
+func getDefaultAuditTarget(c echo.Context) (string, string) {
+	if fileId := c.Param("file"); len(fileId) != 0 {
+		return AuditTargetFile, fileId
+	}
+	if folderId := c.Param("folder"); len(folderId) != 0 {
+		return AuditTargetFolder, folderId
+	}
+	if sessionId := c.Param("id"); len(sessionId) != 0 {
+		return AuditTargetUpload, sessionId
+	}
+	return "", ""
+}
+
+// getAuditSnapshot reads stored state of file or folder, so changes are recorded without help of handler
+func (h *FsHandler) getAuditSnapshot(c echo.Context, targetType, targetId string) bson.M {
+	var dto interface{}
+	switch targetType {
+	case AuditTargetFile:
+		file, err := h.userFileRepository.GetMetainfoFromMongo(targetId)
+		if err != nil {
+			return nil
+		}
+		dto = file
+	case AuditTargetFolder:
+		userId, _ := getUserIdFromContext(c)
+		folder, err := h.folderRepository.GetUserFolder(targetId, userId)
+		if err != nil {
+			return nil
+		}
+		dto = folder
+	default:
+		return nil
+	}
+	raw, err := bson.Marshal(dto)
+	if err != nil {
+		Logger.Errorf("Error during making audit snapshot of %v %v: %v", targetType, targetId, err)
+		return nil
+	}
+	var snapshot bson.M
+	if err := bson.Unmarshal(raw, &snapshot); err != nil {
+		return nil
+	}
+	delete(snapshot, "_id")
+	for field := range snapshot {
+		if auditRedactedFields[field] {
+			snapshot[field] = "<redacted>"
+		}
+	}
+	return snapshot
+}
+
+// diffAuditSnapshots leaves only changed fields
+func diffAuditSnapshots(before, after bson.M) (bson.M, bson.M) {
+	if before == nil || after == nil {
+		return before, after
+	}
+	changedBefore, changedAfter := bson.M{}, bson.M{}
+	for field, value := range before {
+		if !reflect.DeepEqual(value, after[field]) {
+			changedBefore[field] = value
+		}
+	}
+	for field, value := range after {
+		if !reflect.DeepEqual(value, before[field]) {
+			changedAfter[field] = value
+		}
+	}
+	if len(changedBefore) == 0 {
+		changedBefore = nil
+	}
+	if len(changedAfter) == 0 {
+		changedAfter = nil
+	}
+	return changedBefore, changedAfter
+}
+
+func getAuditStatus(c echo.Context, err error) int {
+	if err == nil || c.Response().Committed {
+		return c.Response().Status
+	}
+	if he, ok := err.(*echo.HTTPError); ok {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// Audit records mutating request, including rejected ones, to append-only log
+func (h *FsHandler) Audit(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			state := &auditState{}
+			state.targetType, state.targetId = getDefaultAuditTarget(c)
+			c.Set(utils.AUDIT, state)
+			snapshot := h.getAuditSnapshot(c, state.targetType, state.targetId)
+
+			err := next(c)
+			if state.skip {
+				return err
+			}
+
+			if state.before == nil && state.after == nil {
+				state.before, state.after = diffAuditSnapshots(snapshot, h.getAuditSnapshot(c, state.targetType, state.targetId))
+			}
+			actorId, _ := getUserIdFromContext(c)
+			actorLogin, _ := c.Get(utils.USER_LOGIN).(string)
+			entry := repository.AuditDto{
+				Time:       time.Now(),
+				ActorId:    int64(actorId),
+				ActorLogin: actorLogin,
+				Action:     action,
+				TargetType: state.targetType,
+				TargetId:   state.targetId,
+				Before:     state.before,
+				After:      state.after,
+				Status:     getAuditStatus(c, err),
+				Ip:         getClientIp(c),
+				RequestId:  c.Response().Header().Get(echo.HeaderXRequestID),
+			}
+			if retention := getAuditRetention(); retention > 0 {
+				expires := entry.Time.Add(retention)
+				entry.Expires = &expires
+			}
+			if insertErr := h.auditRepository.Insert(entry); insertErr != nil {
+				Logger.Errorf("Error during writing audit entry %v of %v: %v", action, actorId, insertErr)
+			}
+			return err
+		}
+	}
+}
+
+// normalizeAuditValue converts values decoded from mongo to ones which are rendered naturally in json
+func normalizeAuditValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case primitive.D:
+		m := map[string]interface{}{}
+		for _, e := range v {
+			m[e.Key] = normalizeAuditValue(e.Value)
+		}
+		return m
+	case primitive.M:
+		m := map[string]interface{}{}
+		for key, e := range v {
+			m[key] = normalizeAuditValue(e)
+		}
+		return m
+	case primitive.A:
+		list := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			list = append(list, normalizeAuditValue(e))
+		}
+		return list
+	case primitive.DateTime:
+		return time.Unix(0, int64(v)*int64(time.Millisecond)).UTC()
+	case primitive.ObjectID:
+		return v.Hex()
+	default:
+		return v
+	}
+}
+
+func normalizeAuditMap(m bson.M) map[string]interface{} {
+	if m == nil {
+		return map[string]interface{}{}
+	}
+	return normalizeAuditValue(m).(map[string]interface{})
+}
+
+func parseAuditTime(c echo.Context, name string) (time.Time, bool) {
+	str := c.QueryParam(name)
+	if len(str) == 0 {
+		return time.Time{}, true
+	}
+	parsed, err := time.Parse(time.RFC3339, str)
+	return parsed, err == nil
+}
+
+// AdminAuditHandler returns newest entries first, filtered by userId of actor, action and from/to in RFC3339
+func (h *FsHandler) AdminAuditHandler(c echo.Context) error {
+	if !getUserAdminFromContext(c) {
+		return c.JSON(http.StatusUnauthorized, &utils.H{"status": "not admin"})
+	}
+	q := repository.AuditQuery{Action: c.QueryParam("action"), Limit: defaultAuditLimit}
+	if userIdStr := c.QueryParam(utils.USER_ID); len(userIdStr) != 0 {
+		actorId, err := strconv.ParseInt(userIdStr, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong " + utils.USER_ID})
+		}
+		q.ActorId = &actorId
+	}
+	var ok bool
+	if q.From, ok = parseAuditTime(c, "from"); !ok {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong from"})
+	}
+	if q.To, ok = parseAuditTime(c, "to"); !ok {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong to"})
+	}
+	if limitStr := c.QueryParam("limit"); len(limitStr) != 0 {
+		limit, err := strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit <= 0 || limit > maxAuditLimit {
+			return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong limit"})
+		}
+		q.Limit = limit
+	}
+
+	entries, err := h.auditRepository.Find(q)
+	if err != nil {
+		return err
+	}
+	var list = make([]AuditEntryDto, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, AuditEntryDto{
+			Id:         entry.Id.Hex(),
+			Time:       entry.Time,
+			ActorId:    entry.ActorId,
+			ActorLogin: entry.ActorLogin,
+			Action:     entry.Action,
+			TargetType: entry.TargetType,
+			TargetId:   entry.TargetId,
+			Before:     normalizeAuditMap(entry.Before),
+			After:      normalizeAuditMap(entry.After),
+			Status:     entry.Status,
+			Ip:         entry.Ip,
+			RequestId:  entry.RequestId,
+		})
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "entries": list})
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const maxTags = 20
+const maxTagLength = 50
+const maxDescriptionLength = 2000
+const maxAltTextLength = 500
+const maxAttributes = 20
+const maxAttributeValueLength = 1000
+
+// attribute keys become field names in mongo, so dots and dollars aren't allowed
+var attributeKeyRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]{0,63}$`)
+
+type FileMetaDto struct {
+	Tags        *[]string          `json:"tags"`
+	Description *string            `json:"description"`
+	AltText     *string            `json:"altText"`
+	Attributes  *map[string]string `json:"attributes"`
+}
+
+// PublicFileInfoDto is metadata of published file available to anyone
+type PublicFileInfoDto struct {
+	Filename    string            `json:"filename"`
+	Url         string            `json:"url"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType"`
+	Updated     string            `json:"updated"`
+	Tags        []string          `json:"tags"`
+	Description string            `json:"description"`
+	AltText     string            `json:"altText"`
+	Attributes  map[string]string `json:"attributes"`
+}
+
+// normalizeTags trims tags and removes duplicates keeping order
+func normalizeTags(tags []string) []string {
+	var seen = map[string]bool{}
+	var normalized = make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// validate returns description of the first problem or empty string
+func (m *FileMetaDto) validate() string {
+	if m.Tags != nil {
+		tags := normalizeTags(*m.Tags)
+		if len(tags) > maxTags {
+			return "too many tags, max is " + strconv.Itoa(maxTags)
+		}
+		for _, tag := range tags {
+			if len(tag) == 0 || utf8.RuneCountInString(tag) > maxTagLength {
+				return "wrong tag length, max is " + strconv.Itoa(maxTagLength)
+			}
+		}
+		m.Tags = &tags
+	}
+	if m.Description != nil && utf8.RuneCountInString(*m.Description) > maxDescriptionLength {
+		return "too long description, max is " + strconv.Itoa(maxDescriptionLength)
+	}
+	if m.AltText != nil && utf8.RuneCountInString(*m.AltText) > maxAltTextLength {
+		return "too long alt text, max is " + strconv.Itoa(maxAltTextLength)
+	}
+	if m.Attributes != nil {
+		if len(*m.Attributes) > maxAttributes {
+			return "too many attributes, max is " + strconv.Itoa(maxAttributes)
+		}
+		for key, value := range *m.Attributes {
+			if !attributeKeyRegexp.MatchString(key) {
+				return "wrong attribute key " + strconv.Quote(key)
+			}
+			if utf8.RuneCountInString(value) > maxAttributeValueLength {
+				return "too long value of attribute " + key + ", max is " + strconv.Itoa(maxAttributeValueLength)
+			}
+		}
+	}
+	return ""
+}
+
+// PatchMetaHandler changes only fields present in request, empty value removes field
+func (h *FsHandler) PatchMetaHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	m := &FileMetaDto{}
+	if err := c.Bind(m); err != nil {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "malformed body"})
+	}
+	if problem := m.validate(); len(problem) != 0 {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": problem})
+	}
+
+	dto, err := h.getWritableFile(c, userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	ownerId := int(dto.UserId)
+	patch := repository.FileMetaPatch{Tags: m.Tags, Description: m.Description, AltText: m.AltText, Attributes: m.Attributes}
+	if err := h.userFileRepository.PatchMeta(dto.Id.Hex(), ownerId, patch); err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+
+	dto, err = h.userFileRepository.GetUserFile(dto.Id.Hex(), ownerId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	info, err := h.getFileInfo(getBucketNameInt(ownerId), dto)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "file": info})
+}
+
+// PublicMetaHandler describes published file, e. g. for embedding image with alt text
+func (h *FsHandler) PublicMetaHandler(c echo.Context) error {
+	objId := getFileId(c)
+
+	dto, err := h.userFileRepository.GetMetainfoFromMongo(objId)
+	// file which isn't public looks like absent one
+	if err == nil && (!dto.Published || dto.Trashed || isQuarantined(dto)) {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	if unlocked, err := h.unlockPublicFile(c, dto); !unlocked || err != nil {
+		return err
+	}
+
+	info, err := h.getFileInfo(getBucketNameInt(dto.UserId), dto)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "file": PublicFileInfoDto{
+		Filename:    info.Filename,
+		Url:         info.PublicUrl,
+		Size:        info.Size,
+		ContentType: info.ContentType,
+		Updated:     info.Updated.UTC().Format(http.TimeFormat),
+		Tags:        info.Tags,
+		Description: info.Description,
+		AltText:     info.AltText,
+		Attributes:  info.Attributes,
+	}})
+}
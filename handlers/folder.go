@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const FormFolderId = "folderId"
+const FormPath = "path"
+
+type CreateFolderDto struct {
+	Name     string `json:"name"`
+	ParentId string `json:"parentId"`
+}
+
+type MoveDto struct {
+	FolderId string `json:"folderId"`
+}
+
+type FolderInfoDto struct {
+	Id       string    `json:"id"`
+	Name     string    `json:"name"`
+	ParentId string    `json:"parentId"`
+	Created  time.Time `json:"created"`
+}
+
+type BreadcrumbDto struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+var errWrongPath = errors.New("wrong path")
+
+func getFolderParam(c echo.Context) string {
+	return c.Param("folder")
+}
+
+func toFolderInfo(dto *repository.FolderDto) FolderInfoDto {
+	parentId := ""
+	if dto.ParentId != nil {
+		parentId = dto.ParentId.Hex()
+	}
+	return FolderInfoDto{Id: dto.Id.Hex(), Name: dto.Name, ParentId: parentId, Created: dto.Created}
+}
+
+func isValidFolderName(name string) bool {
+	return len(strings.TrimSpace(name)) != 0 && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// resolveFolder returns nil for empty id which means root, mongo.ErrNoDocuments if folder isn't user's one
+func (h *FsHandler) resolveFolder(folderIdStr string, userId int) (*primitive.ObjectID, error) {
+	if len(folderIdStr) == 0 {
+		return nil, nil
+	}
+	folder, err := h.folderRepository.GetUserFolder(folderIdStr, userId)
+	if err != nil {
+		return nil, err
+	}
+	return &folder.Id, nil
+}
+
+// resolveRelativePath creates folders of uploaded directory under base folder and returns folder of file and its name
+func (h *FsHandler) resolveRelativePath(userId int, base *primitive.ObjectID, relativePath string) (*primitive.ObjectID, string, error) {
+	var segments = make([]string, 0)
+	for _, segment := range strings.Split(strings.Replace(relativePath, "\\", "/", -1), "/") {
+		if len(segment) == 0 || segment == "." {
+			continue
+		}
+		if segment == ".." {
+			return nil, "", errWrongPath
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return nil, "", errWrongPath
+	}
+	folder := base
+	for _, name := range segments[:len(segments)-1] {
+		dto, err := h.folderRepository.FindOrCreate(userId, name, folder)
+		if err != nil {
+			return nil, "", err
+		}
+		folder = &dto.Id
+	}
+	return folder, segments[len(segments)-1], nil
+}
+
+// resolveUploadFolder takes target folder and relative path of file in uploaded directory, filename is kept if there is no path
+func (h *FsHandler) resolveUploadFolder(userId int, folderIdStr, relativePath, filename string) (*primitive.ObjectID, string, error) {
+	folder, err := h.resolveFolder(folderIdStr, userId)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(relativePath) == 0 {
+		return folder, filename, nil
+	}
+	return h.resolveRelativePath(userId, folder, relativePath)
+}
+
+func respondFolderError(c echo.Context, err error) error {
+	if err == errWrongPath {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong path"})
+	}
+	if repository.IsDuplicateKey(err) {
+		return c.JSON(http.StatusConflict, &utils.H{"status": "folder already exists"})
+	}
+	return respondNotFoundOrError(c, err)
+}
+
+// getBreadcrumbs returns path from root to folder
+func (h *FsHandler) getBreadcrumbs(userId int, folder *repository.FolderDto) ([]BreadcrumbDto, error) {
+	var breadcrumbs = make([]BreadcrumbDto, 0)
+	for current := folder; current != nil; {
+		breadcrumbs = append([]BreadcrumbDto{{Id: current.Id.Hex(), Name: current.Name}}, breadcrumbs...)
+		if current.ParentId == nil {
+			break
+		}
+		parent, err := h.folderRepository.GetUserFolder(current.ParentId.Hex(), userId)
+		if err != nil {
+			return nil, err
+		}
+		current = parent
+	}
+	return breadcrumbs, nil
+}
+
+func (h *FsHandler) CreateFolderHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	dto := &CreateFolderDto{}
+	if err := c.Bind(dto); err != nil {
+		return err
+	}
+	if !isValidFolderName(dto.Name) {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong name"})
+	}
+	parentId, err := h.resolveFolder(dto.ParentId, userId)
+	if err != nil {
+		return respondFolderError(c, err)
+	}
+
+	folder, err := h.folderRepository.Create(userId, dto.Name, parentId)
+	if err != nil {
+		return respondFolderError(c, err)
+	}
+	setAuditTarget(c, AuditTargetFolder, folder.Id.Hex())
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "folder": toFolderInfo(folder)})
+}
+
+func (h *FsHandler) RenameFolderHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	u := &RenameDto{}
+	if err := c.Bind(u); err != nil {
+		return err
+	}
+	if !isValidFolderName(u.Newname) {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong name"})
+	}
+
+	if err := h.folderRepository.Rename(getFolderParam(c), userId, u.Newname); err != nil {
+		return respondFolderError(c, err)
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
+
+func (h *FsHandler) MoveFolderHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	m := &MoveDto{}
+	if err := c.Bind(m); err != nil {
+		return err
+	}
+
+	folder, err := h.folderRepository.GetUserFolder(getFolderParam(c), userId)
+	if err != nil {
+		return respondFolderError(c, err)
+	}
+	parentId, err := h.resolveFolder(m.FolderId, userId)
+	if err != nil {
+		return respondFolderError(c, err)
+	}
+	if parentId != nil {
+		// folder cannot be moved into itself or into its descendant
+		parent, err := h.folderRepository.GetUserFolder(parentId.Hex(), userId)
+		if err != nil {
+			return respondFolderError(c, err)
+		}
+		ancestors, err := h.getBreadcrumbs(userId, parent)
+		if err != nil {
+			return err
+		}
+		for _, ancestor := range ancestors {
+			if ancestor.Id == folder.Id.Hex() {
+				return c.JSON(http.StatusBadRequest, &utils.H{"status": "folder cannot be moved into itself"})
+			}
+		}
+	}
+
+	if err := h.folderRepository.Move(folder.Id.Hex(), userId, parentId); err != nil {
+		return respondFolderError(c, err)
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
+
+// DeleteFolderHandler moves files of folder and its subfolders to trash and removes folders.
+// Quarantined files are trashed too, folder with files being uploaded, including pending tus sessions, isn't deleted.
+// Restored file whose folder has gone is placed to root.
+func (h *FsHandler) DeleteFolderHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	folder, err := h.folderRepository.GetUserFolder(getFolderParam(c), userId)
+	if err != nil {
+		return respondFolderError(c, err)
+	}
+
+	// depth first, so folder is removed only after its content
+	var folders []repository.FolderDto
+	var files []repository.UserFileDto
+	var collect func(folder repository.FolderDto) error
+	collect = func(folder repository.FolderDto) error {
+		children, err := h.folderRepository.FindChildren(userId, &folder.Id)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := collect(child); err != nil {
+				return err
+			}
+		}
+		folderFiles, err := h.userFileRepository.FindFilesInFolder(userId, &folder.Id)
+		if err != nil {
+			return err
+		}
+		files = append(files, folderFiles...)
+		folders = append(folders, folder)
+		return nil
+	}
+	if err := collect(*folder); err != nil {
+		return err
+	}
+	// uploaded file would appear in removed folder
+	for _, file := range files {
+		if file.State == repository.UploadStateUploading {
+			return c.JSON(http.StatusConflict, &utils.H{"status": "folder has uploading files", "id": file.Id.Hex()})
+		}
+	}
+	var folderIds = make([]primitive.ObjectID, 0, len(folders))
+	for _, folder := range folders {
+		folderIds = append(folderIds, folder.Id)
+	}
+	pending, err := h.uploadSessions.CountPendingInFolders(userId, folderIds)
+	if err != nil {
+		return err
+	}
+	if pending != 0 {
+		return c.JSON(http.StatusConflict, &utils.H{"status": "folder has uploading files"})
+	}
+
+	var trashedFiles int
+	counted := isTrashCounted()
+	for _, file := range files {
+		dto, err := h.userFileRepository.MoveToTrash(file.Id.Hex(), userId, counted)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !counted {
+			h.releaseUserSpace(userId, dto.Size)
+		}
+		h.emitWebhook(WebhookFileDeleted, userId, h.getWebhookFile(dto), nil)
+		trashedFiles++
+	}
+	for _, folder := range folders {
+		Logger.Infof("Removing folder %v of user %v", folder.Id.Hex(), userId)
+		if err := h.folderRepository.Delete(folder.Id); err != nil {
+			return err
+		}
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "trashed": trashedFiles})
+}
+
+// MoveFileHandler places file into folder, empty folderId means root
+func (h *FsHandler) MoveFileHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	m := &MoveDto{}
+	if err := c.Bind(m); err != nil {
+		return err
+	}
+	folderId, err := h.resolveFolder(m.FolderId, userId)
+	if err != nil {
+		return respondFolderError(c, err)
+	}
+
+	if err := h.userFileRepository.SetFolder(getFileId(c), userId, folderId); err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
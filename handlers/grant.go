@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type GrantDto struct {
+	UserId int  `json:"userId"`
+	Write  bool `json:"write"`
+}
+
+type GrantInfoDto struct {
+	UserId  int64     `json:"userId"`
+	Write   bool      `json:"write"`
+	Created time.Time `json:"created"`
+}
+
+type SharedFileInfoDto struct {
+	FileInfoDto
+	OwnerId int64 `json:"ownerId"`
+	Write   bool  `json:"write"`
+}
+
+// getGrantedFile returns file of another user which has been shared with user, mongo.ErrNoDocuments if it hasn't
+func (h *FsHandler) getGrantedFile(fileId string, userId int, write bool) (*repository.UserFileDto, error) {
+	grant, err := h.fileGrantRepository.GetGrant(fileId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if write && !grant.Write {
+		return nil, mongo.ErrNoDocuments
+	}
+	dto, err := h.userFileRepository.GetUserFile(fileId, int(grant.OwnerId))
+	if err != nil {
+		return nil, err
+	}
+	if dto.Trashed || dto.State != repository.UploadStateReady {
+		return nil, mongo.ErrNoDocuments
+	}
+	return dto, nil
+}
+
+// getWritableFile returns user's own file or file shared with user for writing
+func (h *FsHandler) getWritableFile(c echo.Context, userId int) (*repository.UserFileDto, error) {
+	dto, err := h.getCurrentUserFile(c, userId)
+	if err == mongo.ErrNoDocuments {
+		return h.getGrantedFile(getFileId(c), userId, true)
+	}
+	return dto, err
+}
+
+func (h *FsHandler) GrantHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	g := &GrantDto{}
+	if err := c.Bind(g); err != nil {
+		return err
+	}
+	if g.UserId <= 0 || g.UserId == userId {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong userId"})
+	}
+
+	dto, err := h.getCurrentUserFile(c, userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	before, err := h.fileGrantRepository.GetGrant(dto.Id.Hex(), g.UserId)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if err := h.fileGrantRepository.Grant(dto.Id, userId, g.UserId, g.Write); err != nil {
+		return err
+	}
+	if before != nil {
+		setAuditChange(c, GrantDto{UserId: int(before.GranteeId), Write: before.Write}, g)
+	} else {
+		setAuditChange(c, nil, g)
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
+
+func (h *FsHandler) GrantsHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	dto, err := h.userFileRepository.GetUserFile(getFileId(c), userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	grants, err := h.fileGrantRepository.FindGrantsOfFile(dto.Id)
+	if err != nil {
+		return err
+	}
+	var list = make([]GrantInfoDto, 0, len(grants))
+	for _, grant := range grants {
+		list = append(list, GrantInfoDto{UserId: grant.GranteeId, Write: grant.Write, Created: grant.Created})
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "grants": list})
+}
+
+func (h *FsHandler) RevokeGrantHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+	granteeId, err := strconv.Atoi(c.Param(utils.USER_ID))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong userId"})
+	}
+
+	dto, err := h.userFileRepository.GetUserFile(getFileId(c), userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	if err := h.fileGrantRepository.Revoke(dto.Id, granteeId); err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	setAuditChange(c, utils.H{"userId": granteeId}, nil)
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
+
+// SharedWithMeHandler lists files of other users which have been shared with user
+func (h *FsHandler) SharedWithMeHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	grants, err := h.fileGrantRepository.FindGrantsForUser(userId)
+	if err != nil {
+		return err
+	}
+	var ids = make([]primitive.ObjectID, 0, len(grants))
+	for _, grant := range grants {
+		ids = append(ids, grant.FileId)
+	}
+	files, err := h.userFileRepository.FindFilesByIds(ids)
+	if err != nil {
+		return err
+	}
+
+	var list = make([]SharedFileInfoDto, 0, len(grants))
+	for _, grant := range grants {
+		file, ok := files[grant.FileId]
+		if !ok || file.Trashed || file.State != repository.UploadStateReady {
+			continue
+		}
+		info, err := h.getFileInfo(getBucketNameInt(file.UserId), &file)
+		if err != nil {
+			return err
+		}
+		list = append(list, SharedFileInfoDto{FileInfoDto: *info, OwnerId: file.UserId, Write: grant.Write})
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "files": list})
+}
@@ -1,30 +1,50 @@
 package handlers
 
 import (
-	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
-	"github.com/minio/minio-go"
+	"github.com/nkonev/blog-storage/client"
 	"github.com/nkonev/blog-storage/data/repository"
+	"github.com/nkonev/blog-storage/imaging"
 	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/scanner"
+	"github.com/nkonev/blog-storage/storage"
 	"github.com/nkonev/blog-storage/utils"
 	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"mime/multipart"
+	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 type FsHandler struct {
-	serverUrl          string
-	minio              *minio.Client
-	mongo              *mongo.Client
-	userFileRepository *repository.UserFileRepository
-	limitsRepository   *repository.LimitsRepository
+	serverUrl                 string
+	storage                   storage.Storage
+	mongo                     *mongo.Client
+	userFileRepository        *repository.UserFileRepository
+	limitsRepository          *repository.LimitsRepository
+	uploadSessions            *repository.UploadSessionRepository
+	usageRepository           *repository.UsageRepository
+	fileVersionRepository     *repository.FileVersionRepository
+	shareLinkRepository       *repository.ShareLinkRepository
+	passwordAttemptRepository *repository.PasswordAttemptRepository
+	downloadStatsRepository   *repository.DownloadStatsRepository
+	fileGrantRepository       *repository.FileGrantRepository
+	folderRepository          *repository.FolderRepository
+	derivativeRepository      *repository.DerivativeRepository
+	scanner                   scanner.Scanner
+	auditRepository           *repository.AuditRepository
+	webhookDeliveryRepository *repository.WebhookDeliveryRepository
+	restClient                client.RestClient
 }
 
 type RenameDto struct {
@@ -32,35 +52,73 @@ type RenameDto struct {
 }
 
 type FileInfoDto struct {
-	Id        string `json:"id"`
-	Filename  string `json:"filename"`
-	Url       string `json:"url"`
-	PublicUrl string `json:"publicUrl"`
-	Size      int64  `json:"size"`
+	Id                string            `json:"id"`
+	Filename          string            `json:"filename"`
+	Url               string            `json:"url"`
+	PublicUrl         string            `json:"publicUrl"`
+	Size              int64             `json:"size"`
+	ContentType       string            `json:"contentType"`
+	Sha256            string            `json:"sha256"`
+	Created           time.Time         `json:"created"`
+	Updated           time.Time         `json:"updated"`
+	PasswordProtected bool              `json:"passwordProtected"`
+	Sanitized         bool              `json:"sanitized"`
+	FolderId          string            `json:"folderId"`
+	Tags              []string          `json:"tags"`
+	Description       string            `json:"description"`
+	AltText           string            `json:"altText"`
+	Attributes        map[string]string `json:"attributes"`
 }
 
 const FormFile = "file"
+const HeaderETag = "ETag"
 
 func NewFsHandler(
-	minio *minio.Client,
+	storage storage.Storage,
 	client *mongo.Client,
 	userFileRepository *repository.UserFileRepository,
 	limitsRepository *repository.LimitsRepository,
+	uploadSessions *repository.UploadSessionRepository,
+	usageRepository *repository.UsageRepository,
+	fileVersionRepository *repository.FileVersionRepository,
+	shareLinkRepository *repository.ShareLinkRepository,
+	passwordAttemptRepository *repository.PasswordAttemptRepository,
+	downloadStatsRepository *repository.DownloadStatsRepository,
+	fileGrantRepository *repository.FileGrantRepository,
+	folderRepository *repository.FolderRepository,
+	derivativeRepository *repository.DerivativeRepository,
+	scanner scanner.Scanner,
+	auditRepository *repository.AuditRepository,
+	webhookDeliveryRepository *repository.WebhookDeliveryRepository,
+	restClient client.RestClient,
 ) *FsHandler {
 	return &FsHandler{
-		minio:              minio,
-		serverUrl:          viper.GetString("server.url"),
-		mongo:              client,
-		userFileRepository: userFileRepository,
-		limitsRepository:   limitsRepository}
+		storage:                   storage,
+		serverUrl:                 viper.GetString("server.url"),
+		mongo:                     client,
+		userFileRepository:        userFileRepository,
+		limitsRepository:          limitsRepository,
+		uploadSessions:            uploadSessions,
+		usageRepository:           usageRepository,
+		fileVersionRepository:     fileVersionRepository,
+		shareLinkRepository:       shareLinkRepository,
+		passwordAttemptRepository: passwordAttemptRepository,
+		downloadStatsRepository:   downloadStatsRepository,
+		fileGrantRepository:       fileGrantRepository,
+		folderRepository:          folderRepository,
+		derivativeRepository:      derivativeRepository,
+		scanner:                   scanner,
+		auditRepository:           auditRepository,
+		webhookDeliveryRepository: webhookDeliveryRepository,
+		restClient:                restClient}
 }
 
-func (h *FsHandler) getPrivateUrlFromObject(objInfo minio.ObjectInfo) (*string, error) {
+func (h *FsHandler) getPrivateUrl(fileId string) (*string, error) {
 	downloadUrl, err := url.Parse(h.serverUrl)
 	if err != nil {
 		return nil, err
 	}
-	downloadUrl.Path += utils.DOWNLOAD_PREFIX + objInfo.Key
+	downloadUrl.Path += utils.DOWNLOAD_PREFIX + fileId
 	str := downloadUrl.String()
 	return &str, nil
 }
@@ -76,67 +134,146 @@ func (h *FsHandler) LsHandler(c echo.Context) error {
 
 	Logger.Debugf("Listing bucket '%v':", bucket)
 
-	userFilesCursor, e := h.userFileRepository.FindUserFiles(userId)
+	var folder *repository.FolderDto
+	var breadcrumbs = make([]BreadcrumbDto, 0)
+	if folderIdStr := c.QueryParam("folder"); len(folderIdStr) != 0 {
+		var err error
+		folder, err = h.folderRepository.GetUserFolder(folderIdStr, userId)
+		if err != nil {
+			return respondNotFoundOrError(c, err)
+		}
+		breadcrumbs, err = h.getBreadcrumbs(userId, folder)
+		if err != nil {
+			return err
+		}
+	}
+	var folderId *primitive.ObjectID
+	if folder != nil {
+		folderId = &folder.Id
+	}
+
+	subfolders, e := h.folderRepository.FindChildren(userId, folderId)
+	if e != nil {
+		return e
+	}
+	var folders = make([]FolderInfoDto, 0, len(subfolders))
+	for i := range subfolders {
+		folders = append(folders, toFolderInfo(&subfolders[i]))
+	}
+
+	query, e := parseFileQuery(c, userId, folderId)
+	if e != nil {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": e.Error()})
+	}
+	total, e := h.userFileRepository.CountFiles(*query)
+	if e != nil {
+		return e
+	}
+	userFiles, e := h.userFileRepository.FindFilesPage(*query)
 	if e != nil {
 		Logger.Errorf("Error during querying record from mongo")
 		return e
 	}
-	defer userFilesCursor.Close(context.TODO())
+	nextCursor := ""
+	if query.Limit > 0 && int64(len(userFiles)) == query.Limit {
+		nextCursor = encodeCursor(repository.NewFileCursor(query.Sort, &userFiles[len(userFiles)-1]))
+	}
 
 	var list []FileInfoDto = make([]FileInfoDto, 0)
-	for userFilesCursor.Next(context.TODO()) {
-		mongoDto, err := repository.ToFileMongoDto(userFilesCursor)
+	for i := range userFiles {
+		info, err := h.getFileInfo(bucket, &userFiles[i])
 		if err != nil {
-			Logger.Errorf("Error during get mongo dto: %v", err)
 			return err
 		}
+		list = append(list, *info)
+	}
 
-		obj, err := h.minio.GetObject(bucket, mongoDto.Id.Hex(), minio.GetObjectOptions{})
-		if err != nil {
-			Logger.Errorf("Error during GetObject: %v", err)
-			return err
-		}
-		objInfo, err := obj.Stat()
-		if err != nil {
-			Logger.Infof("Cannot stat: %v. May be file by key %v still uploading. Skipping it.", err, mongoDto.Id.Hex())
-			continue
-		}
-		Logger.Debugf("Object '%v'", objInfo.Key)
-
-		publicUrl := ""
-		if mongoDto.Published {
-			publicUrl = h.getPublicUrl(bucket, mongoDto.Id.Hex())
-		}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "files": list, "folders": folders, "breadcrumbs": breadcrumbs, "total": total, "nextCursor": nextCursor})
+}
 
-		downloadUrl, err := h.getPrivateUrlFromObject(objInfo)
-		if err != nil {
-			Logger.Errorf("Error get private url: %v", err)
-			return err
-		}
+func (h *FsHandler) getFileInfo(bucket string, mongoDto *repository.UserFileDto) (*FileInfoDto, error) {
+	publicUrl := ""
+	if mongoDto.Published {
+		publicUrl = h.getPublicUrl(bucket, mongoDto.Id.Hex())
+	}
 
-		info := FileInfoDto{Id: mongoDto.Id.Hex(), Filename: mongoDto.Filename, Url: *downloadUrl, Size: objInfo.Size, PublicUrl: publicUrl}
-		list = append(list, info)
+	downloadUrl, err := h.getPrivateUrl(mongoDto.Id.Hex())
+	if err != nil {
+		Logger.Errorf("Error get private url: %v", err)
+		return nil, err
 	}
 
-	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "files": list})
+	folderId := ""
+	if mongoDto.FolderId != nil {
+		folderId = mongoDto.FolderId.Hex()
+	}
+	tags := mongoDto.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	attributes := mongoDto.Attributes
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+
+	return &FileInfoDto{
+		Id:                mongoDto.Id.Hex(),
+		Filename:          mongoDto.Filename,
+		Url:               *downloadUrl,
+		Size:              mongoDto.Size,
+		PublicUrl:         publicUrl,
+		ContentType:       mongoDto.ContentType,
+		Sha256:            mongoDto.Sha256,
+		Created:           mongoDto.Created,
+		Updated:           mongoDto.Updated,
+		PasswordProtected: len(mongoDto.PasswordHash) != 0,
+		Sanitized:         mongoDto.Sanitized,
+		FolderId:          folderId,
+		Tags:              tags,
+		Description:       mongoDto.Description,
+		AltText:           mongoDto.AltText,
+		Attributes:        attributes,
+	}, nil
 }
 
-func (h *FsHandler) checkUserLimit(bucketName string, c echo.Context, file *multipart.FileHeader) (bool, error) {
-	consumption := h.calcUserFilesConsumption(bucketName)
+// reserveUserSpace atomically takes space from user's quota, so concurrent uploads cannot both slip under the limit.
+// Reserved space should be released by releaseUserSpace if upload fails.
+func (h *FsHandler) reserveUserSpace(c echo.Context, size int64) (bool, error) {
 	userId, ok := getUserIdFromContext(c)
 	if !ok {
 		return false, errors.New("Error during get(cast) userId")
 	}
-	maxAllowed, err := h.getMaxAllowedConsumption(userId)
+	limits, err := h.getUserLimits(userId)
 	if err != nil {
 		Logger.Errorf("Error during calculating max allowed %v", err)
 		return false, err
 	}
-	if consumption+file.Size > maxAllowed {
-		Logger.Infof("Upload too large %v+%v>%v bytes", consumption, file.Size, maxAllowed)
-		return false, nil
+	filesOk, err := h.checkFilesLimit(userId, limits)
+	if err != nil || !filesOk {
+		return false, err
+	}
+	return h.reserveUserBytes(userId, limits, size)
+}
+
+// reserveUserBytes is reserveUserSpace for content which doesn't add new file, e. g. new version of existing one
+func (h *FsHandler) reserveUserBytes(userId int, limits *UserLimits, size int64) (bool, error) {
+	maxAllowed := limits.MaxBytes
+	reserved, err := h.usageRepository.Reserve(userId, size, maxAllowed)
+	if err != nil {
+		Logger.Errorf("Error during reserving %v bytes for user %v: %v", size, userId, err)
+		return false, err
+	}
+	if !reserved {
+		Logger.Infof("Upload too large %v bytes, max allowed is %v bytes", size, maxAllowed)
+		h.emitWebhook(WebhookQuotaExceeded, userId, nil, &WebhookQuotaDto{MaxBytes: maxAllowed, MaxFiles: limits.MaxFiles, Requested: size})
+	}
+	return reserved, nil
+}
+
+func (h *FsHandler) releaseUserSpace(userId int, size int64) {
+	if err := h.usageRepository.Add(userId, -size); err != nil {
+		Logger.Errorf("Error during releasing %v bytes of user %v: %v", size, userId, err)
 	}
-	return true, nil
 }
 
 func getUserIdFromContext(c echo.Context) (int, bool) {
@@ -159,17 +296,24 @@ func (h *FsHandler) UploadHandler(c echo.Context) error {
 
 	bucketName := h.ensureAndGetBucket(c)
 
-	userLimitOk, err := h.checkUserLimit(bucketName, c, file)
+	i, err := getUserIdFromRequest(c)
 	if err != nil {
 		return err
 	}
-	if !userLimitOk {
-		return c.JSON(http.StatusRequestEntityTooLarge, &utils.H{"status": "fail"})
-	}
 
-	contentType := file.Header.Get("Content-Type")
+	// file of dropped directory keeps its relative path
+	folderId, filename, err := h.resolveUploadFolder(i, c.FormValue(FormFolderId), c.FormValue(FormPath), file.Filename)
+	if err != nil {
+		return respondFolderError(c, err)
+	}
 
-	Logger.Debugf("Determined content type: %v", contentType)
+	rules, err := h.getUploadRules(i)
+	if err != nil {
+		return err
+	}
+	if err := rules.checkSize(file.Size); err != nil {
+		return respondUploadRejection(c, err)
+	}
 
 	src, err := file.Open()
 	if err != nil {
@@ -177,24 +321,91 @@ func (h *FsHandler) UploadHandler(c echo.Context) error {
 	}
 	defer src.Close()
 
-	// put file
-	i, err := getUserIdFromRequest(c)
+	// Content-Type of multipart part is set by client and cannot be trusted
+	contentType, content, err := sniffContentType(src)
 	if err != nil {
 		return err
 	}
-	mongoId, err := h.userFileRepository.InsertMetaInfoToMongo(file.Filename, i)
+	Logger.Debugf("Determined content type: %v, declared: %v", contentType, file.Header.Get("Content-Type"))
+	if err := rules.checkFile(filename, contentType); err != nil {
+		return respondUploadRejection(c, err)
+	}
+
+	userLimitOk, err := h.reserveUserSpace(c, file.Size)
 	if err != nil {
 		return err
 	}
+	if !userLimitOk {
+		return c.JSON(http.StatusRequestEntityTooLarge, &utils.H{"status": "fail"})
+	}
 
-	if _, err := h.minio.PutObject(bucketName, *mongoId, src, file.Size, minio.PutObjectOptions{ContentType: contentType}); err != nil {
-		Logger.Errorf("Error during upload object: %v", err)
+	// put file
+	mongoId, err := h.userFileRepository.InsertMetaInfoToMongo(filename, i, contentType, folderId)
+	if err != nil {
+		h.releaseUserSpace(i, file.Size)
 		return err
 	}
+	setAuditTarget(c, AuditTargetFile, *mongoId)
+
+	reason, err := h.putUserObject(bucketName, *mongoId, i, content, file.Size, contentType)
+	if err != nil {
+		Logger.Errorf("Error during upload object: %v", err)
+		h.rollbackUserFile(*mongoId, i)
+		h.releaseUserSpace(i, file.Size)
+		return respondBrokenImageOrError(c, err)
+	}
+	if len(reason) != 0 {
+		return respondQuarantined(c, *mongoId, reason)
+	}
+	go h.generateThumbnail(*mongoId, i)
+	h.emitFileWebhook(WebhookFileUploaded, *mongoId)
 
 	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "id": mongoId})
 }
 
+// putUserObject stores content and fills metadata which is known only after whole stream has been read.
+// Returned reason isn't empty when file has been quarantined by scanner.
+func (h *FsHandler) putUserObject(bucketName, fileId string, userId int, src io.Reader, size int64, contentType string) (string, error) {
+	sanitize := getSanitizePolicy() == SanitizeOnUpload && imaging.CanStripMetadata(contentType)
+	objectSize := size
+	var stripped *io.PipeReader
+	var stripResult <-chan error
+	if sanitize {
+		// size is unknown until metadata is stripped
+		stripped, stripResult = stripMetadataAsync(src, contentType)
+		src = stripped
+		objectSize = -1
+	}
+
+	hash := sha256.New()
+	written, err := h.storage.PutObject(bucketName, fileId, io.TeeReader(src, hash), objectSize, contentType)
+	if sanitize {
+		stripped.Close()
+		if stripErr := <-stripResult; stripErr == imaging.ErrUnsupportedFormat {
+			err = stripErr
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if sanitize && written < size {
+		// caller has reserved size of original
+		h.releaseUserSpace(userId, size-written)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if reason := h.scanObject(bucketName, fileId); len(reason) != 0 {
+		Logger.Warnf("File %v of user %v is quarantined: %v", fileId, userId, reason)
+		return reason, h.userFileRepository.Quarantine(fileId, userId, written, checksum, contentType, reason)
+	}
+	return "", h.userFileRepository.MarkUploaded(fileId, userId, written, checksum, contentType, sanitize)
+}
+
+func (h *FsHandler) rollbackUserFile(fileId string, userId int) {
+	if err := h.userFileRepository.Delete(fileId, userId); err != nil {
+		Logger.Errorf("Error during rollback of file %v: %v", fileId, err)
+	}
+}
+
 func getBucketName(c echo.Context) string {
 	i, _ := getUserIdFromRequest(c)
 	return getBucketNameInt(i)
@@ -225,39 +436,33 @@ func (h *FsHandler) ensureAndGetBucket(c echo.Context) string {
 }
 
 func (h *FsHandler) ensureBucket(bucketName, location string) {
-	err := h.minio.MakeBucket(bucketName, location)
-	if err != nil {
-		// Check to see if we already own this bucket (which happens if you run this twice)
-		exists, err := h.minio.BucketExists(bucketName)
-		if err == nil && exists {
-			Logger.Debugf("Bucket '%s' already present", bucketName)
-		} else {
-			Logger.Fatal(err)
-		}
-	} else {
-		Logger.Infof("Successfully created bucket '%s'", bucketName)
+	if err := h.storage.EnsureBucket(bucketName, location); err != nil {
+		Logger.Fatal(err)
 	}
-
 }
 
 func (h *FsHandler) download(bucketName, objId string, mongoDto *repository.UserFileDto) func(c echo.Context) error {
 	return func(c echo.Context) error {
-		info, e := h.minio.StatObject(bucketName, objId, minio.StatObjectOptions{})
+		info, e := h.storage.StatObject(bucketName, objId)
 		if e != nil {
 			return c.JSON(http.StatusNotFound, &utils.H{"status": "stat fail"})
 		}
 
-		c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(info.Size, 10))
-		c.Response().Header().Set(echo.HeaderContentType, info.ContentType)
-		c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; Filename=\""+mongoDto.Filename+"\"")
-
-		object, e := h.minio.GetObject(bucketName, objId, minio.GetObjectOptions{})
-		defer object.Close()
+		object, e := h.storage.GetObject(bucketName, objId)
 		if e != nil {
 			return c.JSON(http.StatusInternalServerError, &utils.H{"status": "fail"})
 		}
+		defer object.Close()
+
+		c.Response().Header().Set(echo.HeaderContentType, info.ContentType)
+		c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; Filename=\""+mongoDto.Filename+"\"")
+		if len(info.ETag) != 0 {
+			c.Response().Header().Set(HeaderETag, "\""+info.ETag+"\"")
+		}
 
-		return c.Stream(http.StatusOK, info.ContentType, object)
+		// handles Range, If-Range, If-None-Match, If-Modified-Since and sets Content-Length, Last-Modified
+		http.ServeContent(c.Response(), c.Request(), mongoDto.Filename, info.LastModified, object)
+		return nil
 	}
 }
 
@@ -266,23 +471,36 @@ func (h *FsHandler) DownloadHandler(c echo.Context) error {
 
 	objId := getFileId(c)
 
-	dto, err := h.userFileRepository.GetMetainfoFromMongo(objId)
+	userId, err := getUserIdFromRequest(c)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return c.JSON(http.StatusNotFound, &utils.H{"status": "stat fail"})
-		}
 		return err
 	}
 
-	return h.download(bucketName, objId, dto)(c)
+	dto, err := h.userFileRepository.GetUserFile(objId, userId)
+	if err == mongo.ErrNoDocuments {
+		// file of another user can be shared with this one
+		dto, err = h.getGrantedFile(objId, userId, false)
+		if err == nil {
+			bucketName = getBucketNameInt(dto.UserId)
+		}
+	}
+	if err == nil && dto.Trashed {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	if isQuarantined(dto) {
+		return c.JSON(http.StatusForbidden, &utils.H{"status": "quarantined"})
+	}
+
+	return h.recordDownload(repository.DownloadKindPrivate, dto, h.download(bucketName, objId, dto))(c)
 }
 
 func (h *FsHandler) PublicDownloadHandler(c echo.Context) error {
 
 	objId := getFileId(c)
 
-	userId, err := h.userFileRepository.GetUserIdByGlobalId(objId)
-
 	dto, err := h.userFileRepository.GetMetainfoFromMongo(objId)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -290,81 +508,144 @@ func (h *FsHandler) PublicDownloadHandler(c echo.Context) error {
 		}
 		return err
 	}
-	if !dto.Published {
+	if !dto.Published || dto.Trashed || isQuarantined(dto) {
 		return c.JSON(http.StatusNotFound, &utils.H{"status": "access fail"})
 	}
+	if unlocked, err := h.unlockPublicFile(c, dto); !unlocked || err != nil {
+		return err
+	}
+	imageOptions, problem := parseImageOptions(c)
+	if len(problem) != 0 {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": problem})
+	}
+	if imageOptions != nil {
+		return h.recordDownload(repository.DownloadKindPublic, dto, func(c echo.Context) error {
+			return h.serveDerivative(c, dto, *imageOptions)
+		})(c)
+	}
+
+	if isSanitizedOnPublish(dto) {
+		key, err := h.ensureSanitizedCopy(dto)
+		if err != nil {
+			return respondBrokenImageOrError(c, err)
+		}
+		return h.recordDownload(repository.DownloadKindPublic, dto, h.download(utils.DERIVATIVES_BUCKET, key, dto))(c)
+	}
 
-	bucketName := getBucketNameInt(userId)
+	bucketName := getBucketNameInt(int(dto.UserId))
 
-	return h.download(bucketName, objId, dto)(c)
+	return h.recordDownload(repository.DownloadKindPublic, dto, h.download(bucketName, objId, dto))(c)
 }
 
 func getFileId(context echo.Context) string {
 	return context.Param("file")
 }
 
+// respondNotFoundOrError hides whether file is absent or belongs to another user
+func respondNotFoundOrError(c echo.Context, err error) error {
+	if err == mongo.ErrNoDocuments {
+		return c.JSON(http.StatusNotFound, &utils.H{"status": "not found"})
+	}
+	return err
+}
+
 func (h *FsHandler) MoveHandler(c echo.Context) error {
 	from := getFileId(c)
 
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
 	u := &RenameDto{}
 	if err := c.Bind(u); err != nil {
 		return err
 	}
 
-	if err := h.userFileRepository.RenameUserFile(from, u.Newname); err != nil {
+	previous, err := h.userFileRepository.GetUserFile(from, userId)
+	if err == nil && previous.Trashed {
+		err = mongo.ErrNoDocuments
+	}
+	if err == mongo.ErrNoDocuments {
+		// grantee with write access renames file of owner
+		previous, err = h.getGrantedFile(from, userId, true)
+	}
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	ownerId := int(previous.UserId)
+
+	// otherwise uploaded x.txt could be renamed to denied x.exe
+	rules, err := h.getUploadRules(ownerId)
+	if err != nil {
 		return err
 	}
+	if err := rules.checkFile(u.Newname, previous.ContentType); err != nil {
+		return respondUploadRejection(c, err)
+	}
+
+	if err := h.userFileRepository.RenameUserFile(from, ownerId, u.Newname); err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	file := h.getWebhookFile(previous)
+	file.PreviousFilename, file.Filename = previous.Filename, u.Newname
+	h.emitWebhook(WebhookFileRenamed, ownerId, file, nil)
 
 	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
 }
 
+// DeleteHandler moves file to trash, it will be purged after retention or on emptying trash
 func (h *FsHandler) DeleteHandler(c echo.Context) error {
-	bucketName := h.ensureAndGetBucket(c)
 	objId := getFileId(c)
 
-	if err := h.minio.RemoveObject(bucketName, objId); err != nil {
-		Logger.Errorf("Error during remove object from minio: %v", err)
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
 		return err
 	}
 
-	e := h.userFileRepository.Delete(objId)
-	if e != nil {
-		Logger.Errorf("Error during remove object from mongo: %v", e)
-		return e
+	counted := isTrashCounted()
+	dto, err := h.userFileRepository.MoveToTrash(objId, userId, counted)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	if !counted {
+		h.releaseUserSpace(userId, dto.Size)
 	}
+	h.emitWebhook(WebhookFileDeleted, userId, h.getWebhookFile(dto), nil)
 
 	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
 }
 
 func (h *FsHandler) Limits(c echo.Context) error {
-	bucketName := h.ensureAndGetBucket(c)
-
 	userId, ok := getUserIdFromContext(c)
 	if !ok {
 		Logger.Errorf("Error during get(cast) userId")
 	}
 
-	max, e := h.getMaxAllowedConsumption(userId)
+	limits, e := h.getUserLimits(userId)
 	if e != nil {
 		return e
 	}
-	consumption := h.calcUserFilesConsumption(bucketName)
-
-	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "used": h.calcUserFilesConsumption(bucketName), "available": max - consumption, "admin": getUserAdminFromContext(c)})
-}
-
-func (h *FsHandler) calcUserFilesConsumption(bucketName string) int64 {
-	var totalBucketConsumption int64
-
-	recursive := true
-	doneCh := make(chan struct{})
-	defer close(doneCh)
-
-	Logger.Debugf("Listing bucket '%v':", bucketName)
-	for objInfo := range h.minio.ListObjects(bucketName, "", recursive, doneCh) {
-		totalBucketConsumption += objInfo.Size
+	consumption, e := h.usageRepository.GetUsed(userId)
+	if e != nil {
+		return e
 	}
-	return totalBucketConsumption
+	files, e := h.userFileRepository.CountUserFiles(userId, isTrashCounted())
+	if e != nil {
+		return e
+	}
+
+	return c.JSON(http.StatusOK, &utils.H{
+		"status":    "ok",
+		"used":      consumption,
+		"available": limits.MaxBytes - consumption,
+		"admin":     getUserAdminFromContext(c),
+		"plan":      limits.Plan,
+		"unlimited": limits.Unlimited,
+		"maxBytes":  limits.MaxBytes,
+		"maxFiles":  limits.MaxFiles,
+		"files":     files,
+	})
 }
 
 func (h *FsHandler) getPublicUrl(bucketName string, minioObjId string) string {
@@ -374,49 +655,159 @@ func (h *FsHandler) getPublicUrl(bucketName string, minioObjId string) string {
 func (h *FsHandler) Publish(c echo.Context) error {
 	objId := getFileId(c)
 
-	elem, err := h.userFileRepository.UpdatePublished(objId, true)
+	userId, err := getUserIdFromRequest(c)
 	if err != nil {
 		return err
 	}
 
+	current, err := h.userFileRepository.GetUserFile(objId, userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	if isQuarantined(current) {
+		return c.JSON(http.StatusForbidden, &utils.H{"status": "quarantined"})
+	}
+
+	elem, err := h.userFileRepository.UpdatePublished(objId, userId, true)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	h.sanitizePublished(objId)
+	h.emitFileWebhook(WebhookFilePublished, objId)
+
 	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "Published": true, "url": h.getPublicUrl(getBucketName(c), elem.Id.Hex())})
 }
 
 func (h *FsHandler) DeletePublish(c echo.Context) error {
 	objId := getFileId(c)
 
-	_, err := h.userFileRepository.UpdatePublished(objId, false)
+	userId, err := getUserIdFromRequest(c)
 	if err != nil {
 		return err
 	}
 
+	_, err = h.userFileRepository.UpdatePublished(objId, userId, false)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	h.emitFileWebhook(WebhookFileUnpublished, objId)
+
 	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "unpublished": true})
 }
 
-func (h *FsHandler) getMaxAllowedConsumption(userId int) (int64, error) {
-	b, e := h.limitsRepository.IsStorageUnlimitedForUser(userId)
+// PlanDto is a named set of limits defined in config under limits.plans
+type PlanDto struct {
+	Name     string `json:"name"`
+	MaxBytes int64  `json:"maxBytes" mapstructure:"max"`
+	// 0 means unlimited count of files
+	MaxFiles int64 `json:"maxFiles" mapstructure:"files"`
+	// restrictions of uploaded files on top of global ones
+	Uploads UploadRulesDto `json:"uploads" mapstructure:"uploads"`
+}
+
+func getPlans() map[string]PlanDto {
+	var plans = map[string]PlanDto{}
+	if err := viper.UnmarshalKey("limits.plans", &plans); err != nil {
+		Logger.Errorf("Error during reading plans: %v", err)
+	}
+	for name, plan := range plans {
+		plan.Name = name
+		plans[name] = plan
+	}
+	return plans
+}
+
+func getPlansList() []PlanDto {
+	var list = make([]PlanDto, 0)
+	for _, plan := range getPlans() {
+		list = append(list, plan)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].MaxBytes < list[j].MaxBytes })
+	return list
+}
+
+// UserLimits is effective quota of user
+type UserLimits struct {
+	Unlimited bool   `json:"unlimited"`
+	Plan      string `json:"plan"`
+	MaxBytes  int64  `json:"maxBytes"`
+	// 0 means unlimited count of files
+	MaxFiles int64 `json:"maxFiles"`
+}
+
+// getUserLimits resolves limits in order: unlimited flag, explicit values, user's plan, default plan, default per user max
+func (h *FsHandler) getUserLimits(userId int) (*UserLimits, error) {
+	dto, e := h.limitsRepository.GetUserLimits(userId)
 	if e != nil {
-		return 0, e
+		return nil, e
 	}
 
-	if b {
+	if dto.Unlimited {
 		var stat syscall.Statfs_t
 		wd := viper.GetString("limits.stat.dir")
 		err := syscall.Statfs(wd, &stat)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		// Available blocks * size per block = available space in bytes
 		u := int64(stat.Bavail * uint64(stat.Bsize))
-		return u, nil
-	} else {
-		return viper.GetInt64("limits.default.per.user.max"), nil
+		return &UserLimits{Unlimited: true, MaxBytes: u}, nil
+	}
+
+	result := &UserLimits{MaxBytes: viper.GetInt64("limits.default.per.user.max")}
+	planName := dto.Plan
+	if len(planName) == 0 {
+		planName = viper.GetString("limits.default.plan")
+	}
+	if len(planName) != 0 {
+		if plan, ok := getPlans()[planName]; ok {
+			result.Plan = plan.Name
+			result.MaxBytes = plan.MaxBytes
+			result.MaxFiles = plan.MaxFiles
+		} else {
+			Logger.Warnf("Plan '%v' of user %v isn't defined in config", planName, userId)
+		}
+	}
+	if dto.MaxBytes != 0 {
+		result.MaxBytes = dto.MaxBytes
+	}
+	if dto.MaxFiles != 0 {
+		result.MaxFiles = dto.MaxFiles
+	}
+	return result, nil
+}
+
+// checkFilesLimit counts unfinished resumable uploads as files too
+func (h *FsHandler) checkFilesLimit(userId int, limits *UserLimits) (bool, error) {
+	if limits.MaxFiles == 0 {
+		return true, nil
+	}
+	files, err := h.userFileRepository.CountUserFiles(userId, isTrashCounted())
+	if err != nil {
+		return false, err
+	}
+	pending, err := h.uploadSessions.CountPending(userId)
+	if err != nil {
+		return false, err
+	}
+	if files+pending >= limits.MaxFiles {
+		Logger.Infof("User %v has reached files limit %v", userId, limits.MaxFiles)
+		h.emitWebhook(WebhookQuotaExceeded, userId, nil, &WebhookQuotaDto{MaxBytes: limits.MaxBytes, MaxFiles: limits.MaxFiles})
+		return false, nil
 	}
+	return true, nil
 }
 
 type UserDto struct {
-	Id        int64 `json:"id"`
-	Unlimited bool  `json:"unlimited"`
+	Id        int64  `json:"id"`
+	Unlimited bool   `json:"unlimited"`
+	Plan      string `json:"plan"`
+	// explicitly set by admin, 0 if not set
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int64 `json:"maxFiles"`
+	// effective ones
+	Limits *UserLimits `json:"limits"`
+	Used   int64       `json:"used"`
 }
 
 func (h *FsHandler) AdminUsersHandler(c echo.Context) error {
@@ -426,22 +817,22 @@ func (h *FsHandler) AdminUsersHandler(c echo.Context) error {
 
 	}
 
-	infos, e := h.minio.ListBuckets()
+	bucketNames, e := h.storage.ListBuckets()
 	if e != nil {
 		return e
 	}
 
 	var a = make([]UserDto, 0)
-	for _, bucket := range infos {
-		if strings.Index(bucket.Name, utils.USER_PREFIX) == 0 {
+	for _, bucketName := range bucketNames {
+		if strings.Index(bucketName, utils.USER_PREFIX) == 0 {
 			var i int
-			_, e := fmt.Sscanf(bucket.Name, utils.USER_PREFIX+"%d", &i)
+			_, e := fmt.Sscanf(bucketName, utils.USER_PREFIX+"%d", &i)
 			if e == nil {
-				unlim, e := h.limitsRepository.IsStorageUnlimitedForUser(i)
+				userDto, e := h.getUserDto(i)
 				if e != nil {
-					Logger.Warnf("Error during parse user id from bucket %v", e)
+					Logger.Warnf("Error during getting limits of user %v: %v", i, e)
 				} else {
-					a = append(a, UserDto{Id: int64(i), Unlimited: unlim})
+					a = append(a, *userDto)
 				}
 			} else {
 				Logger.Warnf("Error during parse user id from bucket %v", e)
@@ -449,9 +840,34 @@ func (h *FsHandler) AdminUsersHandler(c echo.Context) error {
 		}
 	}
 
-	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "users": a})
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "users": a, "plans": getPlansList()})
 }
 
+func (h *FsHandler) getUserDto(userId int) (*UserDto, error) {
+	dto, e := h.limitsRepository.GetUserLimits(userId)
+	if e != nil {
+		return nil, e
+	}
+	limits, e := h.getUserLimits(userId)
+	if e != nil {
+		return nil, e
+	}
+	used, e := h.usageRepository.GetUsed(userId)
+	if e != nil {
+		return nil, e
+	}
+	return &UserDto{
+		Id:        int64(userId),
+		Unlimited: dto.Unlimited,
+		Plan:      dto.Plan,
+		MaxBytes:  dto.MaxBytes,
+		MaxFiles:  dto.MaxFiles,
+		Limits:    limits,
+		Used:      used,
+	}, nil
+}
+
+// AdminPatchUserHandler changes only passed query parameters. Empty plan, zero maxBytes or maxFiles reset value to plan's one.
 func (h *FsHandler) AdminPatchUserHandler(c echo.Context) error {
 	admin := getUserAdminFromContext(c)
 	if !admin {
@@ -460,22 +876,59 @@ func (h *FsHandler) AdminPatchUserHandler(c echo.Context) error {
 	}
 
 	userIdStr := c.QueryParam(utils.USER_ID)
-	limitedStr := c.QueryParam(utils.LIMITED)
 
 	userId, e := strconv.Atoi(userIdStr)
 	if e != nil {
 		return e
 	}
 
-	limited, e := strconv.ParseBool(limitedStr)
+	setAuditTarget(c, AuditTargetUser, strconv.Itoa(userId))
+	before, e := h.getUserDto(userId)
 	if e != nil {
 		return e
 	}
 
-	e = h.limitsRepository.Patch(userId, limited)
+	var patch repository.LimitsPatch
+	params := c.QueryParams()
+	if _, ok := params[utils.LIMITED]; ok {
+		limited, e := strconv.ParseBool(c.QueryParam(utils.LIMITED))
+		if e != nil {
+			return e
+		}
+		unlimited := !limited
+		patch.Unlimited = &unlimited
+	}
+	if _, ok := params[utils.PLAN]; ok {
+		planName := c.QueryParam(utils.PLAN)
+		if _, exists := getPlans()[planName]; len(planName) != 0 && !exists {
+			return c.JSON(http.StatusBadRequest, &utils.H{"status": "unknown plan"})
+		}
+		patch.Plan = &planName
+	}
+	if _, ok := params[utils.MAX_BYTES]; ok {
+		maxBytes, e := strconv.ParseInt(c.QueryParam(utils.MAX_BYTES), 10, 64)
+		if e != nil || maxBytes < 0 {
+			return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong " + utils.MAX_BYTES})
+		}
+		patch.MaxBytes = &maxBytes
+	}
+	if _, ok := params[utils.MAX_FILES]; ok {
+		maxFiles, e := strconv.ParseInt(c.QueryParam(utils.MAX_FILES), 10, 64)
+		if e != nil || maxFiles < 0 {
+			return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong " + utils.MAX_FILES})
+		}
+		patch.MaxFiles = &maxFiles
+	}
+
+	e = h.limitsRepository.Patch(userId, patch)
 	if e != nil {
 		return e
 	}
 
-	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+	userDto, e := h.getUserDto(userId)
+	if e != nil {
+		return e
+	}
+	setAuditChange(c, before, userDto)
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "user": userDto})
 }
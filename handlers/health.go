@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/client"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/storage"
+	"github.com/nkonev/blog-storage/utils"
+	"github.com/spf13/viper"
+	"github.com/xakep666/mongo-migrate"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const HealthOk = "ok"
+const HealthFail = "fail"
+
+// HealthHandler answers probes of orchestrator, both endpoints are excluded from auth by config
+type HealthHandler struct {
+	// version reached on start, 0 until migrations are applied. It's first for atomic access on 32-bit platforms
+	migratedVersion uint64
+	mongo           *mongo.Client
+	storage         storage.Storage
+	restClient      client.RestClient
+	migrate         *migrate.Migrate
+}
+
+type HealthCheckDto struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+	// status of auth backend response
+	HttpStatus int `json:"httpStatus,omitempty"`
+	// version of schema in database
+	Version uint64 `json:"version,omitempty"`
+}
+
+func NewHealthHandler(mongo *mongo.Client, storage storage.Storage, restClient client.RestClient, m *migrate.Migrate) *HealthHandler {
+	return &HealthHandler{mongo: mongo, storage: storage, restClient: restClient, migrate: m}
+}
+
+// SetMigrated is called after migrations are applied, readiness requires database to be at least at this version
+func (h *HealthHandler) SetMigrated(version uint64) {
+	atomic.StoreUint64(&h.migratedVersion, version)
+}
+
+// LiveHandler tells only that process serves requests, dependencies aren't checked so their outage doesn't cause restart
+func (h *HealthHandler) LiveHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, &utils.H{"status": HealthOk})
+}
+
+// ReadyHandler checks all dependencies concurrently and responds 503 if any of them fails
+func (h *HealthHandler) ReadyHandler(c echo.Context) error {
+	viper.SetDefault("health.timeout", "3s")
+	ctx, cancel := context.WithTimeout(c.Request().Context(), viper.GetDuration("health.timeout"))
+	defer cancel()
+
+	checks := map[string]func(ctx context.Context, dto *HealthCheckDto) error{
+		"mongo":      h.checkMongo,
+		"storage":    h.checkStorage,
+		"auth":       h.checkAuth,
+		"migrations": h.checkMigrations,
+	}
+	var results = map[string]*HealthCheckDto{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context, dto *HealthCheckDto) error) {
+			defer wg.Done()
+			dto := &HealthCheckDto{Status: HealthOk}
+			start := time.Now()
+			if err := check(ctx, dto); err != nil {
+				Logger.Warnf("Readiness check %v failed: %v", name, err)
+				dto.Status = HealthFail
+				dto.Error = err.Error()
+			}
+			dto.Latency = time.Since(start).String()
+			mutex.Lock()
+			results[name] = dto
+			mutex.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	status, httpStatus := HealthOk, http.StatusOK
+	for _, dto := range results {
+		if dto.Status != HealthOk {
+			status, httpStatus = HealthFail, http.StatusServiceUnavailable
+		}
+	}
+	return c.JSON(httpStatus, &utils.H{"status": status, "checks": results})
+}
+
+func (h *HealthHandler) checkMongo(ctx context.Context, dto *HealthCheckDto) error {
+	return h.mongo.Ping(ctx, readpref.Primary())
+}
+
+// checkStorage lists buckets, storage interface has no context so it's abandoned on timeout
+func (h *HealthHandler) checkStorage(ctx context.Context, dto *HealthCheckDto) error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := h.storage.ListBuckets()
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkAuth only checks that auth backend answers, request has no session so 401 is expected
+func (h *HealthHandler) checkAuth(ctx context.Context, dto *HealthCheckDto) error {
+	req, err := http.NewRequest(http.MethodGet, viper.GetString("auth.url"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "application/json")
+	resp, err := h.restClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dto.HttpStatus = resp.StatusCode
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("auth backend responded %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func (h *HealthHandler) checkMigrations(ctx context.Context, dto *HealthCheckDto) error {
+	expected := atomic.LoadUint64(&h.migratedVersion)
+	if expected == 0 {
+		return errors.New("migrations are not applied yet")
+	}
+	version, _, err := h.migrate.Version()
+	if err != nil {
+		return err
+	}
+	dto.Version = version
+	if version < expected {
+		return fmt.Errorf("database is at version %v, expected %v", version, expected)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	"github.com/nkonev/blog-storage/imaging"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+const imageParamWidth = "w"
+const imageParamHeight = "h"
+const imageParamFit = "fit"
+const imageParamFormat = "format"
+const imageParamThumbnail = "thumbnail"
+
+func getImageMaxWidth() int {
+	viper.SetDefault("images.max.width", 2048)
+	return viper.GetInt("images.max.width")
+}
+
+func getImageMaxHeight() int {
+	viper.SetDefault("images.max.height", 2048)
+	return viper.GetInt("images.max.height")
+}
+
+func getImageMaxSourcePixels() int {
+	viper.SetDefault("images.max.sourcePixels", 50000000)
+	return viper.GetInt("images.max.sourcePixels")
+}
+
+// getAllowedImageSizes restricts width and height, so requesting every possible size cannot fill the store. Empty means any size up to max.
+func getAllowedImageSizes() []int {
+	return cast.ToIntSlice(viper.Get("images.sizes"))
+}
+
+func getThumbnailOptions() imaging.Options {
+	viper.SetDefault("images.thumbnail.width", 256)
+	viper.SetDefault("images.thumbnail.height", 256)
+	viper.SetDefault("images.thumbnail.fit", imaging.FitCover)
+	return imaging.Options{
+		Width:  viper.GetInt("images.thumbnail.width"),
+		Height: viper.GetInt("images.thumbnail.height"),
+		Fit:    viper.GetString("images.thumbnail.fit"),
+	}
+}
+
+func isAllowedImageSize(size, max int) bool {
+	if size == 0 {
+		return true
+	}
+	if size < 0 || size > max {
+		return false
+	}
+	allowed := getAllowedImageSizes()
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == size {
+			return true
+		}
+	}
+	return false
+}
+
+// parseImageOptions returns nil options when original is requested
+func parseImageOptions(c echo.Context) (*imaging.Options, string) {
+	params := c.QueryParams()
+	if _, ok := params[imageParamThumbnail]; ok {
+		opts := getThumbnailOptions()
+		return &opts, ""
+	}
+	_, hasWidth := params[imageParamWidth]
+	_, hasHeight := params[imageParamHeight]
+	_, hasFit := params[imageParamFit]
+	_, hasFormat := params[imageParamFormat]
+	if !hasWidth && !hasHeight && !hasFit && !hasFormat {
+		return nil, ""
+	}
+
+	opts := imaging.Options{Fit: imaging.FitContain, Format: c.QueryParam(imageParamFormat)}
+	var err error
+	if hasWidth {
+		if opts.Width, err = strconv.Atoi(c.QueryParam(imageParamWidth)); err != nil || !isAllowedImageSize(opts.Width, getImageMaxWidth()) {
+			return nil, "wrong " + imageParamWidth
+		}
+	}
+	if hasHeight {
+		if opts.Height, err = strconv.Atoi(c.QueryParam(imageParamHeight)); err != nil || !isAllowedImageSize(opts.Height, getImageMaxHeight()) {
+			return nil, "wrong " + imageParamHeight
+		}
+	}
+	if hasFit {
+		opts.Fit = c.QueryParam(imageParamFit)
+		if !imaging.IsValidFit(opts.Fit) {
+			return nil, "wrong " + imageParamFit
+		}
+	}
+	if len(opts.Format) != 0 && !imaging.IsValidFormat(opts.Format) {
+		return nil, "wrong " + imageParamFormat
+	}
+	return &opts, ""
+}
+
+// getDerivativeKey includes checksum of original, so derivative of replaced content is never served
+func getDerivativeKey(dto *repository.UserFileDto, opts imaging.Options) string {
+	checksum := dto.Sha256
+	if len(checksum) > 16 {
+		checksum = checksum[:16]
+	}
+	return dto.Id.Hex() + "_" + opts.String() + "_" + checksum
+}
+
+// ensureDerivative makes resized image unless it has already been cached
+func (h *FsHandler) ensureDerivative(dto *repository.UserFileDto, opts imaging.Options) (string, error) {
+	key := getDerivativeKey(dto, opts)
+	if _, err := h.storage.StatObject(utils.DERIVATIVES_BUCKET, key); err == nil {
+		return key, nil
+	}
+
+	original, err := h.storage.GetObject(getBucketNameInt(dto.UserId), dto.Id.Hex())
+	if err != nil {
+		return "", err
+	}
+	defer original.Close()
+
+	resized, contentType, err := imaging.Resize(original, opts, getImageMaxSourcePixels())
+	if err != nil {
+		return "", err
+	}
+	h.ensureBucket(utils.DERIVATIVES_BUCKET, "europe-east")
+	if _, err := h.storage.PutObject(utils.DERIVATIVES_BUCKET, key, bytes.NewReader(resized), int64(len(resized)), contentType); err != nil {
+		return "", err
+	}
+	if err := h.derivativeRepository.Save(key, dto.Id, int64(len(resized))); err != nil {
+		return "", err
+	}
+	Logger.Infof("Created derivative %v of file %v", key, dto.Id.Hex())
+	return key, nil
+}
+
+func (h *FsHandler) serveDerivative(c echo.Context, dto *repository.UserFileDto, opts imaging.Options) error {
+	if !imaging.IsSupportedContentType(dto.ContentType) {
+		return c.JSON(http.StatusUnsupportedMediaType, &utils.H{"status": "not an image"})
+	}
+	key, err := h.ensureDerivative(dto, opts)
+	switch err {
+	case nil:
+	case imaging.ErrUnsupportedFormat:
+		return c.JSON(http.StatusUnsupportedMediaType, &utils.H{"status": "not an image"})
+	case imaging.ErrTooLarge:
+		return c.JSON(http.StatusRequestEntityTooLarge, &utils.H{"status": "image is too large"})
+	default:
+		return err
+	}
+	return h.download(utils.DERIVATIVES_BUCKET, key, dto)(c)
+}
+
+// generateThumbnail is called after upload so the first page showing image doesn't wait for resizing
+func (h *FsHandler) generateThumbnail(fileId string, userId int) {
+	dto, err := h.userFileRepository.GetUserFile(fileId, userId)
+	if err != nil {
+		Logger.Errorf("Error during getting file %v for thumbnail: %v", fileId, err)
+		return
+	}
+	if !imaging.IsSupportedContentType(dto.ContentType) {
+		return
+	}
+	if _, err := h.ensureDerivative(dto, getThumbnailOptions()); err != nil {
+		Logger.Warnf("Cannot make thumbnail of file %v: %v", fileId, err)
+	}
+}
+
+// removeDerivatives is called when original is replaced or purged
+func (h *FsHandler) removeDerivatives(dto *repository.UserFileDto) {
+	derivatives, err := h.derivativeRepository.FindByFile(dto.Id)
+	if err != nil {
+		Logger.Errorf("Error during finding derivatives of %v: %v", dto.Id.Hex(), err)
+		return
+	}
+	for _, derivative := range derivatives {
+		if err := h.storage.RemoveObject(utils.DERIVATIVES_BUCKET, derivative.Id); err != nil {
+			Logger.Errorf("Error during removing derivative %v: %v", derivative.Id, err)
+			continue
+		}
+		if err := h.derivativeRepository.Delete(derivative.Id); err != nil {
+			Logger.Errorf("Error during removing derivative %v from mongo: %v", derivative.Id, err)
+		}
+	}
+}
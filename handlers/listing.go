@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const defaultPageSize = 50
+const maxPageSize = 1000
+
+type wrongParamError string
+
+func (e wrongParamError) Error() string {
+	return "wrong " + string(e)
+}
+
+func encodeCursor(cursor repository.FileCursor) string {
+	bytes, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func decodeCursor(s string) (*repository.FileCursor, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cursor repository.FileCursor
+	if err := json.Unmarshal(bytes, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// parseFileQuery reads paging, sorting and filtering parameters of listing, returns wrongParamError for malformed ones
+func parseFileQuery(c echo.Context, userId int, folderId *primitive.ObjectID) (*repository.FileQuery, error) {
+	q := &repository.FileQuery{
+		UserId:      userId,
+		FolderId:    folderId,
+		Filename:    c.QueryParam("filename"),
+		ContentType: c.QueryParam("contentType"),
+		Sort:        repository.SortByName,
+	}
+	if sort := c.QueryParam("sort"); len(sort) != 0 {
+		if !repository.IsValidSort(sort) {
+			return nil, wrongParamError("sort")
+		}
+		q.Sort = sort
+	}
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return nil, wrongParamError("order")
+	}
+	if limitStr := c.QueryParam("limit"); len(limitStr) != 0 {
+		limit, err := strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return nil, wrongParamError("limit")
+		}
+		q.Limit = limit
+	}
+	if publishedStr := c.QueryParam("published"); len(publishedStr) != 0 {
+		published, err := strconv.ParseBool(publishedStr)
+		if err != nil {
+			return nil, wrongParamError("published")
+		}
+		q.Published = &published
+	}
+	if cursorStr := c.QueryParam("cursor"); len(cursorStr) != 0 {
+		cursor, err := decodeCursor(cursorStr)
+		if err != nil {
+			return nil, wrongParamError("cursor")
+		}
+		q.After = cursor
+	}
+	// client which doesn't page gets all files as before paging was introduced
+	if q.Limit == 0 && q.After != nil {
+		q.Limit = defaultPageSize
+	}
+	return q, nil
+}
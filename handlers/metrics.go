@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"github.com/nkonev/blog-storage/metrics"
+)
+
+// GetUsersUsage collects consumption and effective quota of every user known by usage counters
+func (h *FsHandler) GetUsersUsage() ([]metrics.UserUsage, error) {
+	usages, err := h.usageRepository.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	var list = make([]metrics.UserUsage, 0, len(usages))
+	for _, usage := range usages {
+		limits, err := h.getUserLimits(usage.Id)
+		if err != nil {
+			return nil, err
+		}
+		files, err := h.userFileRepository.CountUserFiles(usage.Id, isTrashCounted())
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, metrics.UserUsage{UserId: usage.Id, Used: usage.Used, MaxBytes: limits.MaxBytes, Files: files})
+	}
+	return list, nil
+}
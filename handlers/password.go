@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type PasswordDto struct {
+	Password string `json:"password" form:"password"`
+}
+
+const unlockCookiePrefix = "unlock_"
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>{{.Filename}}</title>
+</head>
+<body>
+<form method="post">
+    <p>File <b>{{.Filename}}</b> is protected by password</p>
+    {{if .Wrong}}<p style="color: red">Wrong password</p>{{end}}
+    <input type="password" name="password" autofocus>
+    <button type="submit">Download</button>
+</form>
+</body>
+</html>
+`))
+
+type challengePageData struct {
+	Filename string
+	Wrong    bool
+}
+
+func getPasswordMaxFailures() int64 {
+	viper.SetDefault("password.throttle.failures", 5)
+	return viper.GetInt64("password.throttle.failures")
+}
+
+func getPasswordThrottleWindow() time.Duration {
+	viper.SetDefault("password.throttle.window", "15m")
+	return viper.GetDuration("password.throttle.window")
+}
+
+func getUnlockTtl() time.Duration {
+	viper.SetDefault("password.unlock.ttl", "24h")
+	return viper.GetDuration("password.unlock.ttl")
+}
+
+// signUnlock binds unlock to password hash, so changing password locks file again
+func signUnlock(dto *repository.UserFileDto, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(viper.GetString("password.unlock.secret")))
+	fmt.Fprintf(mac, "%v\n%v\n%v", dto.Id.Hex(), dto.PasswordHash, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isUnlockedByCookie(c echo.Context, dto *repository.UserFileDto) bool {
+	cookie, err := c.Cookie(unlockCookiePrefix + dto.Id.Hex())
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(signUnlock(dto, expires)), []byte(parts[1]))
+}
+
+func setUnlockCookie(c echo.Context, dto *repository.UserFileDto) {
+	expires := time.Now().Add(getUnlockTtl())
+	c.SetCookie(&http.Cookie{
+		Name:     unlockCookiePrefix + dto.Id.Hex(),
+		Value:    strconv.FormatInt(expires.Unix(), 10) + "." + signUnlock(dto, expires.Unix()),
+		Path:     c.Request().URL.Path,
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// getOfferedPassword takes password from Basic auth, html form or json body
+func getOfferedPassword(c echo.Context) (string, bool) {
+	if _, password, ok := c.Request().BasicAuth(); ok {
+		return password, true
+	}
+	if c.Request().Method != http.MethodPost {
+		return "", false
+	}
+	p := &PasswordDto{}
+	if err := c.Bind(p); err != nil {
+		Logger.Infof("Error during binding password: %v", err)
+		return "", false
+	}
+	return p.Password, true
+}
+
+func wantsHtml(c echo.Context) bool {
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML)
+}
+
+func respondChallenge(c echo.Context, dto *repository.UserFileDto, wrong bool) error {
+	if wantsHtml(c) {
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+		c.Response().WriteHeader(http.StatusUnauthorized)
+		return challengePage.Execute(c.Response(), challengePageData{Filename: dto.Filename, Wrong: wrong})
+	}
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Basic realm=\"file\"")
+	if wrong {
+		return c.JSON(http.StatusUnauthorized, &utils.H{"status": "wrong password"})
+	}
+	return c.JSON(http.StatusUnauthorized, &utils.H{"status": "password required"})
+}
+
+// unlockPublicFile checks password of protected file. Returns true if download may proceed, otherwise response has been written.
+func (h *FsHandler) unlockPublicFile(c echo.Context, dto *repository.UserFileDto) (bool, error) {
+	if len(dto.PasswordHash) == 0 || isUnlockedByCookie(c, dto) {
+		return true, nil
+	}
+
+	password, offered := getOfferedPassword(c)
+	if !offered {
+		return false, respondChallenge(c, dto, false)
+	}
+
+	fileId := dto.Id.Hex()
+	lockedUntil, err := h.passwordAttemptRepository.GetLockedUntil(fileId, getPasswordMaxFailures())
+	if err != nil {
+		return false, err
+	}
+	if lockedUntil != nil {
+		retryAfter := int64(time.Until(*lockedUntil).Seconds()) + 1
+		c.Response().Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		return false, c.JSON(http.StatusTooManyRequests, &utils.H{"status": "too many attempts"})
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(dto.PasswordHash), []byte(password)) != nil {
+		if err := h.passwordAttemptRepository.RegisterFailure(fileId, getPasswordThrottleWindow()); err != nil {
+			return false, err
+		}
+		return false, respondChallenge(c, dto, true)
+	}
+
+	setUnlockCookie(c, dto)
+	if c.Request().Method == http.MethodPost && wantsHtml(c) {
+		// browser gets file by ordinary GET with cookie, so reload doesn't resubmit form
+		return false, c.Redirect(http.StatusSeeOther, c.Request().URL.RequestURI())
+	}
+	return true, nil
+}
+
+// SetPasswordHandler protects file by password, empty password removes protection
+func (h *FsHandler) SetPasswordHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	p := &PasswordDto{}
+	if err := c.Bind(p); err != nil {
+		return err
+	}
+
+	var hash string
+	if len(p.Password) != 0 {
+		hash, err = utils.HashPassword(p.Password)
+		if err != nil {
+			return err
+		}
+	}
+	if err := h.userFileRepository.SetPassword(getFileId(c), userId, hash); err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "passwordProtected": len(hash) != 0})
+}
+
+func (h *FsHandler) DeletePasswordHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.userFileRepository.SetPassword(getFileId(c), userId, ""); err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "passwordProtected": false})
+}
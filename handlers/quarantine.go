@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"github.com/spf13/viper"
+)
+
+// reason of quarantine when scanner is unavailable, details are only logged
+const reasonScanFailed = "scan failed"
+
+type QuarantinedFileDto struct {
+	FileInfoDto
+	OwnerId       int64     `json:"ownerId"`
+	Reason        string    `json:"reason"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+// isScanFailOpen makes file visible when scanner cannot be reached, otherwise file waits for admin in quarantine
+func isScanFailOpen() bool {
+	return viper.GetBool("scanner.failOpen")
+}
+
+// scanObject reads stored object back, so exactly stored bytes are checked. Returns reason of quarantine or empty string.
+func (h *FsHandler) scanObject(bucketName, fileId string) string {
+	object, err := h.storage.GetObject(bucketName, fileId)
+	if err == nil {
+		defer object.Close()
+		result, scanErr := h.scanner.Scan(object)
+		if scanErr == nil {
+			if result.Infected {
+				return result.Signature
+			}
+			return ""
+		}
+		err = scanErr
+	}
+	if isScanFailOpen() {
+		Logger.Warnf("File %v isn't scanned: %v", fileId, err)
+		return ""
+	}
+	Logger.Errorf("Error during scan of file %v: %v", fileId, err)
+	return reasonScanFailed
+}
+
+func respondQuarantined(c echo.Context, fileId, reason string) error {
+	return c.JSON(http.StatusUnprocessableEntity, &utils.H{"status": "quarantined", "id": fileId, "reason": reason})
+}
+
+func isQuarantined(dto *repository.UserFileDto) bool {
+	return dto.State == repository.UploadStateQuarantined
+}
+
+func (h *FsHandler) AdminQuarantineHandler(c echo.Context) error {
+	if !getUserAdminFromContext(c) {
+		return c.JSON(http.StatusUnauthorized, &utils.H{"status": "not admin"})
+	}
+	files, err := h.userFileRepository.FindQuarantined()
+	if err != nil {
+		return err
+	}
+	var list = make([]QuarantinedFileDto, 0, len(files))
+	for i := range files {
+		dto := &files[i]
+		info, err := h.getFileInfo(getBucketNameInt(dto.UserId), dto)
+		if err != nil {
+			return err
+		}
+		list = append(list, QuarantinedFileDto{FileInfoDto: *info, OwnerId: dto.UserId, Reason: dto.QuarantineReason, QuarantinedAt: dto.QuarantinedAt})
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "files": list})
+}
+
+// AdminReleaseHandler is used for false positives
+func (h *FsHandler) AdminReleaseHandler(c echo.Context) error {
+	if !getUserAdminFromContext(c) {
+		return c.JSON(http.StatusUnauthorized, &utils.H{"status": "not admin"})
+	}
+	dto, err := h.userFileRepository.GetQuarantined(getFileId(c))
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	if err := h.userFileRepository.Release(dto.Id); err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	Logger.Infof("File %v of user %v has been released from quarantine", dto.Id.Hex(), dto.UserId)
+	go h.generateThumbnail(dto.Id.Hex(), int(dto.UserId))
+	if dto.Published {
+		h.sanitizePublished(dto.Id.Hex())
+	}
+	h.emitFileWebhook(WebhookFileUploaded, dto.Id.Hex())
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
+
+func (h *FsHandler) AdminDeleteQuarantinedHandler(c echo.Context) error {
+	if !getUserAdminFromContext(c) {
+		return c.JSON(http.StatusUnauthorized, &utils.H{"status": "not admin"})
+	}
+	dto, err := h.userFileRepository.GetQuarantined(getFileId(c))
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	// quarantined file always takes space, unlike trashed one
+	dto.TrashCounted = true
+	deleted, err := h.purgeFile(dto, true)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		// released by another admin meanwhile
+		return c.JSON(http.StatusNotFound, &utils.H{"status": "not found"})
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
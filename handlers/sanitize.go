@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	"github.com/nkonev/blog-storage/imaging"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"github.com/spf13/viper"
+)
+
+// SanitizeOff keeps images as they were uploaded
+const SanitizeOff = "off"
+
+// SanitizeOnUpload strips metadata before original is stored
+const SanitizeOnUpload = "upload"
+
+// SanitizeOnPublish keeps private original intact and serves stripped copy on public route
+const SanitizeOnPublish = "publish"
+
+func getSanitizePolicy() string {
+	viper.SetDefault("images.sanitize", SanitizeOnPublish)
+	return viper.GetString("images.sanitize")
+}
+
+func isSanitizedOnPublish(dto *repository.UserFileDto) bool {
+	return getSanitizePolicy() == SanitizeOnPublish && imaging.CanStripMetadata(dto.ContentType)
+}
+
+// stripMetadataAsync returns reader of stripped image, result is sent after reader is drained or closed
+func stripMetadataAsync(src io.Reader, contentType string) (*io.PipeReader, <-chan error) {
+	reader, writer := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		_, err := imaging.StripMetadata(writer, src, contentType)
+		writer.CloseWithError(err)
+		result <- err
+	}()
+	return reader, result
+}
+
+func getSanitizedKey(dto *repository.UserFileDto) string {
+	checksum := dto.Sha256
+	if len(checksum) > 16 {
+		checksum = checksum[:16]
+	}
+	return dto.Id.Hex() + "_sanitized_" + checksum
+}
+
+// ensureSanitizedCopy makes published copy without metadata. It's kept among derivatives, so it's removed when original is replaced or purged.
+func (h *FsHandler) ensureSanitizedCopy(dto *repository.UserFileDto) (string, error) {
+	key := getSanitizedKey(dto)
+	if _, err := h.storage.StatObject(utils.DERIVATIVES_BUCKET, key); err == nil {
+		return key, nil
+	}
+
+	original, err := h.storage.GetObject(getBucketNameInt(dto.UserId), dto.Id.Hex())
+	if err != nil {
+		return "", err
+	}
+	defer original.Close()
+
+	var buf bytes.Buffer
+	if _, err := imaging.StripMetadata(&buf, original, dto.ContentType); err != nil {
+		return "", err
+	}
+	h.ensureBucket(utils.DERIVATIVES_BUCKET, "europe-east")
+	if _, err := h.storage.PutObject(utils.DERIVATIVES_BUCKET, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), dto.ContentType); err != nil {
+		return "", err
+	}
+	if err := h.derivativeRepository.Save(key, dto.Id, int64(buf.Len())); err != nil {
+		return "", err
+	}
+	if err := h.userFileRepository.SetSanitized(dto.Id, dto.Sha256); err != nil {
+		return "", err
+	}
+	Logger.Infof("Created sanitized copy %v of file %v", key, dto.Id.Hex())
+	return key, nil
+}
+
+// sanitizePublished is called on publish so file info reflects sanitization at once
+func (h *FsHandler) sanitizePublished(fileId string) {
+	dto, err := h.userFileRepository.GetMetainfoFromMongo(fileId)
+	if err != nil {
+		Logger.Errorf("Error during getting file %v for sanitization: %v", fileId, err)
+		return
+	}
+	if !isSanitizedOnPublish(dto) {
+		return
+	}
+	if _, err := h.ensureSanitizedCopy(dto); err != nil {
+		Logger.Warnf("Cannot sanitize published file %v: %v", fileId, err)
+	}
+}
+
+func respondBrokenImageOrError(c echo.Context, err error) error {
+	if err == imaging.ErrUnsupportedFormat {
+		return c.JSON(http.StatusUnsupportedMediaType, &utils.H{"status": "broken image"})
+	}
+	return err
+}
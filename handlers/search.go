@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	"github.com/nkonev/blog-storage/utils"
+)
+
+const defaultSearchLimit = 20
+const maxSearchLimit = 100
+const maxSearchTerms = 10
+
+// HighlightDto marks match in field, offsets are in characters, End is exclusive
+type HighlightDto struct {
+	Field string `json:"field"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+type SearchHitDto struct {
+	FileInfoDto
+	OwnerId    int64          `json:"ownerId"`
+	Highlights []HighlightDto `json:"highlights"`
+}
+
+func parseSearchTerms(q string) []string {
+	var terms = make([]string, 0)
+	for _, term := range strings.Fields(strings.ToLower(q)) {
+		if len(terms) == maxSearchTerms {
+			break
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// findHighlights finds starts of words matching terms
+func findHighlights(field, value string, terms []string) []HighlightDto {
+	var highlights = make([]HighlightDto, 0)
+	runes := []rune(strings.ToLower(value))
+	for i := range runes {
+		if i > 0 && (unicode.IsLetter(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+			continue
+		}
+		for _, term := range terms {
+			termRunes := []rune(term)
+			if i+len(termRunes) <= len(runes) && string(runes[i:i+len(termRunes)]) == term {
+				highlights = append(highlights, HighlightDto{Field: field, Start: i, End: i + len(termRunes)})
+				break
+			}
+		}
+	}
+	return highlights
+}
+
+func (h *FsHandler) toSearchHit(dto *repository.UserFileDto, terms []string) (*SearchHitDto, error) {
+	info, err := h.getFileInfo(getBucketNameInt(dto.UserId), dto)
+	if err != nil {
+		return nil, err
+	}
+	highlights := findHighlights("filename", dto.Filename, terms)
+	for i, tag := range dto.Tags {
+		highlights = append(highlights, findHighlights("tags."+strconv.Itoa(i), tag, terms)...)
+	}
+	highlights = append(highlights, findHighlights("description", dto.Description, terms)...)
+	return &SearchHitDto{FileInfoDto: *info, OwnerId: dto.UserId, Highlights: highlights}, nil
+}
+
+// search merges whole word matches found by text index, which are ranked by relevance, with prefix matches
+func (h *FsHandler) search(c echo.Context, userId *int) error {
+	terms := parseSearchTerms(c.QueryParam("q"))
+	if len(terms) == 0 {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "empty query"})
+	}
+	var limit int64 = defaultSearchLimit
+	if limitStr := c.QueryParam("limit"); len(limitStr) != 0 {
+		var err error
+		limit, err = strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit <= 0 || limit > maxSearchLimit {
+			return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong limit"})
+		}
+	}
+
+	query := repository.SearchQuery{UserId: userId, Terms: terms, Limit: limit}
+	textResults, err := h.userFileRepository.SearchText(query)
+	if err != nil {
+		return err
+	}
+	prefixResults, err := h.userFileRepository.SearchPrefix(query)
+	if err != nil {
+		return err
+	}
+
+	var seen = map[string]bool{}
+	var hits = make([]SearchHitDto, 0, limit)
+	for _, result := range append(textResults, prefixResults...) {
+		if int64(len(hits)) == limit {
+			break
+		}
+		id := result.Id.Hex()
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		hit, err := h.toSearchHit(&result.UserFileDto, terms)
+		if err != nil {
+			return err
+		}
+		hits = append(hits, *hit)
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "files": hits})
+}
+
+// SearchHandler searches among files of current user
+func (h *FsHandler) SearchHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+	return h.search(c, &userId)
+}
+
+// AdminSearchHandler searches among files of all users
+func (h *FsHandler) AdminSearchHandler(c echo.Context) error {
+	if !getUserAdminFromContext(c) {
+		return c.JSON(http.StatusUnauthorized, &utils.H{"status": "not admin"})
+	}
+	return h.search(c, nil)
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	uuid "github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ShareKey signs share links. First configured key signs new links, the rest are only accepted so keys can be rotated
+// without breaking links issued before.
+type ShareKey struct {
+	Id     string
+	Secret string
+}
+
+const shareParamExpires = "expires"
+const shareParamMaxDownloads = "max"
+const shareParamGeneration = "gen"
+const shareParamNonce = "nonce"
+const shareParamKey = "kid"
+const shareParamSignature = "sig"
+
+func getShareKeys() []ShareKey {
+	var keys []ShareKey
+	if err := viper.UnmarshalKey("share.keys", &keys); err != nil {
+		Logger.Errorf("Error during reading share keys: %v", err)
+	}
+	return keys
+}
+
+func findShareKey(id string) *ShareKey {
+	for _, key := range getShareKeys() {
+		if key.Id == id {
+			return &key
+		}
+	}
+	return nil
+}
+
+func getShareDefaultTtl() time.Duration {
+	viper.SetDefault("share.ttl.default", "24h")
+	return viper.GetDuration("share.ttl.default")
+}
+
+func getShareMaxTtl() time.Duration {
+	viper.SetDefault("share.ttl.max", "720h")
+	return viper.GetDuration("share.ttl.max")
+}
+
+// ShareLink holds everything needed to verify link without storing it
+type ShareLink struct {
+	FileId       string
+	Expires      int64
+	MaxDownloads int64
+	Generation   int64
+	Nonce        string
+	KeyId        string
+}
+
+func (l *ShareLink) sign(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%v\n%v\n%v\n%v\n%v\n%v", l.FileId, l.Expires, l.MaxDownloads, l.Generation, l.Nonce, l.KeyId)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (l *ShareLink) query(signature string) url.Values {
+	values := url.Values{}
+	values.Set(shareParamExpires, strconv.FormatInt(l.Expires, 10))
+	values.Set(shareParamMaxDownloads, strconv.FormatInt(l.MaxDownloads, 10))
+	values.Set(shareParamGeneration, strconv.FormatInt(l.Generation, 10))
+	values.Set(shareParamNonce, l.Nonce)
+	values.Set(shareParamKey, l.KeyId)
+	values.Set(shareParamSignature, signature)
+	return values
+}
+
+func parseShareLink(c echo.Context) (*ShareLink, error) {
+	expires, err := strconv.ParseInt(c.QueryParam(shareParamExpires), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	maxDownloads, err := strconv.ParseInt(c.QueryParam(shareParamMaxDownloads), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	generation, err := strconv.ParseInt(c.QueryParam(shareParamGeneration), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &ShareLink{
+		FileId:       getFileId(c),
+		Expires:      expires,
+		MaxDownloads: maxDownloads,
+		Generation:   generation,
+		Nonce:        c.QueryParam(shareParamNonce),
+		KeyId:        c.QueryParam(shareParamKey),
+	}, nil
+}
+
+func (h *FsHandler) getShareUrl(link *ShareLink, signature string) string {
+	return h.serverUrl + utils.PUBLIC_PREFIX + utils.SHARED_PREFIX + link.FileId + "?" + link.query(signature).Encode()
+}
+
+// ShareHandler mints signed link to private file which expires after ttl and optionally after max downloads
+func (h *FsHandler) ShareHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	keys := getShareKeys()
+	if len(keys) == 0 {
+		Logger.Errorf("There are no configured share keys")
+		return c.JSON(http.StatusInternalServerError, &utils.H{"status": "sharing isn't configured"})
+	}
+
+	ttl := getShareDefaultTtl()
+	if ttlStr := c.QueryParam(utils.TTL); len(ttlStr) != 0 {
+		ttl, err = time.ParseDuration(ttlStr)
+		if err != nil || ttl <= 0 || ttl > getShareMaxTtl() {
+			return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong " + utils.TTL})
+		}
+	}
+	var maxDownloads int64
+	if maxStr := c.QueryParam(utils.MAX_DOWNLOADS); len(maxStr) != 0 {
+		maxDownloads, err = strconv.ParseInt(maxStr, 10, 64)
+		if err != nil || maxDownloads < 0 {
+			return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong " + utils.MAX_DOWNLOADS})
+		}
+	}
+
+	dto, err := h.getCurrentUserFile(c, userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+
+	expires := time.Now().Add(ttl)
+	link := &ShareLink{
+		FileId:       dto.Id.Hex(),
+		Expires:      expires.Unix(),
+		MaxDownloads: maxDownloads,
+		Generation:   dto.LinkGeneration,
+		Nonce:        uuid.NewV4().String(),
+		KeyId:        keys[0].Id,
+	}
+	shareUrl := h.getShareUrl(link, link.sign(keys[0].Secret))
+	// link itself is a credential, so only its terms are recorded
+	setAuditChange(c, nil, utils.H{"expires": expires, "maxDownloads": maxDownloads})
+
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "url": shareUrl, "expires": expires, "maxDownloads": maxDownloads})
+}
+
+// RevokeSharesHandler makes all share links of file issued before invalid
+func (h *FsHandler) RevokeSharesHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := h.userFileRepository.RevokeLinks(getFileId(c), userId); err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
+
+// isCountedDownload tells whether request takes download of limited link. Every GET is counted, including ones with Range,
+// because client decides which ranges it asks for. HEAD returns no content.
+func isCountedDownload(c echo.Context) bool {
+	return c.Request().Method == http.MethodGet
+}
+
+func (h *FsHandler) SharedDownloadHandler(c echo.Context) error {
+	link, err := parseShareLink(c)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, &utils.H{"status": "invalid link"})
+	}
+	key := findShareKey(link.KeyId)
+	if key == nil || !hmac.Equal([]byte(link.sign(key.Secret)), []byte(c.QueryParam(shareParamSignature))) {
+		return c.JSON(http.StatusForbidden, &utils.H{"status": "invalid link"})
+	}
+	if time.Now().Unix() > link.Expires {
+		return c.JSON(http.StatusGone, &utils.H{"status": "expired"})
+	}
+
+	dto, err := h.userFileRepository.GetMetainfoFromMongo(link.FileId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, &utils.H{"status": "stat fail"})
+		}
+		return err
+	}
+	if dto.Trashed || dto.State != repository.UploadStateReady {
+		return c.JSON(http.StatusNotFound, &utils.H{"status": "stat fail"})
+	}
+	if dto.LinkGeneration != link.Generation {
+		return c.JSON(http.StatusGone, &utils.H{"status": "revoked"})
+	}
+
+	if link.MaxDownloads > 0 && isCountedDownload(c) {
+		consumed, err := h.shareLinkRepository.TryConsume(link.Nonce, dto.Id, link.MaxDownloads, time.Unix(link.Expires, 0))
+		if err != nil {
+			return err
+		}
+		if !consumed {
+			return c.JSON(http.StatusGone, &utils.H{"status": "download limit reached"})
+		}
+	}
+
+	return h.recordDownload(repository.DownloadKindShared, dto, h.download(getBucketNameInt(dto.UserId), link.FileId, dto))(c)
+}
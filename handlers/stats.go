@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const statsDateLayout = "2006-01-02"
+const defaultStatsPeriod = 30 * 24 * time.Hour
+const defaultTopLimit = 10
+
+type StatsTotalDto struct {
+	Key       string `json:"key"`
+	Downloads int64  `json:"downloads"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type FileStatsDto struct {
+	Id        string `json:"id"`
+	Filename  string `json:"filename"`
+	UserId    int64  `json:"userId"`
+	Downloads int64  `json:"downloads"`
+	Bytes     int64  `json:"bytes"`
+}
+
+func getReferrerHost(c echo.Context) string {
+	referrer, err := url.Parse(c.Request().Referer())
+	if err != nil {
+		return ""
+	}
+	return referrer.Hostname()
+}
+
+// recordDownload counts download after it has been served, failure to count doesn't affect downloading.
+// Partial response adds only bytes, so client fetching file by ranges doesn't inflate count of downloads.
+func (h *FsHandler) recordDownload(kind string, dto *repository.UserFileDto, next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := next(c); err != nil {
+			return err
+		}
+		if c.Request().Method != http.MethodGet {
+			return nil
+		}
+		var downloads int64
+		switch c.Response().Status {
+		case http.StatusOK:
+			downloads = 1
+		case http.StatusPartialContent:
+		default:
+			return nil
+		}
+		if err := h.downloadStatsRepository.Record(dto.Id, dto.UserId, kind, getReferrerHost(c), downloads, c.Response().Size); err != nil {
+			Logger.Errorf("Error during recording download of %v: %v", dto.Id.Hex(), err)
+		}
+		return nil
+	}
+}
+
+// getStatsPeriod reads inclusive period of days from "from" and "to" parameters, last 30 days by default
+func getStatsPeriod(c echo.Context) (time.Time, time.Time, error) {
+	to := time.Now()
+	if toStr := c.QueryParam("to"); len(toStr) != 0 {
+		parsed, err := time.Parse(statsDateLayout, toStr)
+		if err != nil {
+			return to, to, err
+		}
+		to = parsed
+	}
+	from := to.Add(-defaultStatsPeriod)
+	if fromStr := c.QueryParam("from"); len(fromStr) != 0 {
+		parsed, err := time.Parse(statsDateLayout, fromStr)
+		if err != nil {
+			return from, to, err
+		}
+		from = parsed
+	}
+	return from, to, nil
+}
+
+func toStatsTotals(totals []repository.DownloadStatsTotalDto) []StatsTotalDto {
+	var list = make([]StatsTotalDto, 0, len(totals))
+	for _, total := range totals {
+		var key string
+		switch k := total.Key.(type) {
+		case primitive.DateTime:
+			key = time.Unix(int64(k)/1000, 0).UTC().Format(statsDateLayout)
+		case string:
+			key = k
+		}
+		list = append(list, StatsTotalDto{Key: key, Downloads: total.Downloads, Bytes: total.Bytes})
+	}
+	return list
+}
+
+func sumTotals(totals []StatsTotalDto) (int64, int64) {
+	var downloads, bytes int64
+	for _, total := range totals {
+		downloads += total.Downloads
+		bytes += total.Bytes
+	}
+	return downloads, bytes
+}
+
+// FileStatsHandler returns downloads of user's file by day, kind and referrer
+func (h *FsHandler) FileStatsHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+	from, to, err := getStatsPeriod(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong period"})
+	}
+
+	dto, err := h.userFileRepository.GetUserFile(getFileId(c), userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+
+	filter := bson.D{{Key: repository.StatsFileIdField, Value: dto.Id}}
+	var grouped = map[string][]StatsTotalDto{}
+	for _, field := range []string{repository.StatsDayField, repository.StatsKindField, repository.StatsReferrerField} {
+		totals, err := h.downloadStatsRepository.Totals(filter, from, to, field, 0)
+		if err != nil {
+			return err
+		}
+		grouped[field] = toStatsTotals(totals)
+	}
+	downloads, bytes := sumTotals(grouped[repository.StatsKindField])
+
+	return c.JSON(http.StatusOK, &utils.H{
+		"status":    "ok",
+		"downloads": downloads,
+		"bytes":     bytes,
+		"days":      grouped[repository.StatsDayField],
+		"kinds":     grouped[repository.StatsKindField],
+		"referrers": grouped[repository.StatsReferrerField],
+	})
+}
+
+func (h *FsHandler) getFileStats(filter bson.D, from, to time.Time, limit int64) ([]FileStatsDto, error) {
+	totals, err := h.downloadStatsRepository.Totals(filter, from, to, repository.StatsFileIdField, limit)
+	if err != nil {
+		return nil, err
+	}
+	var ids = make([]primitive.ObjectID, 0, len(totals))
+	for _, total := range totals {
+		if id, ok := total.Key.(primitive.ObjectID); ok {
+			ids = append(ids, id)
+		}
+	}
+	files, err := h.userFileRepository.FindFilesByIds(ids)
+	if err != nil {
+		return nil, err
+	}
+	var list = make([]FileStatsDto, 0, len(totals))
+	for _, total := range totals {
+		id, ok := total.Key.(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		file := files[id]
+		list = append(list, FileStatsDto{
+			Id:        id.Hex(),
+			Filename:  file.Filename,
+			UserId:    file.UserId,
+			Downloads: total.Downloads,
+			Bytes:     total.Bytes,
+		})
+	}
+	return list, nil
+}
+
+// UserStatsHandler returns downloads of all user's files, most downloaded first
+func (h *FsHandler) UserStatsHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+	from, to, err := getStatsPeriod(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong period"})
+	}
+
+	list, err := h.getFileStats(bson.D{{Key: repository.StatsUserIdField, Value: int64(userId)}}, from, to, 0)
+	if err != nil {
+		return err
+	}
+	downloads, bytes := int64(0), int64(0)
+	for _, file := range list {
+		downloads += file.Downloads
+		bytes += file.Bytes
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "downloads": downloads, "bytes": bytes, "files": list})
+}
+
+// AdminTopStatsHandler returns most downloaded files of all users
+func (h *FsHandler) AdminTopStatsHandler(c echo.Context) error {
+	if !getUserAdminFromContext(c) {
+		return c.JSON(http.StatusUnauthorized, &utils.H{"status": "not admin"})
+	}
+	from, to, err := getStatsPeriod(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong period"})
+	}
+	var limit int64 = defaultTopLimit
+	if limitStr := c.QueryParam("limit"); len(limitStr) != 0 {
+		limit, err = strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit <= 0 {
+			return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong limit"})
+		}
+	}
+
+	filter := bson.D{}
+	if kind := c.QueryParam(repository.StatsKindField); len(kind) != 0 {
+		filter = append(filter, bson.E{Key: repository.StatsKindField, Value: kind})
+	}
+	list, err := h.getFileStats(filter, from, to, limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "files": list})
+}
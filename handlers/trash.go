@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type TrashedFileDto struct {
+	Id        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	TrashedAt time.Time `json:"trashedAt"`
+	// after this time file will be purged
+	PurgeAt time.Time `json:"purgeAt"`
+}
+
+// isTrashCounted tells whether trashed files take space from quota
+func isTrashCounted() bool {
+	viper.SetDefault("trash.counted", true)
+	return viper.GetBool("trash.counted")
+}
+
+func getTrashRetention() time.Duration {
+	viper.SetDefault("trash.retention", "720h")
+	return viper.GetDuration("trash.retention")
+}
+
+func (h *FsHandler) TrashHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	files, err := h.userFileRepository.FindTrashed(userId)
+	if err != nil {
+		return err
+	}
+
+	retention := getTrashRetention()
+	var list = make([]TrashedFileDto, 0, len(files))
+	for _, file := range files {
+		list = append(list, TrashedFileDto{
+			Id:        file.Id.Hex(),
+			Filename:  file.Filename,
+			Size:      file.Size,
+			TrashedAt: file.TrashedAt,
+			PurgeAt:   file.TrashedAt.Add(retention),
+		})
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "files": list})
+}
+
+func (h *FsHandler) RestoreHandler(c echo.Context) error {
+	objId := getFileId(c)
+
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	dto, err := h.userFileRepository.GetUserFile(objId, userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	if !dto.Trashed {
+		return c.JSON(http.StatusNotFound, &utils.H{"status": "not found"})
+	}
+
+	if !dto.TrashCounted {
+		// space was released on trashing so restored file should fit into quota again
+		reserved, err := h.reserveUserSpace(c, dto.Size)
+		if err != nil {
+			return err
+		}
+		if !reserved {
+			return c.JSON(http.StatusRequestEntityTooLarge, &utils.H{"status": "fail"})
+		}
+	}
+
+	if _, err := h.userFileRepository.Restore(objId, userId); err != nil {
+		if !dto.TrashCounted {
+			h.releaseUserSpace(userId, dto.Size)
+		}
+		return respondNotFoundOrError(c, err)
+	}
+	if dto.FolderId != nil {
+		if _, err := h.folderRepository.GetUserFolder(dto.FolderId.Hex(), userId); err == mongo.ErrNoDocuments {
+			// folder has been deleted while file was in trash
+			if err := h.userFileRepository.SetFolder(objId, userId, nil); err != nil {
+				return err
+			}
+		}
+	}
+	h.emitFileWebhook(WebhookFileRestored, objId)
+
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
+
+func (h *FsHandler) EmptyTrashHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	files, err := h.userFileRepository.FindTrashed(userId)
+	if err != nil {
+		return err
+	}
+	var purged = make([]string, 0, len(files))
+	for i := range files {
+		deleted, err := h.purgeFile(&files[i], false)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			purged = append(purged, files[i].Id.Hex())
+		}
+	}
+	setAuditChange(c, nil, utils.H{"purged": purged})
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "purged": len(purged)})
+}
+
+// purgeFile removes trashed file completely, or quarantined one when quarantined is set. Metadata is removed first
+// and only while file is still in that state, so file restored concurrently keeps its content. Returns false in that case.
+func (h *FsHandler) purgeFile(dto *repository.UserFileDto, quarantined bool) (bool, error) {
+	userId := int(dto.UserId)
+	var deleted bool
+	var err error
+	if quarantined {
+		deleted, err = h.userFileRepository.DeleteQuarantined(dto.Id)
+	} else {
+		deleted, err = h.userFileRepository.DeleteTrashed(dto.Id, userId)
+	}
+	if err != nil {
+		Logger.Errorf("Error during remove object from mongo: %v", err)
+		return false, err
+	}
+	if !deleted {
+		Logger.Infof("File %v has already been restored or purged", dto.Id.Hex())
+		return false, nil
+	}
+	if dto.TrashCounted {
+		h.releaseUserSpace(userId, dto.Size)
+	}
+	if err := h.storage.RemoveObject(getBucketNameInt(userId), dto.Id.Hex()); err != nil {
+		// object without metadata is removed by orphans cleanup
+		Logger.Errorf("Error during remove object from storage: %v", err)
+		return true, err
+	}
+	if err := h.purgeVersions(dto.Id); err != nil {
+		return true, err
+	}
+	if err := h.downloadStatsRepository.DeleteByFile(dto.Id); err != nil {
+		Logger.Errorf("Error during remove download stats of %v: %v", dto.Id.Hex(), err)
+	}
+	if err := h.fileGrantRepository.DeleteByFile(dto.Id); err != nil {
+		Logger.Errorf("Error during remove grants of %v: %v", dto.Id.Hex(), err)
+	}
+	h.removeDerivatives(dto)
+	Logger.Infof("File %v of user %v has been purged", dto.Id.Hex(), userId)
+	return true, nil
+}
+
+// PurgeExpiredTrash removes files which have been in trash longer than retention
+func (h *FsHandler) PurgeExpiredTrash() (int, error) {
+	files, err := h.userFileRepository.FindTrashedBefore(time.Now().Add(-getTrashRetention()))
+	if err != nil {
+		return 0, err
+	}
+	var purged int
+	for i := range files {
+		deleted, err := h.purgeFile(&files[i], false)
+		if deleted {
+			purged++
+		}
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,439 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// https://tus.io/protocols/resumable-upload.html
+const TusVersion = "1.0.0"
+const TusExtensions = "creation,termination,expiration"
+
+const HeaderTusResumable = "Tus-Resumable"
+const HeaderTusVersion = "Tus-Version"
+const HeaderTusExtension = "Tus-Extension"
+const HeaderTusMaxSize = "Tus-Max-Size"
+const HeaderUploadLength = "Upload-Length"
+const HeaderUploadOffset = "Upload-Offset"
+const HeaderUploadMetadata = "Upload-Metadata"
+const HeaderUploadExpires = "Upload-Expires"
+const HeaderUploadDeferLength = "Upload-Defer-Length"
+
+const TusOffsetContentType = "application/offset+octet-stream"
+
+func getTusExpiration() time.Duration {
+	viper.SetDefault("tus.expiration", "24h")
+	return viper.GetDuration("tus.expiration")
+}
+
+func setTusHeaders(c echo.Context) {
+	c.Response().Header().Set(HeaderTusResumable, TusVersion)
+	c.Response().Header().Set("Cache-Control", "no-store")
+}
+
+// TusMiddleware rejects clients which speak another version of protocol
+func (h *FsHandler) TusMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		setTusHeaders(c)
+		if c.Request().Method != http.MethodOptions && c.Request().Header.Get(HeaderTusResumable) != TusVersion {
+			c.Response().Header().Set(HeaderTusVersion, TusVersion)
+			return c.JSON(http.StatusPreconditionFailed, &utils.H{"status": "unsupported tus version"})
+		}
+		return next(c)
+	}
+}
+
+// parseTusMetadata parses "key base64value,key2 base64value2"
+func parseTusMetadata(header string) map[string]string {
+	var result = map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		if len(kv) == 0 {
+			continue
+		}
+		if len(kv) == 1 {
+			result[kv[0]] = ""
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			Logger.Infof("Cannot decode tus metadata value of key %v: %v", kv[0], err)
+			continue
+		}
+		result[kv[0]] = string(decoded)
+	}
+	return result
+}
+
+func firstNonEmpty(m map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := m[k]; len(v) != 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+func (h *FsHandler) getTusLocation(sessionId string) string {
+	return h.serverUrl + utils.TUS_PREFIX + sessionId
+}
+
+func (h *FsHandler) TusOptionsHandler(c echo.Context) error {
+	c.Response().Header().Set(HeaderTusVersion, TusVersion)
+	c.Response().Header().Set(HeaderTusExtension, TusExtensions)
+	if userId, ok := getUserIdFromContext(c); ok {
+		if limits, err := h.getUserLimits(userId); err == nil {
+			c.Response().Header().Set(HeaderTusMaxSize, strconv.FormatInt(limits.MaxBytes, 10))
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *FsHandler) TusCreateHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	if len(c.Request().Header.Get(HeaderUploadDeferLength)) != 0 {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "deferred length is not supported"})
+	}
+	length, err := strconv.ParseInt(c.Request().Header.Get(HeaderUploadLength), 10, 64)
+	if err != nil || length < 0 {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong " + HeaderUploadLength})
+	}
+
+	metadata := parseTusMetadata(c.Request().Header.Get(HeaderUploadMetadata))
+	filename := firstNonEmpty(metadata, "filename", "name")
+	if len(filename) == 0 {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "filename metadata is required"})
+	}
+	contentType := firstNonEmpty(metadata, "filetype", "type", "contentType")
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	folderId, filename, err := h.resolveUploadFolder(userId, metadata[FormFolderId], firstNonEmpty(metadata, "relativePath", FormPath), filename)
+	if err != nil {
+		return respondFolderError(c, err)
+	}
+
+	// declared type is checked at once, real one is sniffed when upload is completed
+	rules, err := h.getUploadRules(userId)
+	if err != nil {
+		return err
+	}
+	if err := rules.checkSize(length); err != nil {
+		return respondUploadRejection(c, err)
+	}
+	if err := rules.checkFile(filename, contentType); err != nil {
+		return respondUploadRejection(c, err)
+	}
+
+	// space is reserved until upload is completed, terminated or expired
+	userLimitOk, err := h.reserveUserSpace(c, length)
+	if err != nil {
+		return err
+	}
+	if !userLimitOk {
+		return c.JSON(http.StatusRequestEntityTooLarge, &utils.H{"status": "fail"})
+	}
+
+	expiresAt := time.Now().Add(getTusExpiration())
+	sessionId, err := h.uploadSessions.Create(repository.UploadSessionDto{
+		UserId:      int64(userId),
+		Filename:    filename,
+		ContentType: contentType,
+		Length:      length,
+		Expires:     expiresAt,
+		FolderId:    folderId,
+	})
+	if err != nil {
+		h.releaseUserSpace(userId, length)
+		return err
+	}
+	setAuditTarget(c, AuditTargetUpload, *sessionId)
+
+	if length == 0 {
+		session, err := h.uploadSessions.GetUserSession(*sessionId, userId)
+		if err != nil {
+			return err
+		}
+		if err := h.completeUpload(c, session); err != nil {
+			return respondUploadRejection(c, err)
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, h.getTusLocation(*sessionId))
+	c.Response().Header().Set(HeaderUploadExpires, expiresAt.UTC().Format(http.TimeFormat))
+	c.Response().Header().Set(HeaderUploadOffset, "0")
+	return c.NoContent(http.StatusCreated)
+}
+
+// getActiveSession writes response itself when it returns nil session
+func (h *FsHandler) getActiveSession(c echo.Context) (*repository.UploadSessionDto, error) {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return nil, err
+	}
+	session, err := h.uploadSessions.GetUserSession(c.Param("id"), userId)
+	if err == mongo.ErrNoDocuments {
+		return nil, c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.Expires.Before(time.Now()) {
+		return nil, c.NoContent(http.StatusGone)
+	}
+	return session, nil
+}
+
+func setTusProgressHeaders(c echo.Context, session *repository.UploadSessionDto) {
+	c.Response().Header().Set(HeaderUploadOffset, strconv.FormatInt(session.Offset, 10))
+	c.Response().Header().Set(HeaderUploadLength, strconv.FormatInt(session.Length, 10))
+	c.Response().Header().Set(HeaderUploadExpires, session.Expires.UTC().Format(http.TimeFormat))
+}
+
+func (h *FsHandler) TusHeadHandler(c echo.Context) error {
+	session, err := h.getActiveSession(c)
+	if session == nil {
+		return err
+	}
+	setTusProgressHeaders(c, session)
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *FsHandler) TusPatchHandler(c echo.Context) error {
+	skipAudit(c)
+	if c.Request().Header.Get(echo.HeaderContentType) != TusOffsetContentType {
+		return c.JSON(http.StatusUnsupportedMediaType, &utils.H{"status": "wrong content type"})
+	}
+	clientOffset, err := strconv.ParseInt(c.Request().Header.Get(HeaderUploadOffset), 10, 64)
+	if err != nil || clientOffset < 0 {
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong " + HeaderUploadOffset})
+	}
+
+	session, err := h.getActiveSession(c)
+	if session == nil {
+		return err
+	}
+	if clientOffset != session.Offset {
+		setTusProgressHeaders(c, session)
+		return c.NoContent(http.StatusConflict)
+	}
+
+	remaining := session.Length - session.Offset
+	if remaining > 0 {
+		size := int64(-1)
+		if contentLength := c.Request().ContentLength; contentLength >= 0 {
+			if contentLength > remaining {
+				return c.JSON(http.StatusRequestEntityTooLarge, &utils.H{"status": "chunk exceeds " + HeaderUploadLength})
+			}
+			size = contentLength
+		}
+		if size != 0 {
+			newExpires := time.Now().Add(getTusExpiration())
+			appended, err := h.storePart(c, session, io.LimitReader(c.Request().Body, remaining), size, newExpires)
+			if err != nil {
+				return err
+			}
+			if !appended {
+				// concurrent PATCH has won
+				return c.NoContent(http.StatusConflict)
+			}
+		}
+	}
+
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+	session, err = h.uploadSessions.GetUserSession(session.Id.Hex(), userId)
+	if err != nil {
+		return err
+	}
+	if session.Offset == session.Length && !session.IsCompleted() {
+		// only completion is recorded, not each chunk
+		getAuditState(c).skip = false
+		if err := h.completeUpload(c, session); err != nil {
+			return respondUploadRejection(c, err)
+		}
+	}
+	setTusProgressHeaders(c, session)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// storePart streams request body to separate object and registers it in session
+func (h *FsHandler) storePart(c echo.Context, session *repository.UploadSessionDto, body io.Reader, size int64, newExpires time.Time) (bool, error) {
+	if err := h.storage.EnsureBucket(utils.UPLOADS_BUCKET, getBucketLocation(c)); err != nil {
+		return false, err
+	}
+	partKey := primitive.NewObjectID().Hex()
+	written, err := h.storage.PutObject(utils.UPLOADS_BUCKET, partKey, body, size, TusOffsetContentType)
+	if err != nil {
+		Logger.Infof("Error during storing part of upload %v: %v", session.Id.Hex(), err)
+		h.removePart(partKey)
+		return false, err
+	}
+	if written == 0 {
+		h.removePart(partKey)
+		return true, nil
+	}
+	appended, err := h.uploadSessions.AppendPart(session.Id.Hex(), int(session.UserId), session.Offset, repository.UploadPartDto{Key: partKey, Size: written}, newExpires)
+	if err != nil || !appended {
+		h.removePart(partKey)
+	}
+	return appended, err
+}
+
+func (h *FsHandler) removePart(partKey string) {
+	if err := h.storage.RemoveObject(utils.UPLOADS_BUCKET, partKey); err != nil {
+		Logger.Warnf("Error during removing upload part %v: %v", partKey, err)
+	}
+}
+
+// completeUpload assembles parts into ordinary user file which becomes visible in /ls
+func (h *FsHandler) completeUpload(c echo.Context, session *repository.UploadSessionDto) error {
+	bucketName := h.ensureAndGetBucket(c)
+	userId := int(session.UserId)
+
+	var readers = make([]io.Reader, 0, len(session.Parts))
+	for _, part := range session.Parts {
+		object, err := h.storage.GetObject(utils.UPLOADS_BUCKET, part.Key)
+		if err != nil {
+			Logger.Errorf("Error during opening part %v of upload %v: %v", part.Key, session.Id.Hex(), err)
+			return err
+		}
+		defer object.Close()
+		readers = append(readers, object)
+	}
+
+	contentType, content, err := sniffContentType(io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+	rules, err := h.getUploadRules(userId)
+	if err != nil {
+		return err
+	}
+	if err := rules.checkFile(session.Filename, contentType); err != nil {
+		Logger.Infof("Upload %v is rejected: %v", session.Id.Hex(), err)
+		h.terminateSession(session)
+		return err
+	}
+
+	// folder is resolved on creation of session, it could be removed since then
+	folderId := session.FolderId
+	if folderId != nil {
+		if _, err := h.folderRepository.GetUserFolder(folderId.Hex(), userId); err == mongo.ErrNoDocuments {
+			Logger.Infof("Folder %v of upload %v has gone, file is placed to root", folderId.Hex(), session.Id.Hex())
+			folderId = nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	mongoId, err := h.userFileRepository.InsertMetaInfoToMongo(session.Filename, userId, contentType, folderId)
+	if err != nil {
+		return err
+	}
+	setAuditTarget(c, AuditTargetFile, *mongoId)
+
+	// quarantined file is kept for admin, upload is completed anyway
+	reason, err := h.putUserObject(bucketName, *mongoId, userId, content, session.Length, contentType)
+	if err != nil {
+		Logger.Errorf("Error during assembling upload %v: %v", session.Id.Hex(), err)
+		h.rollbackUserFile(*mongoId, userId)
+		return err
+	}
+
+	completed, err := h.uploadSessions.Complete(session.Id.Hex(), userId, *mongoId)
+	if err != nil {
+		return err
+	}
+	if !completed {
+		// concurrent request has assembled the same parts, its file is kept
+		Logger.Infof("Upload %v has already been completed, removing duplicate file %v", session.Id.Hex(), *mongoId)
+		h.discardDuplicateUpload(bucketName, *mongoId, userId, session.Length)
+		actual, err := h.uploadSessions.GetUserSession(session.Id.Hex(), userId)
+		if err != nil {
+			return err
+		}
+		*session = *actual
+		setAuditTarget(c, AuditTargetFile, actual.FileId)
+		return nil
+	}
+	for _, part := range session.Parts {
+		h.removePart(part.Key)
+	}
+	session.FileId = *mongoId
+	session.Parts = nil
+	Logger.Infof("Upload %v completed as file %v", session.Id.Hex(), *mongoId)
+	if len(reason) == 0 {
+		h.emitFileWebhook(WebhookFileUploaded, *mongoId)
+	}
+	return nil
+}
+
+// discardDuplicateUpload removes file assembled by completion which has lost race, space reserved by session belongs to file of winner
+func (h *FsHandler) discardDuplicateUpload(bucketName, fileId string, userId int, length int64) {
+	if dto, err := h.userFileRepository.GetUserFile(fileId, userId); err == nil && dto.Size < length {
+		// putUserObject has released space saved by sanitizing, the winner has released it too, so it is taken back once
+		doubleReleased := length - dto.Size
+		if err := h.usageRepository.Add(userId, doubleReleased); err != nil {
+			Logger.Errorf("Error during reserving %v bytes of user %v back: %v", doubleReleased, userId, err)
+		}
+	}
+	if err := h.storage.RemoveObject(bucketName, fileId); err != nil {
+		Logger.Errorf("Error during removing duplicate object %v: %v", fileId, err)
+	}
+	h.rollbackUserFile(fileId, userId)
+}
+
+func (h *FsHandler) TusDeleteHandler(c echo.Context) error {
+	session, err := h.getActiveSession(c)
+	if session == nil {
+		return err
+	}
+	h.terminateSession(session)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *FsHandler) terminateSession(session *repository.UploadSessionDto) {
+	for _, part := range session.Parts {
+		h.removePart(part.Key)
+	}
+	deleted, err := h.uploadSessions.Delete(session.Id)
+	if err != nil {
+		Logger.Errorf("Error during removing upload session %v: %v", session.Id.Hex(), err)
+		return
+	}
+	// another replica may have already terminated it
+	if deleted && !session.IsCompleted() {
+		h.releaseUserSpace(int(session.UserId), session.Length)
+	}
+}
+
+// CleanExpiredUploads removes expired sessions together with their parts, completed files are kept
+func (h *FsHandler) CleanExpiredUploads() (int, error) {
+	sessions, err := h.uploadSessions.FindExpired(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	for i := range sessions {
+		h.terminateSession(&sessions[i])
+	}
+	return len(sessions), nil
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"github.com/spf13/viper"
+)
+
+// count of first bytes which http.DetectContentType considers
+const sniffLen = 512
+
+// UploadListDto matches types exactly ("image/png") or by family ("image/*"), extensions are case insensitive
+type UploadListDto struct {
+	Types      []string `json:"types" mapstructure:"types"`
+	Extensions []string `json:"extensions" mapstructure:"extensions"`
+}
+
+// UploadRulesDto restricts what can be uploaded, defined in config under uploads and under limits.plans.<name>.uploads
+type UploadRulesDto struct {
+	// max size of single file, 0 means no limit besides quota and server.body.limit
+	MaxSize int64 `json:"maxSize" mapstructure:"max"`
+	// empty allow list allows everything which isn't denied
+	Allow UploadListDto `json:"allow" mapstructure:"allow"`
+	Deny  UploadListDto `json:"deny" mapstructure:"deny"`
+}
+
+// uploadRejection carries response to client when file breaks upload rules
+type uploadRejection struct {
+	status int
+	body   utils.H
+}
+
+func (e *uploadRejection) Error() string {
+	return fmt.Sprintf("upload rejected with %v: %v", e.status, e.body["status"])
+}
+
+func respondUploadRejection(c echo.Context, err error) error {
+	if rejection, ok := err.(*uploadRejection); ok {
+		return c.JSON(rejection.status, &rejection.body)
+	}
+	return err
+}
+
+func getGlobalUploadRules() UploadRulesDto {
+	var rules UploadRulesDto
+	if err := viper.UnmarshalKey("uploads", &rules); err != nil {
+		Logger.Errorf("Error during reading upload rules: %v", err)
+	}
+	return rules
+}
+
+// getUploadRules merges global rules with rules of user's plan: plan's max and allow lists replace global ones, deny lists are joined
+func (h *FsHandler) getUploadRules(userId int) (*UploadRulesDto, error) {
+	rules := getGlobalUploadRules()
+	limits, err := h.getUserLimits(userId)
+	if err != nil {
+		return nil, err
+	}
+	plan, ok := getPlans()[limits.Plan]
+	if !ok {
+		return &rules, nil
+	}
+	if plan.Uploads.MaxSize != 0 {
+		rules.MaxSize = plan.Uploads.MaxSize
+	}
+	if len(plan.Uploads.Allow.Types) != 0 {
+		rules.Allow.Types = plan.Uploads.Allow.Types
+	}
+	if len(plan.Uploads.Allow.Extensions) != 0 {
+		rules.Allow.Extensions = plan.Uploads.Allow.Extensions
+	}
+	rules.Deny.Types = append(append([]string{}, rules.Deny.Types...), plan.Uploads.Deny.Types...)
+	rules.Deny.Extensions = append(append([]string{}, rules.Deny.Extensions...), plan.Uploads.Deny.Extensions...)
+	return &rules, nil
+}
+
+func (r *UploadRulesDto) checkSize(size int64) error {
+	if r.MaxSize != 0 && size > r.MaxSize {
+		return &uploadRejection{http.StatusRequestEntityTooLarge, utils.H{"status": "file is too large", "maxSize": r.MaxSize}}
+	}
+	return nil
+}
+
+// checkFile checks both extension and content type, so renamed executable is rejected as well as image with wrong extension
+func (r *UploadRulesDto) checkFile(filename, contentType string) error {
+	mediaType := getMediaType(contentType)
+	extension := strings.ToLower(filepath.Ext(filename))
+
+	if matchesType(r.Deny.Types, mediaType) || (len(r.Allow.Types) != 0 && !matchesType(r.Allow.Types, mediaType)) {
+		return &uploadRejection{http.StatusUnsupportedMediaType, utils.H{"status": "content type is not allowed", "contentType": mediaType}}
+	}
+	if matchesExtension(r.Deny.Extensions, extension) || (len(r.Allow.Extensions) != 0 && !matchesExtension(r.Allow.Extensions, extension)) {
+		return &uploadRejection{http.StatusUnsupportedMediaType, utils.H{"status": "extension is not allowed", "extension": extension}}
+	}
+	return nil
+}
+
+func getMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediaType
+}
+
+func matchesType(list []string, mediaType string) bool {
+	for _, entry := range list {
+		entry = strings.ToLower(entry)
+		if entry == mediaType {
+			return true
+		}
+		if strings.HasSuffix(entry, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(entry, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesExtension(list []string, extension string) bool {
+	for _, entry := range list {
+		entry = strings.ToLower(entry)
+		if !strings.HasPrefix(entry, ".") {
+			entry = "." + entry
+		}
+		if entry == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffContentType determines type by first bytes instead of trusting client, returned reader yields whole content
+func sniffContentType(src io.Reader) (string, io.Reader, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	return http.DetectContentType(head), io.MultiReader(bytes.NewReader(head), src), nil
+}
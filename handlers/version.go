@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type FileVersionInfoDto struct {
+	Id          string    `json:"id"`
+	Url         string    `json:"url"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	Sha256      string    `json:"sha256"`
+	Created     time.Time `json:"created"`
+	Replaced    time.Time `json:"replaced"`
+}
+
+func getVersionId(c echo.Context) string {
+	return c.Param("version")
+}
+
+// getCurrentUserFile returns file which can be modified, i. e. not trashed one
+func (h *FsHandler) getCurrentUserFile(c echo.Context, userId int) (*repository.UserFileDto, error) {
+	dto, err := h.userFileRepository.GetUserFile(getFileId(c), userId)
+	if err != nil {
+		return nil, err
+	}
+	if dto.Trashed || dto.State != repository.UploadStateReady {
+		return nil, mongo.ErrNoDocuments
+	}
+	return dto, nil
+}
+
+// getVersionedUserFile returns file whose versions can be used. Content of quarantined file is hidden, but earlier versions are still clean.
+func (h *FsHandler) getVersionedUserFile(c echo.Context, userId int) (*repository.UserFileDto, error) {
+	dto, err := h.userFileRepository.GetUserFile(getFileId(c), userId)
+	if err != nil {
+		return nil, err
+	}
+	if dto.Trashed || (dto.State != repository.UploadStateReady && !isQuarantined(dto)) {
+		return nil, mongo.ErrNoDocuments
+	}
+	return dto, nil
+}
+
+// reserveVersionSpace takes space for current content which becomes a version, versions are always counted
+func (h *FsHandler) reserveVersionSpace(userId int, size int64) (bool, error) {
+	limits, err := h.getUserLimits(userId)
+	if err != nil {
+		Logger.Errorf("Error during calculating max allowed %v", err)
+		return false, err
+	}
+	return h.reserveUserBytes(userId, limits, size)
+}
+
+// saveCurrentAsVersion copies current content of file aside and remembers it as version
+func (h *FsHandler) saveCurrentAsVersion(bucketName string, dto *repository.UserFileDto) (*repository.FileVersionDto, error) {
+	version := repository.NewVersionOf(dto)
+	if err := h.storage.CopyObject(bucketName, dto.Id.Hex(), version.Id.Hex()); err != nil {
+		Logger.Errorf("Error during copying object %v to version: %v", dto.Id.Hex(), err)
+		return nil, err
+	}
+	if err := h.fileVersionRepository.Insert(version); err != nil {
+		Logger.Errorf("Error during inserting version of %v: %v", dto.Id.Hex(), err)
+		h.removeVersionObject(bucketName, version.Id.Hex())
+		return nil, err
+	}
+	return &version, nil
+}
+
+// rollbackVersion is used when new content wasn't stored after current one has been saved as version
+func (h *FsHandler) rollbackVersion(bucketName string, version *repository.FileVersionDto) {
+	if _, err := h.fileVersionRepository.Delete(version.Id); err != nil {
+		Logger.Errorf("Error during rollback of version %v: %v", version.Id.Hex(), err)
+	}
+	h.removeVersionObject(bucketName, version.Id.Hex())
+}
+
+func (h *FsHandler) removeVersionObject(bucketName, versionId string) {
+	if err := h.storage.RemoveObject(bucketName, versionId); err != nil {
+		Logger.Errorf("Error during remove version object %v: %v", versionId, err)
+	}
+}
+
+// ReplaceHandler overwrites content of file in place, so id and public url are kept. Previous content is kept as version.
+func (h *FsHandler) ReplaceHandler(c echo.Context) error {
+	file, err := c.FormFile(FormFile)
+	if err != nil {
+		Logger.Errorf("Error during extracting form %v parameter: %v", FormFile, err)
+		return err
+	}
+
+	requesterId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	dto, err := h.getWritableFile(c, requesterId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	// file may be replaced by grantee, space is taken from owner's quota anyway
+	userId := int(dto.UserId)
+	bucketName := getBucketNameInt(userId)
+
+	rules, err := h.getUploadRules(userId)
+	if err != nil {
+		return err
+	}
+	if err := rules.checkSize(file.Size); err != nil {
+		return respondUploadRejection(c, err)
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// file keeps its name, so new content should match its extension
+	contentType, content, err := sniffContentType(src)
+	if err != nil {
+		return err
+	}
+	if err := rules.checkFile(dto.Filename, contentType); err != nil {
+		return respondUploadRejection(c, err)
+	}
+
+	// new content replaces current one which stays as version, so both of them are counted
+	reserved, err := h.reserveVersionSpace(userId, file.Size)
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		return c.JSON(http.StatusRequestEntityTooLarge, &utils.H{"status": "fail"})
+	}
+
+	version, err := h.saveCurrentAsVersion(bucketName, dto)
+	if err != nil {
+		h.releaseUserSpace(userId, file.Size)
+		return err
+	}
+
+	reason, err := h.putUserObject(bucketName, dto.Id.Hex(), userId, content, file.Size, contentType)
+	if err != nil {
+		Logger.Errorf("Error during replace object: %v", err)
+		h.rollbackVersion(bucketName, version)
+		h.releaseUserSpace(userId, file.Size)
+		return respondBrokenImageOrError(c, err)
+	}
+
+	h.removeDerivatives(dto)
+	if len(reason) != 0 {
+		// previous content is still available as version
+		return respondQuarantined(c, dto.Id.Hex(), reason)
+	}
+	go h.generateThumbnail(dto.Id.Hex(), userId)
+	if dto.Published {
+		h.sanitizePublished(dto.Id.Hex())
+	}
+
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "id": dto.Id.Hex(), "version": version.Id.Hex()})
+}
+
+func (h *FsHandler) VersionsHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	dto, err := h.getVersionedUserFile(c, userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+
+	versions, err := h.fileVersionRepository.FindVersions(dto.Id)
+	if err != nil {
+		return err
+	}
+
+	downloadUrl, err := h.getPrivateUrl(dto.Id.Hex())
+	if err != nil {
+		return err
+	}
+
+	var list = make([]FileVersionInfoDto, 0, len(versions))
+	for _, version := range versions {
+		list = append(list, FileVersionInfoDto{
+			Id:          version.Id.Hex(),
+			Url:         *downloadUrl + "/" + version.Id.Hex(),
+			Size:        version.Size,
+			ContentType: version.ContentType,
+			Sha256:      version.Sha256,
+			Created:     version.Created,
+			Replaced:    version.Replaced,
+		})
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "versions": list})
+}
+
+func (h *FsHandler) DownloadVersionHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	dto, err := h.getVersionedUserFile(c, userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	version, err := h.fileVersionRepository.GetUserVersion(getFileId(c), getVersionId(c), userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+
+	return h.recordDownload(repository.DownloadKindPrivate, dto, h.download(getBucketNameInt(userId), version.Id.Hex(), dto))(c)
+}
+
+// RestoreVersionHandler makes version current content of file. Replaced content becomes version, so restore can be undone.
+func (h *FsHandler) RestoreVersionHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+	bucketName := h.ensureAndGetBucket(c)
+
+	dto, err := h.getVersionedUserFile(c, userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	restored, err := h.fileVersionRepository.GetUserVersion(getFileId(c), getVersionId(c), userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+
+	if isQuarantined(dto) {
+		return h.restoreQuarantined(c, bucketName, userId, dto, restored)
+	}
+
+	// restored version's space passes to file and current content becomes version, so total size isn't changed
+	version, err := h.saveCurrentAsVersion(bucketName, dto)
+	if err != nil {
+		return err
+	}
+
+	if err := h.storage.CopyObject(bucketName, restored.Id.Hex(), dto.Id.Hex()); err != nil {
+		Logger.Errorf("Error during restore version %v: %v", restored.Id.Hex(), err)
+		h.rollbackVersion(bucketName, version)
+		return err
+	}
+	if err := h.userFileRepository.MarkUploaded(dto.Id.Hex(), userId, restored.Size, restored.Sha256, restored.ContentType, restored.Sanitized); err != nil {
+		Logger.Errorf("Error during marking restored version %v: %v", restored.Id.Hex(), err)
+		// object should match metadata again, version is kept if it cannot be copied back
+		if copyErr := h.storage.CopyObject(bucketName, version.Id.Hex(), dto.Id.Hex()); copyErr != nil {
+			Logger.Errorf("Error during rollback of restore of %v: %v", dto.Id.Hex(), copyErr)
+		} else {
+			h.rollbackVersion(bucketName, version)
+		}
+		return err
+	}
+
+	h.removeDerivatives(dto)
+	if dto.Published {
+		h.sanitizePublished(dto.Id.Hex())
+	}
+
+	if deleted, err := h.fileVersionRepository.Delete(restored.Id); err != nil {
+		return err
+	} else if deleted {
+		h.removeVersionObject(bucketName, restored.Id.Hex())
+	}
+
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "version": version.Id.Hex()})
+}
+
+// restoreQuarantined overwrites quarantined content with version and makes file visible again. Infected content isn't kept as version.
+func (h *FsHandler) restoreQuarantined(c echo.Context, bucketName string, userId int, dto *repository.UserFileDto, restored *repository.FileVersionDto) error {
+	if err := h.storage.CopyObject(bucketName, restored.Id.Hex(), dto.Id.Hex()); err != nil {
+		Logger.Errorf("Error during restore version %v: %v", restored.Id.Hex(), err)
+		return err
+	}
+	// file stays quarantined on failure, version is still there, so restore can be repeated
+	if err := h.userFileRepository.MarkUploaded(dto.Id.Hex(), userId, restored.Size, restored.Sha256, restored.ContentType, restored.Sanitized); err != nil {
+		Logger.Errorf("Error during marking restored version %v: %v", restored.Id.Hex(), err)
+		return err
+	}
+	// restored version's space passes to file, space of quarantined content is freed
+	h.releaseUserSpace(userId, dto.Size)
+
+	h.removeDerivatives(dto)
+	if dto.Published {
+		h.sanitizePublished(dto.Id.Hex())
+	}
+
+	if deleted, err := h.fileVersionRepository.Delete(restored.Id); err != nil {
+		return err
+	} else if deleted {
+		h.removeVersionObject(bucketName, restored.Id.Hex())
+	}
+
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
+
+func (h *FsHandler) DeleteVersionHandler(c echo.Context) error {
+	userId, err := getUserIdFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	version, err := h.fileVersionRepository.GetUserVersion(getFileId(c), getVersionId(c), userId)
+	if err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+
+	if err := h.deleteVersion(version); err != nil {
+		return err
+	}
+	setAuditChange(c, utils.H{"version": version.Id.Hex(), "size": version.Size, "sha256": version.Sha256}, nil)
+
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok"})
+}
+
+// deleteVersion releases space only once even if version is deleted concurrently
+func (h *FsHandler) deleteVersion(version *repository.FileVersionDto) error {
+	deleted, err := h.fileVersionRepository.Delete(version.Id)
+	if err != nil {
+		Logger.Errorf("Error during remove version %v from mongo: %v", version.Id.Hex(), err)
+		return err
+	}
+	if !deleted {
+		return nil
+	}
+	userId := int(version.UserId)
+	if err := h.storage.RemoveObject(getBucketNameInt(userId), version.Id.Hex()); err != nil {
+		Logger.Errorf("Error during remove version object %v: %v", version.Id.Hex(), err)
+	}
+	h.releaseUserSpace(userId, version.Size)
+	return nil
+}
+
+// purgeVersions removes all versions of file
+func (h *FsHandler) purgeVersions(fileId primitive.ObjectID) error {
+	versions, err := h.fileVersionRepository.FindVersions(fileId)
+	if err != nil {
+		return err
+	}
+	for i := range versions {
+		if err := h.deleteVersion(&versions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
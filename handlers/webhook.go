@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nkonev/blog-storage/data/repository"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/utils"
+	uuid "github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const WebhookFileUploaded = "file.uploaded"
+const WebhookFileRenamed = "file.renamed"
+const WebhookFilePublished = "file.published"
+const WebhookFileUnpublished = "file.unpublished"
+const WebhookFileDeleted = "file.deleted"
+const WebhookFileRestored = "file.restored"
+const WebhookQuotaExceeded = "quota.exceeded"
+
+const HeaderWebhookEvent = "X-Webhook-Event"
+const HeaderWebhookId = "X-Webhook-Id"
+const HeaderWebhookDelivery = "X-Webhook-Delivery"
+const HeaderWebhookTimestamp = "X-Webhook-Timestamp"
+const HeaderWebhookSignature = "X-Webhook-Signature"
+
+// max deliveries sent by one run of sender, the rest wait for next tick
+const webhookBatch = 100
+
+const defaultWebhookDeliveriesLimit = 100
+const maxWebhookDeliveriesLimit = 1000
+
+// WebhookSubscriptionDto is defined in config under webhooks.subscriptions
+type WebhookSubscriptionDto struct {
+	Url    string `mapstructure:"url"`
+	Secret string `mapstructure:"secret"`
+	// empty means all events
+	Events []string `mapstructure:"events"`
+}
+
+func (s WebhookSubscriptionDto) accepts(event string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEventDto is body of request, it's identical for all subscriptions and attempts
+type WebhookEventDto struct {
+	Id     string           `json:"id"`
+	Event  string           `json:"event"`
+	Time   time.Time        `json:"time"`
+	UserId int              `json:"userId"`
+	File   *WebhookFileDto  `json:"file,omitempty"`
+	Quota  *WebhookQuotaDto `json:"quota,omitempty"`
+}
+
+type WebhookFileDto struct {
+	Id               string `json:"id"`
+	Filename         string `json:"filename"`
+	PreviousFilename string `json:"previousFilename,omitempty"`
+	Published        bool   `json:"published"`
+	PublicUrl        string `json:"publicUrl,omitempty"`
+	Size             int64  `json:"size"`
+	ContentType      string `json:"contentType"`
+}
+
+type WebhookQuotaDto struct {
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int64 `json:"maxFiles"`
+	// size of rejected content
+	Requested int64 `json:"requested"`
+}
+
+type WebhookDeliveryInfoDto struct {
+	Id          string     `json:"id"`
+	Url         string     `json:"url"`
+	Event       string     `json:"event"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+	LastStatus  int        `json:"lastStatus,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	Created     time.Time  `json:"created"`
+	Delivered   *time.Time `json:"delivered,omitempty"`
+}
+
+func getWebhookSubscriptions() []WebhookSubscriptionDto {
+	var subscriptions = make([]WebhookSubscriptionDto, 0)
+	if err := viper.UnmarshalKey("webhooks.subscriptions", &subscriptions); err != nil {
+		Logger.Errorf("Error during reading webhook subscriptions: %v", err)
+	}
+	return subscriptions
+}
+
+func getWebhookSubscription(url string) (WebhookSubscriptionDto, bool) {
+	for _, s := range getWebhookSubscriptions() {
+		if s.Url == url {
+			return s, true
+		}
+	}
+	return WebhookSubscriptionDto{}, false
+}
+
+func getWebhookRetention() time.Duration {
+	viper.SetDefault("webhooks.retention", "168h")
+	return viper.GetDuration("webhooks.retention")
+}
+
+// getWebhookBackoff doubles delay after each failed attempt, attempts is count of failed ones including current
+func getWebhookBackoff(attempts int) time.Duration {
+	viper.SetDefault("webhooks.backoff.initial", "30s")
+	viper.SetDefault("webhooks.backoff.max", "6h")
+	initial := viper.GetDuration("webhooks.backoff.initial")
+	max := viper.GetDuration("webhooks.backoff.max")
+	delay := initial
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// signWebhook is hex HMAC-SHA256 of "<timestamp>.<body>", timestamp lets subscriber reject old requests
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// emitWebhook stores event in outbox for each interested subscription, it's sent by DeliverWebhooks.
+// Failure to store is logged only, operation itself has already succeeded.
+func (h *FsHandler) emitWebhook(event string, userId int, file *WebhookFileDto, quota *WebhookQuotaDto) {
+	var subscriptions []WebhookSubscriptionDto
+	for _, s := range getWebhookSubscriptions() {
+		if s.accepts(event) {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	if len(subscriptions) == 0 {
+		return
+	}
+	now := time.Now()
+	payload, err := json.Marshal(WebhookEventDto{
+		Id:     uuid.NewV4().String(),
+		Event:  event,
+		Time:   now,
+		UserId: userId,
+		File:   file,
+		Quota:  quota,
+	})
+	if err != nil {
+		Logger.Errorf("Error during marshalling webhook event %v: %v", event, err)
+		return
+	}
+	for _, s := range subscriptions {
+		err := h.webhookDeliveryRepository.Insert(repository.WebhookDeliveryDto{
+			Url:         s.Url,
+			Event:       event,
+			Payload:     string(payload),
+			Status:      repository.WebhookStatusPending,
+			NextAttempt: now,
+			Created:     now,
+		})
+		if err != nil {
+			Logger.Errorf("Error during storing webhook event %v for %v: %v", event, s.Url, err)
+		}
+	}
+}
+
+func (h *FsHandler) getWebhookFile(dto *repository.UserFileDto) *WebhookFileDto {
+	file := &WebhookFileDto{
+		Id:          dto.Id.Hex(),
+		Filename:    dto.Filename,
+		Published:   dto.Published,
+		Size:        dto.Size,
+		ContentType: dto.ContentType,
+	}
+	if dto.Published {
+		file.PublicUrl = h.getPublicUrl(getBucketNameInt(dto.UserId), dto.Id.Hex())
+	}
+	return file
+}
+
+// emitFileWebhook reads actual state of file, so it should be called after change is stored
+func (h *FsHandler) emitFileWebhook(event, fileId string) {
+	dto, err := h.userFileRepository.GetMetainfoFromMongo(fileId)
+	if err != nil {
+		Logger.Errorf("Error during reading file %v for webhook event %v: %v", fileId, event, err)
+		return
+	}
+	h.emitWebhook(event, int(dto.UserId), h.getWebhookFile(dto), nil)
+}
+
+// DeliverWebhooks sends due deliveries from outbox, returns count of successful and given up ones
+func (h *FsHandler) DeliverWebhooks() (int, int, error) {
+	viper.SetDefault("webhooks.timeout", "10s")
+	timeout := viper.GetDuration("webhooks.timeout")
+	var delivered, failed int
+	for i := 0; i < webhookBatch; i++ {
+		// lease is longer than request, so it isn't taken by another replica while being sent
+		dto, err := h.webhookDeliveryRepository.ClaimDue(time.Now(), 2*timeout)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return delivered, failed, err
+		}
+		ok, final, err := h.deliverWebhook(dto, timeout)
+		if err != nil {
+			return delivered, failed, err
+		}
+		if ok {
+			delivered++
+		} else if final {
+			failed++
+		}
+	}
+	return delivered, failed, nil
+}
+
+// deliverWebhook makes one attempt, final is true when delivery was given up
+func (h *FsHandler) deliverWebhook(dto *repository.WebhookDeliveryDto, timeout time.Duration) (bool, bool, error) {
+	expires := time.Now().Add(getWebhookRetention())
+	subscription, exists := getWebhookSubscription(dto.Url)
+	if !exists {
+		Logger.Warnf("Webhook delivery %v is given up because subscription %v was removed", dto.Id.Hex(), dto.Url)
+		return false, true, h.webhookDeliveryRepository.MarkAttemptFailed(dto.Id, 0, "subscription removed", nil, expires)
+	}
+
+	httpStatus, err := h.postWebhook(dto, subscription, timeout)
+	if err == nil {
+		Logger.Infof("Webhook %v delivered to %v", dto.Event, dto.Url)
+		return true, false, h.webhookDeliveryRepository.MarkDelivered(dto.Id, httpStatus, expires)
+	}
+
+	viper.SetDefault("webhooks.maxAttempts", 10)
+	attempts := dto.Attempts + 1
+	if attempts >= viper.GetInt("webhooks.maxAttempts") {
+		Logger.Warnf("Webhook delivery %v to %v is given up after %v attempts: %v", dto.Id.Hex(), dto.Url, attempts, err)
+		return false, true, h.webhookDeliveryRepository.MarkAttemptFailed(dto.Id, httpStatus, err.Error(), nil, expires)
+	}
+	next := time.Now().Add(getWebhookBackoff(attempts))
+	Logger.Infof("Webhook delivery %v to %v failed, next attempt at %v: %v", dto.Id.Hex(), dto.Url, next, err)
+	return false, false, h.webhookDeliveryRepository.MarkAttemptFailed(dto.Id, httpStatus, err.Error(), &next, expires)
+}
+
+// postWebhook returns status of response, any other than 2xx is error
+func (h *FsHandler) postWebhook(dto *repository.WebhookDeliveryDto, subscription WebhookSubscriptionDto, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	body := []byte(dto.Payload)
+	req, err := http.NewRequest(http.MethodPost, dto.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	req.Header.Set(HeaderWebhookEvent, dto.Event)
+	req.Header.Set(HeaderWebhookDelivery, dto.Id.Hex())
+	req.Header.Set(HeaderWebhookTimestamp, timestamp)
+	if len(subscription.Secret) != 0 {
+		req.Header.Set(HeaderWebhookSignature, signWebhook(subscription.Secret, timestamp, body))
+	}
+	var event WebhookEventDto
+	if json.Unmarshal(body, &event) == nil {
+		req.Header.Set(HeaderWebhookId, event.Id)
+	}
+
+	resp, err := h.restClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// drain body so connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// AdminWebhookDeliveriesHandler lists newest deliveries first, optionally filtered by status and event
+func (h *FsHandler) AdminWebhookDeliveriesHandler(c echo.Context) error {
+	if !getUserAdminFromContext(c) {
+		return c.JSON(http.StatusUnauthorized, &utils.H{"status": "not admin"})
+	}
+	status := c.QueryParam("status")
+	switch status {
+	case "", repository.WebhookStatusPending, repository.WebhookStatusDelivered, repository.WebhookStatusFailed:
+	default:
+		return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong status"})
+	}
+	var limit int64 = defaultWebhookDeliveriesLimit
+	if limitStr := c.QueryParam("limit"); len(limitStr) != 0 {
+		l, err := strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || l <= 0 || l > maxWebhookDeliveriesLimit {
+			return c.JSON(http.StatusBadRequest, &utils.H{"status": "wrong limit"})
+		}
+		limit = l
+	}
+
+	deliveries, err := h.webhookDeliveryRepository.Find(status, c.QueryParam("event"), limit)
+	if err != nil {
+		return err
+	}
+	var list = make([]WebhookDeliveryInfoDto, 0, len(deliveries))
+	for _, d := range deliveries {
+		info := WebhookDeliveryInfoDto{
+			Id:         d.Id.Hex(),
+			Url:        d.Url,
+			Event:      d.Event,
+			Status:     d.Status,
+			Attempts:   d.Attempts,
+			LastStatus: d.LastStatus,
+			LastError:  d.LastError,
+			Created:    d.Created,
+			Delivered:  d.Delivered,
+		}
+		if d.Status == repository.WebhookStatusPending {
+			nextAttempt := d.NextAttempt
+			info.NextAttempt = &nextAttempt
+		}
+		list = append(list, info)
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "deliveries": list})
+}
+
+// AdminReplayWebhookHandler puts failed delivery back to outbox, "failed" instead of id replays all of them
+func (h *FsHandler) AdminReplayWebhookHandler(c echo.Context) error {
+	if !getUserAdminFromContext(c) {
+		return c.JSON(http.StatusUnauthorized, &utils.H{"status": "not admin"})
+	}
+	deliveryId := c.Param("id")
+	setAuditTarget(c, AuditTargetWebhook, deliveryId)
+	if deliveryId == repository.WebhookStatusFailed {
+		replayed, err := h.webhookDeliveryRepository.ReplayFailed()
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, &utils.H{"status": "ok", "replayed": replayed})
+	}
+	if err := h.webhookDeliveryRepository.Replay(deliveryId); err != nil {
+		return respondNotFoundOrError(c, err)
+	}
+	return c.JSON(http.StatusOK, &utils.H{"status": "ok", "replayed": 1})
+}
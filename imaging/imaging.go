@@ -0,0 +1,171 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+const FitContain = "contain"
+const FitCover = "cover"
+const FitFill = "fill"
+
+const FormatJpeg = "jpeg"
+const FormatPng = "png"
+const FormatGif = "gif"
+
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+var ErrTooLarge = errors.New("image is too large")
+
+var contentTypes = map[string]string{
+	FormatJpeg: "image/jpeg",
+	FormatPng:  "image/png",
+	FormatGif:  "image/gif",
+}
+
+// Options of derivative image. Zero Width or Height is calculated from aspect ratio, empty Format keeps format of source.
+type Options struct {
+	Width  int
+	Height int
+	Fit    string
+	Format string
+}
+
+func (o Options) String() string {
+	return fmt.Sprintf("%vx%v_%v_%v", o.Width, o.Height, o.Fit, o.Format)
+}
+
+func IsSupportedContentType(contentType string) bool {
+	for _, supported := range contentTypes {
+		if supported == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+func IsValidFit(fit string) bool {
+	return fit == FitContain || fit == FitCover || fit == FitFill
+}
+
+func IsValidFormat(format string) bool {
+	_, ok := contentTypes[format]
+	return ok
+}
+
+// Resize decodes image, checking dimensions before decoding so huge image cannot exhaust memory, and encodes derivative
+func Resize(src io.ReadSeeker, opts Options, maxSourcePixels int) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if _, ok := contentTypes[format]; !ok {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if config.Width*config.Height > maxSourcePixels {
+		return nil, "", ErrTooLarge
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resized := resize(img, opts)
+
+	outFormat := opts.Format
+	if len(outFormat) == 0 {
+		outFormat = format
+	}
+	var buf bytes.Buffer
+	switch outFormat {
+	case FormatJpeg:
+		err = jpeg.Encode(&buf, flatten(resized), &jpeg.Options{Quality: 85})
+	case FormatPng:
+		err = png.Encode(&buf, resized)
+	case FormatGif:
+		err = gif.Encode(&buf, resized, nil)
+	default:
+		err = ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), contentTypes[outFormat], nil
+}
+
+// targetSize returns size of scaled image and size of box it should be cropped to
+func targetSize(srcW, srcH int, opts Options) (int, int, int, int) {
+	w, h := opts.Width, opts.Height
+	if w == 0 && h == 0 {
+		return srcW, srcH, srcW, srcH
+	}
+	if w == 0 {
+		w = max(1, srcW*h/srcH)
+	}
+	if h == 0 {
+		h = max(1, srcH*w/srcW)
+	}
+	switch opts.Fit {
+	case FitFill:
+		return w, h, w, h
+	case FitCover:
+		// scale by bigger ratio and crop the rest
+		if srcW*h > srcH*w {
+			return max(1, srcW*h/srcH), h, w, h
+		}
+		return w, max(1, srcH*w/srcW), w, h
+	default:
+		// scale by smaller ratio, never upscale
+		if w >= srcW && h >= srcH {
+			return srcW, srcH, srcW, srcH
+		}
+		if srcW*h > srcH*w {
+			sh := max(1, srcH*w/srcW)
+			return w, sh, w, sh
+		}
+		sw := max(1, srcW*h/srcH)
+		return sw, h, sw, h
+	}
+}
+
+func resize(img image.Image, opts Options) image.Image {
+	bounds := img.Bounds()
+	scaledW, scaledH, boxW, boxH := targetSize(bounds.Dx(), bounds.Dy(), opts)
+	if scaledW == bounds.Dx() && scaledH == bounds.Dy() && boxW == scaledW && boxH == scaledH {
+		return img
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, scaledW, scaledH))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	if boxW == scaledW && boxH == scaledH {
+		return scaled
+	}
+	offsetX, offsetY := (scaledW-boxW)/2, (scaledH-boxH)/2
+	return scaled.SubImage(image.Rect(offsetX, offsetY, offsetX+boxW, offsetY+boxH))
+}
+
+// flatten puts image onto white background because jpeg has no transparency
+func flatten(img image.Image) image.Image {
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+	return flat
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,62 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makePng(t *testing.T, w, h int) *bytes.Reader {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, png.Encode(&buf, img))
+	return bytes.NewReader(buf.Bytes())
+}
+
+func decodeSize(t *testing.T, data []byte) (int, int, string) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	assert.Nil(t, err)
+	return config.Width, config.Height, format
+}
+
+func TestResize(t *testing.T) {
+	cases := []struct {
+		opts          Options
+		width, height int
+		format        string
+	}{
+		{Options{Width: 100, Fit: FitContain}, 100, 50, "png"},
+		{Options{Width: 100, Height: 100, Fit: FitContain}, 100, 50, "png"},
+		{Options{Width: 100, Height: 100, Fit: FitCover}, 100, 100, "png"},
+		{Options{Width: 100, Height: 100, Fit: FitFill}, 100, 100, "png"},
+		{Options{Height: 25, Fit: FitContain, Format: FormatJpeg}, 50, 25, "jpeg"},
+		// contain never upscales
+		{Options{Width: 1000, Fit: FitContain}, 200, 100, "png"},
+	}
+	for _, c := range cases {
+		data, contentType, err := Resize(makePng(t, 200, 100), c.opts, 1000000)
+		assert.Nil(t, err, c.opts.String())
+		width, height, format := decodeSize(t, data)
+		assert.Equal(t, c.width, width, c.opts.String())
+		assert.Equal(t, c.height, height, c.opts.String())
+		assert.Equal(t, c.format, format, c.opts.String())
+		assert.Equal(t, "image/"+c.format, contentType)
+	}
+}
+
+func TestResizeRejectsHugeAndUnknownImages(t *testing.T) {
+	_, _, err := Resize(makePng(t, 200, 100), Options{Width: 10, Fit: FitContain}, 100)
+	assert.Equal(t, ErrTooLarge, err)
+
+	_, _, err = Resize(bytes.NewReader([]byte("not an image")), Options{Width: 10, Fit: FitContain}, 100)
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
@@ -0,0 +1,163 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+const jpegContentType = "image/jpeg"
+const pngContentType = "image/png"
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+const (
+	jpegMarkerSOI  = 0xd8
+	jpegMarkerEOI  = 0xd9
+	jpegMarkerSOS  = 0xda
+	jpegMarkerAPP1 = 0xe1 // EXIF and XMP, including GPS and camera
+	jpegMarkerIPTC = 0xed // APP13, Photoshop and IPTC
+	jpegMarkerCOM  = 0xfe
+)
+
+// chunks with textual metadata, XMP lives in iTXt
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+}
+
+// CanStripMetadata reports whether StripMetadata supports content type
+func CanStripMetadata(contentType string) bool {
+	return contentType == jpegContentType || contentType == pngContentType
+}
+
+// StripMetadata copies image from src to dst without EXIF, XMP, IPTC and comments. Pixel data isn't re-encoded,
+// so quality is kept but EXIF orientation is lost as well. Returns whether anything has been removed.
+func StripMetadata(dst io.Writer, src io.Reader, contentType string) (bool, error) {
+	switch contentType {
+	case jpegContentType:
+		return stripJpeg(dst, bufio.NewReader(src))
+	case pngContentType:
+		return stripPng(dst, bufio.NewReader(src))
+	default:
+		return false, ErrUnsupportedFormat
+	}
+}
+
+func stripJpeg(dst io.Writer, src *bufio.Reader) (bool, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(src, soi[:]); err != nil || soi[0] != 0xff || soi[1] != jpegMarkerSOI {
+		return false, ErrUnsupportedFormat
+	}
+	if _, err := dst.Write(soi[:]); err != nil {
+		return false, err
+	}
+
+	stripped := false
+	for {
+		marker, err := readJpegMarker(src)
+		if err != nil {
+			return false, err
+		}
+		if marker == jpegMarkerEOI || (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+			// standalone markers have no length
+			if _, err := dst.Write([]byte{0xff, marker}); err != nil {
+				return false, err
+			}
+			if marker == jpegMarkerEOI {
+				return stripped, nil
+			}
+			continue
+		}
+
+		var lengthBytes [2]byte
+		if _, err := io.ReadFull(src, lengthBytes[:]); err != nil {
+			return false, ErrUnsupportedFormat
+		}
+		length := int64(binary.BigEndian.Uint16(lengthBytes[:]))
+		if length < 2 {
+			return false, ErrUnsupportedFormat
+		}
+
+		if marker == jpegMarkerAPP1 || marker == jpegMarkerIPTC || marker == jpegMarkerCOM {
+			if _, err := io.CopyN(ioutil.Discard, src, length-2); err != nil {
+				return false, ErrUnsupportedFormat
+			}
+			stripped = true
+			continue
+		}
+
+		if _, err := dst.Write([]byte{0xff, marker, lengthBytes[0], lengthBytes[1]}); err != nil {
+			return false, err
+		}
+		if _, err := io.CopyN(dst, src, length-2); err != nil {
+			return false, err
+		}
+		if marker == jpegMarkerSOS {
+			// entropy-coded data and everything after it contain no metadata
+			if _, err := io.Copy(dst, src); err != nil {
+				return false, err
+			}
+			return stripped, nil
+		}
+	}
+}
+
+// readJpegMarker skips fill bytes before marker
+func readJpegMarker(src *bufio.Reader) (byte, error) {
+	b, err := src.ReadByte()
+	if err != nil || b != 0xff {
+		return 0, ErrUnsupportedFormat
+	}
+	for {
+		b, err = src.ReadByte()
+		if err != nil {
+			return 0, ErrUnsupportedFormat
+		}
+		if b != 0xff {
+			return b, nil
+		}
+	}
+}
+
+func stripPng(dst io.Writer, src *bufio.Reader) (bool, error) {
+	var signature [8]byte
+	if _, err := io.ReadFull(src, signature[:]); err != nil || !bytes.Equal(signature[:], pngSignature) {
+		return false, ErrUnsupportedFormat
+	}
+	if _, err := dst.Write(signature[:]); err != nil {
+		return false, err
+	}
+
+	stripped := false
+	for {
+		// length and type
+		var header [8]byte
+		if _, err := io.ReadFull(src, header[:]); err != nil {
+			return false, ErrUnsupportedFormat
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+		// data and crc
+		if pngMetadataChunks[chunkType] {
+			if _, err := io.CopyN(ioutil.Discard, src, length+4); err != nil {
+				return false, ErrUnsupportedFormat
+			}
+			stripped = true
+			continue
+		}
+		if _, err := dst.Write(header[:]); err != nil {
+			return false, err
+		}
+		if _, err := io.CopyN(dst, src, length+4); err != nil {
+			return false, err
+		}
+		if chunkType == "IEND" {
+			return stripped, nil
+		}
+	}
+}
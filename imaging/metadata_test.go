@@ -0,0 +1,82 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const gpsMarker = "GPSLatitude 55.7558"
+
+func withExifSegment(jpg []byte) []byte {
+	payload := append([]byte("Exif\x00\x00"), []byte(gpsMarker)...)
+	segment := []byte{0xff, jpegMarkerAPP1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+	// right after SOI, where cameras put it
+	return append(append(append([]byte{}, jpg[:2]...), segment...), jpg[2:]...)
+}
+
+func withTextChunk(png []byte) []byte {
+	data := append([]byte("Comment\x00"), []byte(gpsMarker)...)
+	chunk := make([]byte, 8)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+	// after IHDR which is 8 bytes of signature and 25 bytes of chunk
+	return append(append(append([]byte{}, png[:33]...), chunk...), png[33:]...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	original, err := ioutil.ReadAll(makePng(t, 20, 10))
+	assert.Nil(t, err)
+	img, _, err := image.Decode(bytes.NewReader(original))
+	assert.Nil(t, err)
+	var jpg bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&jpg, img, nil))
+
+	cases := []struct {
+		contentType string
+		data        []byte
+	}{
+		{"image/jpeg", withExifSegment(jpg.Bytes())},
+		{"image/png", withTextChunk(original)},
+	}
+	for _, c := range cases {
+		assert.Contains(t, string(c.data), gpsMarker)
+
+		var out bytes.Buffer
+		stripped, err := StripMetadata(&out, bytes.NewReader(c.data), c.contentType)
+		assert.Nil(t, err, c.contentType)
+		assert.True(t, stripped, c.contentType)
+		assert.NotContains(t, out.String(), gpsMarker, c.contentType)
+		w, h, _ := decodeSize(t, out.Bytes())
+		assert.Equal(t, 20, w)
+		assert.Equal(t, 10, h)
+
+		// clean image is copied as is
+		var again bytes.Buffer
+		stripped, err = StripMetadata(&again, bytes.NewReader(out.Bytes()), c.contentType)
+		assert.Nil(t, err)
+		assert.False(t, stripped)
+		assert.Equal(t, out.Bytes(), again.Bytes())
+	}
+}
+
+func TestStripMetadataRejectsUnknownContent(t *testing.T) {
+	_, err := StripMetadata(ioutil.Discard, bytes.NewReader([]byte("not an image")), "image/jpeg")
+	assert.Equal(t, ErrUnsupportedFormat, err)
+	_, err = StripMetadata(ioutil.Discard, bytes.NewReader([]byte("not an image")), "image/png")
+	assert.Equal(t, ErrUnsupportedFormat, err)
+	_, err = StripMetadata(ioutil.Discard, bytes.NewReader([]byte("GIF89a")), "image/gif")
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
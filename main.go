@@ -2,26 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/minio/minio-go"
 	"github.com/nkonev/blog-storage/client"
 	"github.com/nkonev/blog-storage/data/mongo_lock"
 	"github.com/nkonev/blog-storage/data/repository"
 	"github.com/nkonev/blog-storage/handlers"
 	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/metrics"
+	"github.com/nkonev/blog-storage/scanner"
+	"github.com/nkonev/blog-storage/storage"
 	"github.com/nkonev/blog-storage/utils"
 	"github.com/spf13/viper"
 	migrate "github.com/xakep666/mongo-migrate"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/fx"
+	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 )
 
 const SESSION_COOKIE = "SESSION"
@@ -32,42 +41,57 @@ type authMiddleware echo.MiddlewareFunc
 type staticMiddleware echo.MiddlewareFunc
 
 func main() {
-	configFile, clearMongo, clearMinio := utils.InitFlag("./config-dev/config.yml")
+	configFile, clearMongo, clearMinio, reconcileUsage := utils.InitFlag("./config-dev/config.yml")
 	utils.InitViper(configFile)
 
 	app := fx.New(
 		fx.Logger(Logger),
 		fx.Provide(
 			configureMongo,
-			configureMinio,
+			storage.NewStorage,
 			repository.NewUserFileRepository,
 			repository.NewLimitsRepository,
+			repository.NewUploadSessionRepository,
+			repository.NewUsageRepository,
+			repository.NewFileVersionRepository,
+			repository.NewShareLinkRepository,
+			repository.NewPasswordAttemptRepository,
+			repository.NewDownloadStatsRepository,
+			repository.NewFileGrantRepository,
+			repository.NewFolderRepository,
+			repository.NewDerivativeRepository,
+			scanner.NewScanner,
+			repository.NewAuditRepository,
+			repository.NewWebhookDeliveryRepository,
 			handlers.NewFsHandler,
+			handlers.NewHealthHandler,
 			configureEcho,
 			configureMigrate,
 			configureAuthMiddleware,
 			configureStaticMiddleware,
 			client.NewRestClient,
 		),
-		fx.Invoke(runMigrate, processCli(clearMongo, clearMinio), runEcho),
+		fx.Invoke(runMigrate, processCli(clearMongo, clearMinio, reconcileUsage), runUploadsCleaner, runTrashPurger, runWebhookSender, runUsersMetrics, runMetricsServer, runEcho),
 	)
 	app.Run()
 
 	Logger.Infof("Exit program")
 }
 
-func configureEcho(fsh *handlers.FsHandler, authMiddleware authMiddleware, staticMiddleware staticMiddleware, lc fx.Lifecycle) *echo.Echo {
+func configureEcho(fsh *handlers.FsHandler, hh *handlers.HealthHandler, authMiddleware authMiddleware, staticMiddleware staticMiddleware, lc fx.Lifecycle) *echo.Echo {
 	bodyLimit := viper.GetString("server.body.limit")
 
 	e := echo.New()
 	e.Logger.SetOutput(Logger.Writer())
 
+	e.Pre(middleware.RequestID())
 	e.Pre(echo.MiddlewareFunc(staticMiddleware))
+	e.Use(metrics.Middleware(e))
 	e.Use(echo.MiddlewareFunc(authMiddleware))
 
 	accessLoggerConfig := middleware.LoggerConfig{
 		Output: Logger.Writer(),
-		Format: `"remote_ip":"${remote_ip}",` +
+		Format: `"id":"${id}","remote_ip":"${remote_ip}",` +
 			`"method":"${method}","uri":"${uri}",` +
 			`"status":${status},"error":"${error}","latency_human":"${latency_human}"` +
 			`,"bytes_in":${bytes_in},"bytes_out":${bytes_out},"user_agent":"${user_agent}"` + "\n",
@@ -76,17 +100,66 @@ func configureEcho(fsh *handlers.FsHandler, authMiddleware authMiddleware, stati
 	e.Use(middleware.Secure())
 	e.Use(middleware.BodyLimit(bodyLimit))
 
+	e.GET("/health/live", hh.LiveHandler)
+	e.GET("/health/ready", hh.ReadyHandler)
 	e.GET("/ls", fsh.LsHandler)
+	e.GET("/ls/shared", fsh.SharedWithMeHandler)
+	e.GET("/search", fsh.SearchHandler)
+	e.GET("/search/all", fsh.AdminSearchHandler)
 	e.GET("/limits", fsh.Limits)
-	e.POST("/upload", fsh.UploadHandler)
+	e.POST("/upload", fsh.UploadHandler, fsh.Audit("file.upload"))
 	e.GET(utils.DOWNLOAD_PREFIX+":file", fsh.DownloadHandler)
-	e.POST("/rename/:file", fsh.MoveHandler)
-	e.DELETE("/delete/:file", fsh.DeleteHandler)
-	e.PUT("/publish/:file", fsh.Publish)
+	e.HEAD(utils.DOWNLOAD_PREFIX+":file", fsh.DownloadHandler)
+	e.POST("/rename/:file", fsh.MoveHandler, fsh.Audit("file.rename"))
+	e.DELETE("/delete/:file", fsh.DeleteHandler, fsh.Audit("file.delete"))
+	e.POST("/move/:file", fsh.MoveFileHandler, fsh.Audit("file.move"))
+	e.PATCH("/meta/:file", fsh.PatchMetaHandler, fsh.Audit("file.meta"))
+	e.POST("/folders", fsh.CreateFolderHandler, fsh.Audit("folder.create"))
+	e.POST("/folders/:folder/rename", fsh.RenameFolderHandler, fsh.Audit("folder.rename"))
+	e.POST("/folders/:folder/move", fsh.MoveFolderHandler, fsh.Audit("folder.move"))
+	e.DELETE("/folders/:folder", fsh.DeleteFolderHandler, fsh.Audit("folder.delete"))
+	e.PUT("/replace/:file", fsh.ReplaceHandler, fsh.Audit("file.replace"))
+	e.GET("/versions/:file", fsh.VersionsHandler)
+	e.GET(utils.DOWNLOAD_PREFIX+":file/:version", fsh.DownloadVersionHandler)
+	e.HEAD(utils.DOWNLOAD_PREFIX+":file/:version", fsh.DownloadVersionHandler)
+	e.PUT("/versions/:file/:version", fsh.RestoreVersionHandler, fsh.Audit("version.restore"))
+	e.DELETE("/versions/:file/:version", fsh.DeleteVersionHandler, fsh.Audit("version.delete"))
+	e.GET("/trash", fsh.TrashHandler)
+	e.PUT("/restore/:file", fsh.RestoreHandler, fsh.Audit("file.restore"))
+	e.DELETE("/trash", fsh.EmptyTrashHandler, fsh.Audit("trash.empty"))
+	e.PUT("/publish/:file", fsh.Publish, fsh.Audit("file.publish"))
 	e.GET(utils.PUBLIC_PREFIX+"/"+utils.USER_PREFIX+":userId/:file", fsh.PublicDownloadHandler)
-	e.DELETE("/publish/:file", fsh.DeletePublish)
+	e.HEAD(utils.PUBLIC_PREFIX+"/"+utils.USER_PREFIX+":userId/:file", fsh.PublicDownloadHandler)
+	e.POST(utils.PUBLIC_PREFIX+"/"+utils.USER_PREFIX+":userId/:file", fsh.PublicDownloadHandler)
+	e.GET(utils.PUBLIC_PREFIX+"/"+utils.USER_PREFIX+":userId/:file/meta", fsh.PublicMetaHandler)
+	e.DELETE("/publish/:file", fsh.DeletePublish, fsh.Audit("file.unpublish"))
+	e.PUT("/password/:file", fsh.SetPasswordHandler, fsh.Audit("file.password.set"))
+	e.DELETE("/password/:file", fsh.DeletePasswordHandler, fsh.Audit("file.password.delete"))
+	e.POST("/share/:file", fsh.ShareHandler, fsh.Audit("file.share"))
+	e.DELETE("/share/:file", fsh.RevokeSharesHandler, fsh.Audit("file.share.revoke"))
+	e.GET("/grants/:file", fsh.GrantsHandler)
+	e.PUT("/grants/:file", fsh.GrantHandler, fsh.Audit("grant.set"))
+	e.DELETE("/grants/:file/:userId", fsh.RevokeGrantHandler, fsh.Audit("grant.revoke"))
+	e.GET(utils.PUBLIC_PREFIX+utils.SHARED_PREFIX+":file", fsh.SharedDownloadHandler)
+	e.HEAD(utils.PUBLIC_PREFIX+utils.SHARED_PREFIX+":file", fsh.SharedDownloadHandler)
+	e.GET("/stats", fsh.UserStatsHandler)
+	e.GET("/stats/top", fsh.AdminTopStatsHandler)
+	e.GET("/stats/:file", fsh.FileStatsHandler)
+	e.GET("/quarantine", fsh.AdminQuarantineHandler)
+	e.PUT("/quarantine/:file", fsh.AdminReleaseHandler, fsh.Audit("quarantine.release"))
+	e.DELETE("/quarantine/:file", fsh.AdminDeleteQuarantinedHandler, fsh.Audit("quarantine.delete"))
+	e.GET("/audit", fsh.AdminAuditHandler)
+	e.GET("/webhooks/deliveries", fsh.AdminWebhookDeliveriesHandler)
+	e.POST("/webhooks/deliveries/:id/replay", fsh.AdminReplayWebhookHandler, fsh.Audit("webhook.replay"))
 	e.GET("/users", fsh.AdminUsersHandler)
-	e.PATCH("/users", fsh.AdminPatchUserHandler)
+	e.PATCH("/users", fsh.AdminPatchUserHandler, fsh.Audit("user.limits"))
+
+	tus := e.Group(strings.TrimSuffix(utils.TUS_PREFIX, "/"), fsh.TusMiddleware)
+	tus.OPTIONS("/", fsh.TusOptionsHandler)
+	tus.POST("/", fsh.TusCreateHandler, fsh.Audit("upload.create"))
+	tus.HEAD("/:id", fsh.TusHeadHandler)
+	tus.PATCH("/:id", fsh.TusPatchHandler, fsh.Audit("upload.complete"))
+	tus.DELETE("/:id", fsh.TusDeleteHandler, fsh.Audit("upload.terminate"))
 
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) error {
@@ -102,7 +175,6 @@ func configureEcho(fsh *handlers.FsHandler, authMiddleware authMiddleware, stati
 //go:embed static
 var embeddedFiles embed.FS
 
-
 func configureStaticMiddleware() staticMiddleware {
 	fsys, err := fs.Sub(embeddedFiles, "static")
 	if err != nil {
@@ -147,6 +219,7 @@ func configureAuthMiddleware(httpClient client.RestClient) authMiddleware {
 			sessionCookie, err := c.Request().Cookie(SESSION_COOKIE)
 			if err != nil {
 				Logger.Infof("Error get '%v' cookie: %v", SESSION_COOKIE, err)
+				metrics.CountAuthFailure(metrics.AuthUnauthorized)
 				return c.JSON(http.StatusUnauthorized, &utils.H{"status": "unauthorized"})
 			}
 
@@ -162,14 +235,18 @@ func configureAuthMiddleware(httpClient client.RestClient) authMiddleware {
 
 			req.AddCookie(sessionCookie)
 			req.Header.Add("Accept", "application/json")
+			start := time.Now()
 			resp, err := httpClient.Do(req)
+			metrics.ObserveAuth(time.Since(start))
 			if err != nil {
 				Logger.Errorf("Error during requesting auth backend: %v", err)
+				metrics.CountAuthFailure(metrics.AuthError)
 				return err
 			}
 			defer resp.Body.Close()
 
 			if resp.StatusCode == 401 {
+				metrics.CountAuthFailure(metrics.AuthUnauthorized)
 				return c.JSON(resp.StatusCode, &utils.H{"status": "unauthorized"})
 			} else if resp.StatusCode == 200 {
 				// put user id, user name to context
@@ -179,6 +256,7 @@ func configureAuthMiddleware(httpClient client.RestClient) authMiddleware {
 				err = decoder.Decode(&decodedResponse)
 				if err != nil {
 					Logger.Errorf("Error during decoding json: %v", err)
+					metrics.CountAuthFailure(metrics.AuthError)
 					return err
 				}
 
@@ -186,6 +264,7 @@ func configureAuthMiddleware(httpClient client.RestClient) authMiddleware {
 				i, ok := dto["id"].(float64)
 				if !ok {
 					Logger.Errorf("Error during casting to int")
+					metrics.CountAuthFailure(metrics.AuthError)
 					return c.JSON(http.StatusInternalServerError, &utils.H{"status": "fail"})
 				}
 				c.Set(utils.USER_ID, int(i))
@@ -193,6 +272,7 @@ func configureAuthMiddleware(httpClient client.RestClient) authMiddleware {
 				roles, ok2 := dto["roles"].([]interface{})
 				if !ok2 {
 					Logger.Errorf("Error during casting to int")
+					metrics.CountAuthFailure(metrics.AuthError)
 					return c.JSON(http.StatusInternalServerError, &utils.H{"status": "fail"})
 				}
 
@@ -208,6 +288,7 @@ func configureAuthMiddleware(httpClient client.RestClient) authMiddleware {
 				return next(c)
 			} else {
 				Logger.Errorf("Unknown auth status %v", resp.StatusCode)
+				metrics.CountAuthFailure(metrics.AuthError)
 				return c.JSON(http.StatusInternalServerError, &utils.H{"status": "fail"})
 			}
 
@@ -215,7 +296,7 @@ func configureAuthMiddleware(httpClient client.RestClient) authMiddleware {
 	}
 }
 
-func configureMigrate(c *mongo.Client) *migrate.Migrate {
+func configureMigrate(c *mongo.Client, objectStorage storage.Storage) *migrate.Migrate {
 	database := utils.GetMongoDatabase(c)
 	m := migrate.NewMigrate(database,
 		migrate.Migration{
@@ -239,11 +320,236 @@ func configureMigrate(c *mongo.Client) *migrate.Migrate {
 				return db.Collection("user5").Drop(context.TODO())
 			},
 		},
+		migrate.Migration{
+			Version:     4,
+			Description: "backfill size, content type, checksum and timestamps of files",
+			Up: func(db *mongo.Database) error {
+				return backfillFileMetadata(db, objectStorage)
+			},
+		},
+		migrate.Migration{
+			Version:     5,
+			Description: "calculate usage of users",
+			Up: func(db *mongo.Database) error {
+				return recalculateUsage(objectStorage, repository.NewUsageRepository(c), repository.NewUploadSessionRepository(c), repository.NewUserFileRepository(c))
+			},
+		},
+		migrate.Migration{
+			Version:     6,
+			Description: "mark existing limits as unlimited",
+			Up: func(db *mongo.Database) error {
+				_, err := db.Collection(repository.CollectionLimits).UpdateMany(context.TODO(), bson.M{}, repository.GetUpdateDoc(bson.M{"unlimited": true}))
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     7,
+			Description: "expire share link download counters",
+			Up: func(db *mongo.Database) error {
+				_, err := db.Collection(repository.CollectionShareLinkDownloads).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+					Keys:    bson.D{{Key: repository.ShareLinkExpiresField, Value: 1}},
+					Options: options.Index().SetExpireAfterSeconds(0),
+				})
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     8,
+			Description: "expire password attempts",
+			Up: func(db *mongo.Database) error {
+				_, err := db.Collection(repository.CollectionPasswordAttempts).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+					Keys:    bson.D{{Key: repository.PasswordAttemptsExpiresField, Value: 1}},
+					Options: options.Index().SetExpireAfterSeconds(0),
+				})
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     9,
+			Description: "index download stats",
+			Up: func(db *mongo.Database) error {
+				_, err := db.Collection(repository.CollectionDownloadStats).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+					{
+						Keys: bson.D{
+							{Key: repository.StatsFileIdField, Value: 1},
+							{Key: repository.StatsDayField, Value: 1},
+							{Key: repository.StatsKindField, Value: 1},
+							{Key: repository.StatsReferrerField, Value: 1},
+						},
+						Options: options.Index().SetUnique(true),
+					},
+					{
+						Keys: bson.D{{Key: repository.StatsUserIdField, Value: 1}, {Key: repository.StatsDayField, Value: 1}},
+					},
+					{
+						Keys: bson.D{{Key: repository.StatsDayField, Value: 1}},
+					},
+				})
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     10,
+			Description: "index file grants",
+			Up: func(db *mongo.Database) error {
+				_, err := db.Collection(repository.CollectionFileGrants).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+					{
+						Keys:    bson.D{{Key: repository.GrantFileIdField, Value: 1}, {Key: repository.GrantGranteeIdField, Value: 1}},
+						Options: options.Index().SetUnique(true),
+					},
+					{
+						Keys: bson.D{{Key: repository.GrantGranteeIdField, Value: 1}},
+					},
+				})
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     11,
+			Description: "index folders",
+			Up: func(db *mongo.Database) error {
+				_, err := db.Collection(repository.CollectionFolders).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+					Keys: bson.D{
+						{Key: repository.FolderUserIdField, Value: 1},
+						{Key: repository.FolderParentIdField, Value: 1},
+						{Key: repository.FolderNameField, Value: 1},
+					},
+					Options: options.Index().SetUnique(true),
+				})
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     12,
+			Description: "index files for sorted listing",
+			Up: func(db *mongo.Database) error {
+				var models = make([]mongo.IndexModel, 0)
+				for _, field := range repository.IndexedSortFields() {
+					models = append(models, mongo.IndexModel{
+						Keys: bson.D{{Key: "userid", Value: 1}, {Key: "folderid", Value: 1}, {Key: field, Value: 1}, {Key: "_id", Value: 1}},
+					})
+				}
+				_, err := db.Collection(repository.CollectionUserFiles).Indexes().CreateMany(context.TODO(), models)
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     13,
+			Description: "create text index for search",
+			Up: func(db *mongo.Database) error {
+				var keys = bson.D{}
+				var weights = bson.M{}
+				for field, weight := range repository.SearchableFields {
+					keys = append(keys, bson.E{Key: field, Value: "text"})
+					weights[field] = weight
+				}
+				_, err := db.Collection(repository.CollectionUserFiles).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+					Keys:    keys,
+					Options: options.Index().SetName(repository.SearchIndexName).SetWeights(weights).SetDefaultLanguage("none"),
+				})
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     14,
+			Description: "index derivatives",
+			Up: func(db *mongo.Database) error {
+				_, err := db.Collection(repository.CollectionDerivatives).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+					Keys: bson.D{{Key: repository.DerivativeFileIdField, Value: 1}},
+				})
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     15,
+			Description: "index quarantined files",
+			Up: func(db *mongo.Database) error {
+				_, err := db.Collection(repository.CollectionUserFiles).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+					Keys:    bson.D{{Key: repository.QuarantinedAtField, Value: -1}},
+					Options: options.Index().SetSparse(true),
+				})
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     16,
+			Description: "index and expire audit log",
+			Up: func(db *mongo.Database) error {
+				_, err := db.Collection(repository.CollectionAuditLog).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+					{Keys: bson.D{{Key: repository.AuditTimeField, Value: -1}}},
+					{Keys: bson.D{{Key: repository.AuditActorIdField, Value: 1}, {Key: repository.AuditTimeField, Value: -1}}},
+					{Keys: bson.D{{Key: repository.AuditExpiresField, Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+				})
+				return err
+			},
+		},
+		migrate.Migration{
+			Version:     17,
+			Description: "index and expire webhook deliveries",
+			Up: func(db *mongo.Database) error {
+				_, err := db.Collection(repository.CollectionWebhookDeliveries).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+					{Keys: bson.D{{Key: repository.WebhookStatusField, Value: 1}, {Key: repository.WebhookNextAttemptField, Value: 1}}},
+					{Keys: bson.D{{Key: repository.WebhookCreatedField, Value: -1}}},
+					{Keys: bson.D{{Key: repository.WebhookExpiresField, Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+				})
+				return err
+			},
+		},
 	)
 	return m
 }
 
-func runMigrate(m *migrate.Migrate) error {
+func backfillFileMetadata(db *mongo.Database, objectStorage storage.Storage) error {
+	collection := db.Collection(repository.CollectionUserFiles)
+	cursor, err := collection.Find(context.TODO(), bson.M{"state": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+	for cursor.Next(context.TODO()) {
+		var elem repository.UserFileDto
+		if err := cursor.Decode(&elem); err != nil {
+			return err
+		}
+		bucketName := fmt.Sprintf(utils.USER_PREFIX+"%v", elem.UserId)
+		info, err := objectStorage.StatObject(bucketName, elem.Id.Hex())
+		if err == storage.ErrObjectNotFound {
+			// orphan, it will be removed by -mongo
+			Logger.Warnf("Object for file %v is absent in bucket %v, skipping", elem.Id.Hex(), bucketName)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		object, err := objectStorage.GetObject(bucketName, elem.Id.Hex())
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, object)
+		object.Close()
+		if err != nil {
+			return err
+		}
+
+		// created time isn't stored anywhere so the best we know is object modification time
+		_, err = collection.UpdateOne(context.TODO(), bson.M{repository.Id: elem.Id}, repository.GetUpdateDoc(bson.M{
+			"size":        info.Size,
+			"contenttype": info.ContentType,
+			"sha256":      hex.EncodeToString(hash.Sum(nil)),
+			"created":     info.LastModified,
+			"updated":     info.LastModified,
+			"state":       repository.UploadStateReady,
+		}))
+		if err != nil {
+			return err
+		}
+		Logger.Infof("Backfilled metadata of file %v", elem.Id.Hex())
+	}
+	return cursor.Err()
+}
+
+func runMigrate(m *migrate.Migrate, hh *handlers.HealthHandler) error {
 	mongoClient := utils.GetMongoClient()
 	defer mongoClient.Disconnect(context.TODO())
 
@@ -258,22 +564,13 @@ func runMigrate(m *migrate.Migrate) error {
 
 	lock.ReleaseLock()
 
-	return nil
-}
-
-func configureMinio() *minio.Client {
-	endpoint := viper.GetString("minio.endpoint")
-	accessKeyID := viper.GetString("minio.accessKeyId")
-	secretAccessKey := viper.GetString("minio.secretAccessKey")
-	useSSL := false
-
-	// Initialize minio client object.
-	minioClient, err := minio.New(endpoint, accessKeyID, secretAccessKey, useSSL)
+	version, _, err := m.Version()
 	if err != nil {
-		Logger.Fatal(err)
+		return err
 	}
+	hh.SetMigrated(version)
 
-	return minioClient
+	return nil
 }
 
 func configureMongo(lc fx.Lifecycle) *mongo.Client {
@@ -289,122 +586,332 @@ func configureMongo(lc fx.Lifecycle) *mongo.Client {
 	return mongoClient
 }
 
+// runPeriodically runs job on every tick until application stops
+func runPeriodically(name string, interval time.Duration, job func(), lc fx.Lifecycle) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			go func() {
+				for {
+					select {
+					case <-ticker.C:
+						job()
+					case <-done:
+						return
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			Logger.Infof("Stopping %v", name)
+			ticker.Stop()
+			close(done)
+			return nil
+		},
+	})
+}
+
+func runUploadsCleaner(fsh *handlers.FsHandler, lc fx.Lifecycle) {
+	viper.SetDefault("tus.cleaner.interval", "10m")
+	runPeriodically("uploads cleaner", viper.GetDuration("tus.cleaner.interval"), func() {
+		removed, err := fsh.CleanExpiredUploads()
+		metrics.ObserveCleanup(metrics.CleanupExpiredUploads, removed, err)
+		if err != nil {
+			Logger.Errorf("Error during cleaning expired uploads: %v", err)
+		} else {
+			Logger.Infof("Removed %v expired uploads", removed)
+		}
+	}, lc)
+}
+
+func runTrashPurger(fsh *handlers.FsHandler, lc fx.Lifecycle) {
+	viper.SetDefault("trash.purger.interval", "1h")
+	runPeriodically("trash purger", viper.GetDuration("trash.purger.interval"), func() {
+		purged, err := fsh.PurgeExpiredTrash()
+		metrics.ObserveCleanup(metrics.CleanupExpiredTrash, purged, err)
+		if err != nil {
+			Logger.Errorf("Error during purging trash: %v", err)
+		} else {
+			Logger.Infof("Purged %v files from trash", purged)
+		}
+	}, lc)
+}
+
+func runWebhookSender(fsh *handlers.FsHandler, lc fx.Lifecycle) {
+	viper.SetDefault("webhooks.interval", "5s")
+	runPeriodically("webhook sender", viper.GetDuration("webhooks.interval"), func() {
+		delivered, failed, err := fsh.DeliverWebhooks()
+		if err != nil {
+			Logger.Errorf("Error during sending webhooks: %v", err)
+		} else if delivered+failed != 0 {
+			Logger.Infof("Delivered %v webhooks, given up %v", delivered, failed)
+		}
+	}, lc)
+}
+
+// runUsersMetrics exports per user gauges, they are opt-in because count of series grows with count of users
+func runUsersMetrics(fsh *handlers.FsHandler, lc fx.Lifecycle) {
+	if !viper.GetBool("metrics.users.enabled") {
+		return
+	}
+	viper.SetDefault("metrics.users.interval", "1m")
+	runPeriodically("users metrics", viper.GetDuration("metrics.users.interval"), func() {
+		users, err := fsh.GetUsersUsage()
+		if err != nil {
+			Logger.Errorf("Error during collecting users metrics: %v", err)
+			return
+		}
+		metrics.SetUsersUsage(users)
+	}, lc)
+}
+
+// runMetricsServer serves /metrics on separate address, so per user series aren't exposed on public one. Empty address disables it.
+func runMetricsServer(lc fx.Lifecycle) error {
+	address := viper.GetString("metrics.address")
+	if len(address) == 0 {
+		Logger.Infof("Metrics server is disabled")
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		Logger.Errorf("Cannot listen %v: %v", address, err)
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			Logger.Errorf("Metrics server failed: %v", err)
+		}
+	}()
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			Logger.Infof("Stopping metrics server")
+			return server.Shutdown(ctx)
+		},
+	})
+	Logger.Infof("Metrics server started on %v", address)
+	return nil
+}
+
 // rely on viper import and it's configured by
-func runEcho(e *echo.Echo) {
+// runEcho binds listener synchronously, so application fails to start if address is taken
+func runEcho(e *echo.Echo) error {
 	address := viper.GetString("server.address")
 
 	Logger.Info("Starting server...")
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		Logger.Errorf("Cannot listen %v: %v", address, err)
+		return err
+	}
+	e.Listener = listener
 	// Start server in another goroutine
 	go func() {
-		if err := e.Start(address); err != nil {
+		if err := e.Start(address); err != nil && err != http.ErrServerClosed {
+			Logger.Errorf("Server failed: %v", err)
+		} else {
 			Logger.Infof("server shut down: %v", err)
 		}
 	}()
 	Logger.Info("Server started. Waiting for interrupt (2) (Ctrl+C)")
+	return nil
 }
 
-func processCli(clearMongo bool, clearMinio bool) func(mongoClient *mongo.Client, minioClient *minio.Client) error {
-	return func(mongoClient *mongo.Client, minioClient *minio.Client) error {
+func processCli(clearMongo bool, clearMinio bool, reconcileUsage bool) func(mongoClient *mongo.Client, objectStorage storage.Storage) error {
+	return func(mongoClient *mongo.Client, objectStorage storage.Storage) error {
 		if clearMongo {
-			Logger.Infof("Removing orphans from mongo")
-			var listToDeleteFromMongo []string = make([]string, 0)
-			cursor, e := utils.GetMongoDatabase(mongoClient).Collection(repository.CollectionUserFiles).Find(context.TODO(), bson.D{})
-			if e != nil {
-				return e
+			removed, err := removeMongoOrphans(mongoClient, objectStorage)
+			metrics.ObserveCleanup(metrics.CleanupMongoOrphans, removed, err)
+			if err != nil {
+				return err
 			}
-			defer cursor.Close(context.TODO())
-			for cursor.Next(context.TODO()) {
-				var elem repository.UserFileDto
-				err := cursor.Decode(&elem)
-				if err != nil {
-					return err
-				}
-				filename := elem.Id.Hex()
+		} else {
+			Logger.Infof("Skipped removing orphans from mongo")
+		}
 
-				found, err := searchObjectInMinio(minioClient, filename)
-				if err != nil {
-					return err
-				}
-				if !found {
-					listToDeleteFromMongo = append(listToDeleteFromMongo, filename)
-				}
+		if clearMinio {
+			removed, err := removeStorageOrphans(mongoClient, objectStorage)
+			metrics.ObserveCleanup(metrics.CleanupStorageOrphans, removed, err)
+			if err != nil {
+				return err
 			}
-			Logger.Infof("Found %v orphans in mongo", len(listToDeleteFromMongo))
+		} else {
+			Logger.Infof("Skipped removing orphans from storage")
+		}
 
-			for _, orphan := range listToDeleteFromMongo {
-				Logger.Infof("Removing id='%v' from mongo", orphan)
-				idDoc, e := repository.GetIdDoc(orphan)
-				if e != nil {
-					return e
-				}
-				_, e = utils.GetMongoDatabase(mongoClient).Collection(repository.CollectionUserFiles).DeleteOne(context.TODO(), idDoc)
-				if e != nil {
-					return e
-				}
+		if reconcileUsage {
+			Logger.Infof("Recalculating usage")
+			if err := recalculateUsage(objectStorage, repository.NewUsageRepository(mongoClient), repository.NewUploadSessionRepository(mongoClient), repository.NewUserFileRepository(mongoClient)); err != nil {
+				return err
 			}
 		} else {
-			Logger.Infof("Skipped removing orphans from mongo")
+			Logger.Infof("Skipped recalculating usage")
 		}
+		return nil
+	}
+}
 
-		if clearMinio {
-			type pair struct {
-				bucketname string
-				filename   string
-			}
+// removeMongoOrphans removes metadata of files whose objects are absent in storage, returns count of removed ones
+func removeMongoOrphans(mongoClient *mongo.Client, objectStorage storage.Storage) (int, error) {
+	Logger.Infof("Removing orphans from mongo")
+	var listToDeleteFromMongo []string = make([]string, 0)
+	cursor, e := utils.GetMongoDatabase(mongoClient).Collection(repository.CollectionUserFiles).Find(context.TODO(), bson.D{})
+	if e != nil {
+		return 0, e
+	}
+	defer cursor.Close(context.TODO())
+	for cursor.Next(context.TODO()) {
+		var elem repository.UserFileDto
+		err := cursor.Decode(&elem)
+		if err != nil {
+			return 0, err
+		}
+		filename := elem.Id.Hex()
 
-			Logger.Infof("Removing orphans from minio")
-			var listToDeleteFromMinio []pair = make([]pair, 0)
+		found, err := searchObjectInStorage(objectStorage, filename)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			listToDeleteFromMongo = append(listToDeleteFromMongo, filename)
+		}
+	}
+	Logger.Infof("Found %v orphans in mongo", len(listToDeleteFromMongo))
 
-			bucketInfos, err := minioClient.ListBuckets()
-			if err != nil {
-				return err
+	for i, orphan := range listToDeleteFromMongo {
+		Logger.Infof("Removing id='%v' from mongo", orphan)
+		idDoc, e := repository.GetIdDoc(orphan)
+		if e != nil {
+			return i, e
+		}
+		_, e = utils.GetMongoDatabase(mongoClient).Collection(repository.CollectionUserFiles).DeleteOne(context.TODO(), idDoc)
+		if e != nil {
+			return i, e
+		}
+	}
+	return len(listToDeleteFromMongo), nil
+}
+
+// removeStorageOrphans removes objects which have no metadata in mongo, returns count of removed ones
+func removeStorageOrphans(mongoClient *mongo.Client, objectStorage storage.Storage) (int, error) {
+	type pair struct {
+		bucketname string
+		filename   string
+	}
+
+	Logger.Infof("Removing orphans from storage")
+	var listToDeleteFromMinio []pair = make([]pair, 0)
+
+	bucketNames, err := objectStorage.ListBuckets()
+	if err != nil {
+		return 0, err
+	}
+	for _, bucketName := range bucketNames {
+		if bucketName == utils.UPLOADS_BUCKET {
+			// parts of unfinished uploads are tracked by upload sessions and removed on expiration
+			continue
+		}
+		if bucketName == utils.DERIVATIVES_BUCKET {
+			// resized images are removed together with their originals
+			continue
+		}
+		// Create a done channel.
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		Logger.Debugf("Listing bucket '%v':", bucketName)
+		for objInfo := range objectStorage.ListObjects(bucketName, doneCh) {
+			if objInfo.Err != nil {
+				return 0, objInfo.Err
 			}
-			for _, bucketInfo := range bucketInfos {
-				// Create a done channel.
-				doneCh := make(chan struct{})
-				defer close(doneCh)
-				// Recurively list all objects in 'mytestbucket'
-				recursive := true
-				Logger.Debugf("Listing bucket '%v':", bucketInfo.Name)
-				for objInfo := range minioClient.ListObjects(bucketInfo.Name, "", recursive, doneCh) {
-					Logger.Debugf("Object '%v'", objInfo.Key)
-					found, errHex, err := searchInMongo(mongoClient, objInfo.Key)
-					if err != nil {
-						return err
-					}
-					if !found || errHex != nil {
-						listToDeleteFromMinio = append(listToDeleteFromMinio, pair{bucketname: bucketInfo.Name, filename: objInfo.Key})
-					}
-				}
+			Logger.Debugf("Object '%v'", objInfo.Key)
+			found, errHex, err := searchInMongo(mongoClient, objInfo.Key)
+			if err != nil {
+				return 0, err
 			}
-			Logger.Infof("Found %v orphans in minio", len(listToDeleteFromMinio))
-			for _, orphan := range listToDeleteFromMinio {
-				Logger.Infof("Removing '%v' from bucket '%v' of minio", orphan.filename, orphan.bucketname)
-				err := minioClient.RemoveObject(orphan.bucketname, orphan.filename)
-				if err != nil {
-					return err
-				}
+			if !found || errHex != nil {
+				listToDeleteFromMinio = append(listToDeleteFromMinio, pair{bucketname: bucketName, filename: objInfo.Key})
 			}
-		} else {
-			Logger.Infof("Skipped removing orphans from minio")
 		}
-		return nil
 	}
+	Logger.Infof("Found %v orphans in storage", len(listToDeleteFromMinio))
+	for i, orphan := range listToDeleteFromMinio {
+		Logger.Infof("Removing '%v' from bucket '%v' of storage", orphan.filename, orphan.bucketname)
+		err := objectStorage.RemoveObject(orphan.bucketname, orphan.filename)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(listToDeleteFromMinio), nil
 }
 
-func searchObjectInMinio(client3 *minio.Client, filename string) (bool, error) {
-	bucketInfos, err := client3.ListBuckets()
+// recalculateUsage sets usage counters to sizes of objects in users' buckets plus space reserved by unfinished uploads
+func recalculateUsage(objectStorage storage.Storage, usageRepository *repository.UsageRepository, uploadSessions *repository.UploadSessionRepository, userFileRepository *repository.UserFileRepository) error {
+	bucketNames, err := objectStorage.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, bucketName := range bucketNames {
+		var userId int
+		if _, err := fmt.Sscanf(bucketName, utils.USER_PREFIX+"%d", &userId); err != nil {
+			Logger.Debugf("Skipping bucket '%v' which isn't user's one", bucketName)
+			continue
+		}
+		consumption, err := calcBucketConsumption(objectStorage, bucketName)
+		if err != nil {
+			return err
+		}
+		pending, err := uploadSessions.SumPendingLength(userId)
+		if err != nil {
+			return err
+		}
+		trashedUncounted, err := userFileRepository.SumTrashedUncounted(userId)
+		if err != nil {
+			return err
+		}
+		usage := consumption + pending - trashedUncounted
+		if err := usageRepository.Set(userId, usage); err != nil {
+			return err
+		}
+		Logger.Infof("Usage of user %v is %v bytes (%v bytes reserved by unfinished uploads, %v bytes in trash aren't counted)", userId, usage, pending, trashedUncounted)
+	}
+	return nil
+}
+
+func calcBucketConsumption(objectStorage storage.Storage, bucketName string) (int64, error) {
+	var totalBucketConsumption int64
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	Logger.Debugf("Listing bucket '%v':", bucketName)
+	for objInfo := range objectStorage.ListObjects(bucketName, doneCh) {
+		if objInfo.Err != nil {
+			return 0, objInfo.Err
+		}
+		totalBucketConsumption += objInfo.Size
+	}
+	return totalBucketConsumption, nil
+}
+
+func searchObjectInStorage(objectStorage storage.Storage, filename string) (bool, error) {
+	bucketNames, err := objectStorage.ListBuckets()
 	if err != nil {
 		return false, err
 	}
-	for _, bucketInfo := range bucketInfos {
+	for _, bucketName := range bucketNames {
 		// Create a done channel.
 		doneCh := make(chan struct{})
 		defer close(doneCh)
-		// Recurively list all objects in 'mytestbucket'
-		recursive := true
-		Logger.Debugf("Listing bucket '%v':", bucketInfo.Name)
-		for objInfo := range client3.ListObjects(bucketInfo.Name, "", recursive, doneCh) {
+		Logger.Debugf("Listing bucket '%v':", bucketName)
+		for objInfo := range objectStorage.ListObjects(bucketName, doneCh) {
+			if objInfo.Err != nil {
+				return false, objInfo.Err
+			}
 			Logger.Debugf("Object '%v'", objInfo.Key)
 			if objInfo.Key == filename {
 				return true, nil
@@ -423,5 +930,12 @@ func searchInMongo(mongoClient *mongo.Client, s string) (bool, error, error) {
 	if e != nil {
 		return false, nil, e
 	}
+	if !exists {
+		// previous contents of files are stored in the same buckets
+		exists, e = repository.IsDocumentExists(mongoClient, repository.CollectionFileVersions, idDoc)
+		if e != nil {
+			return false, nil, e
+		}
+	}
 	return exists, nil, nil
 }
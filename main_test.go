@@ -3,25 +3,44 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"github.com/labstack/echo/v4"
 	"github.com/nkonev/blog-storage/client"
 	"github.com/nkonev/blog-storage/data/repository"
 	"github.com/nkonev/blog-storage/handlers"
 	. "github.com/nkonev/blog-storage/logger"
+	"github.com/nkonev/blog-storage/metrics"
+	"github.com/nkonev/blog-storage/scanner"
+	"github.com/nkonev/blog-storage/storage"
 	"github.com/nkonev/blog-storage/utils"
 	"github.com/oliveagle/jsonpath"
 	uuid "github.com/satori/go.uuid"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/fx"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
+	"net"
 	"net/http"
 	test "net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -34,6 +53,42 @@ func makeOkAuthServer() *test.Server {
 	return testServer
 }
 
+// makeTwoUsersAuthServer authenticates "sessionCookieUser2" as user 2 and any other session as user 1
+func makeTwoUsersAuthServer() *test.Server {
+	testServer := test.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		cookie, err := req.Cookie(SESSION_COOKIE)
+		res.WriteHeader(200)
+		if err == nil && cookie.Value == "sessionCookieUser2" {
+			res.Write([]byte(`{"id": 2, "login": "other user", "roles": ["ROLE_USER"]}`))
+		} else {
+			res.Write([]byte(`{"id": 1, "login": "nikita k", "roles": ["ROLE_USER"]}`))
+		}
+	}))
+	return testServer
+}
+
+func makeAuthServerForUser(userId int) *test.Server {
+	testServer := test.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(200)
+		res.Write([]byte(`{"id": ` + strconv.Itoa(userId) + `, "login": "user ` + strconv.Itoa(userId) + `", "roles": ["ROLE_USER"]}`))
+	}))
+	return testServer
+}
+
+// makeAdminAuthServer authenticates "adminSessionCookie" as admin and any other session as ordinary user userId
+func makeAdminAuthServer(userId int) *test.Server {
+	testServer := test.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		cookie, err := req.Cookie(SESSION_COOKIE)
+		res.WriteHeader(200)
+		if err == nil && cookie.Value == "adminSessionCookie" {
+			res.Write([]byte(`{"id": 100, "login": "admin", "roles": ["ROLE_USER", "ROLE_ADMIN"]}`))
+		} else {
+			res.Write([]byte(`{"id": ` + strconv.Itoa(userId) + `, "login": "user ` + strconv.Itoa(userId) + `", "roles": ["ROLE_USER"]}`))
+		}
+	}))
+	return testServer
+}
+
 func makeFailAuthServer() *test.Server {
 	testServer := test.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		res.WriteHeader(401)
@@ -55,35 +110,33 @@ func shutdown() {
 }
 
 func setup() {
-	s, _, _ := utils.InitFlag("./config-dev/config.yml")
+	s, _, _, _ := utils.InitFlag("./config-dev/config.yml")
 	utils.InitViper(s)
 
 	Logger.Info("Set up")
 	utils.DropMongo()
 
-	mc := configureMinio()
-	infos, err := mc.ListBuckets()
+	objectStorage := storage.NewStorage()
+	bucketNames, err := objectStorage.ListBuckets()
 	if err != nil {
 		Logger.Panicf("Error during listing buckets: %v", err)
 	}
-	for _, b := range infos {
+	for _, b := range bucketNames {
 		// Create a done channel.
 		doneCh := make(chan struct{})
 		defer close(doneCh)
-		// Recurively list all objects in 'mytestbucket'
-		recursive := true
-		Logger.Infof("Listing bucket '%v':", b.Name)
-		for objInfo := range mc.ListObjects(b.Name, "", recursive, doneCh) {
+		Logger.Infof("Listing bucket '%v':", b)
+		for objInfo := range objectStorage.ListObjects(b, doneCh) {
 			Logger.Infof("Object '%v'", objInfo.Key)
-			err := mc.RemoveObject(b.Name, objInfo.Key)
+			err := objectStorage.RemoveObject(b, objInfo.Key)
 			if err != nil {
 				Logger.Panicf("Error during dropping object %v: %v", objInfo.Key, err)
 			}
 		}
 
-		err := mc.RemoveBucket(b.Name)
+		err := objectStorage.RemoveBucket(b)
 		if err != nil {
-			Logger.Panicf("Error during dropping bucket %v: %v", b.Name, err)
+			Logger.Panicf("Error during dropping bucket %v: %v", b, err)
 		}
 	}
 }
@@ -130,10 +183,22 @@ func runEcho2(test func(e *echo.Echo)) func(e *echo.Echo) {
 
 func setUpContainerForIntegrationTests(additional ...interface{}) fx.Option {
 	var arr []interface{}
-	arr = append(arr, configureMongo, configureMinio,
+	arr = append(arr, configureMongo, storage.NewStorage,
 		repository.NewUserFileRepository,
 		repository.NewLimitsRepository,
-		handlers.NewFsHandler, configureEcho, configureMigrate,
+		repository.NewUploadSessionRepository,
+		repository.NewUsageRepository,
+		repository.NewFileVersionRepository,
+		repository.NewShareLinkRepository,
+		repository.NewPasswordAttemptRepository,
+		repository.NewDownloadStatsRepository,
+		repository.NewFileGrantRepository,
+		repository.NewFolderRepository,
+		repository.NewDerivativeRepository,
+		scanner.NewScanner,
+		repository.NewAuditRepository,
+		repository.NewWebhookDeliveryRepository,
+		handlers.NewFsHandler, handlers.NewHealthHandler, configureEcho, configureMigrate,
 		configureAuthMiddleware, configureStaticMiddleware,
 	)
 	arr = append(arr, additional...)
@@ -232,16 +297,45 @@ func TestStaticAssets(t *testing.T) {
 	})
 }
 
+// uploadOptions are optional parts of multipart upload, zero value means test-file.yml without form fields
+type uploadOptions struct {
+	content []byte
+	fields  map[string]string
+	// Content-Type of file part, application/octet-stream if empty
+	contentType string
+}
+
 func getMultipart(bytea []byte, filename string) (*bytes.Buffer, string) {
+	return getMultipartWithOptions(filename, uploadOptions{content: bytea})
+}
 
+func getMultipartWithOptions(filename string, opts uploadOptions) (*bytes.Buffer, string) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile(handlers.FormFile, filename)
+	for k, v := range opts.fields {
+		if err := writer.WriteField(k, v); err != nil {
+			Logger.Panicf("Error during writing field")
+		}
+	}
+	var part io.Writer
+	var err error
+	if len(opts.contentType) != 0 {
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Disposition", `form-data; name="`+handlers.FormFile+`"; filename="`+filename+`"`)
+		partHeader.Set(echo.HeaderContentType, opts.contentType)
+		part, err = writer.CreatePart(partHeader)
+	} else {
+		part, err = writer.CreateFormFile(handlers.FormFile, filename)
+	}
 	if err != nil {
 		Logger.Panicf("Error during creating form file")
 	}
 
-	_, err = io.Copy(part, bytes.NewReader(bytea))
+	content := opts.content
+	if content == nil {
+		content = getBytea("test-file.yml")
+	}
+	_, err = io.Copy(part, bytes.NewReader(content))
 	if err != nil {
 		Logger.Panicf("Error during copy")
 	}
@@ -364,7 +458,7 @@ func TestUploadDownloadDelete(t *testing.T) {
 
 			assert.Equal(t, http.StatusOK, rec.Code)
 			assert.True(t, "927" == rec.Header().Get(echo.HeaderContentLength))
-			assert.Equal(t, "application/octet-stream", rec.Header().Get(echo.HeaderContentType))
+			assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get(echo.HeaderContentType))
 			assert.NotEmpty(t, rec.Body.String())
 			Logger.Infof("Got body: %v", rec.Body.String())
 			assert.True(t, strings.Index(rec.Body.String(), "# This file used for both developer and demo purposes") == 0)
@@ -396,7 +490,7 @@ func TestUploadDownloadDelete(t *testing.T) {
 			assert.Equal(t, http.StatusNotFound, rec.Code)
 			assert.NotEmpty(t, rec.Body.String())
 			var str = jsonPathHelper(rec.Body.String(), "$.status").(string)
-			assert.Equal(t, "stat fail", str)
+			assert.Equal(t, "not found", str)
 		}
 	})
 }
@@ -561,3 +655,1831 @@ func TestUploadPublish(t *testing.T) {
 
 	})
 }
+
+func TestForeignFileIsNotAccessible(t *testing.T) {
+	testServer := makeTwoUsersAuthServer()
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		fileName := "foreign_" + uuid.NewV4().String() + ".yml"
+		fileId := uploadTestFile(t, e, fileName)
+
+		{
+			c, b, _ := request("POST", "/rename/"+fileId, strings.NewReader(`{"newname": "stolen.yml"}`), e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusNotFound, c)
+			assert.Equal(t, "not found", jsonPathHelper(b, "$.status").(string))
+		}
+		{
+			c, b, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusNotFound, c)
+			assert.Equal(t, "not found", jsonPathHelper(b, "$.status").(string))
+		}
+		{
+			c, b, _ := request("DELETE", "/publish/"+fileId, nil, e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusNotFound, c)
+			assert.Equal(t, "not found", jsonPathHelper(b, "$.status").(string))
+		}
+		{
+			c, b, _ := request("DELETE", "/delete/"+fileId, nil, e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusNotFound, c)
+			assert.Equal(t, "not found", jsonPathHelper(b, "$.status").(string))
+		}
+		{
+			c, b, _ := request("GET", "/download/"+fileId, nil, e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusNotFound, c)
+			assert.Equal(t, "not found", jsonPathHelper(b, "$.status").(string))
+		}
+		{
+			// malformed id looks like absent one
+			c, _, _ := request("PUT", "/publish/not-an-id", nil, e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusNotFound, c)
+		}
+
+		{
+			req := test.NewRequest("GET", "/public/user1/"+fileId, nil)
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		}
+		{
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			var arr = jsonPathHelper(b, "$.files[?(@.id =~ /"+fileId+"/)].filename").([]interface{})
+			assert.Equal(t, fileName, arr[0])
+		}
+		{
+			c, b, _ := request("GET", "/download/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.True(t, strings.Index(b, "# This file used for both developer and demo purposes") == 0)
+		}
+	})
+}
+
+func tusRequest(method, path string, body io.Reader, e *echo.Echo, headers map[string]string) *test.ResponseRecorder {
+	req := test.NewRequest(method, path, body)
+	req.Header = map[string][]string{
+		echo.HeaderCookie:           []string{SESSION_COOKIE + "=" + "sessionCookie"},
+		handlers.HeaderTusResumable: {handlers.TusVersion},
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := test.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTusUpload(t *testing.T) {
+	testServer := makeOkAuthServer()
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	var sessions *repository.UploadSessionRepository
+	container := fx.Options(setUpContainerForIntegrationTests(client.NewRestClient), fx.Populate(&sessions))
+
+	runTest(container, func(e *echo.Echo) {
+		dat := getBytea("test-file.yml")
+		fileName := "tus_" + uuid.NewV4().String() + ".yml"
+		var location string
+		{
+			rec := tusRequest("OPTIONS", "/tus/", nil, e, nil)
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+			assert.Equal(t, handlers.TusVersion, rec.Header().Get(handlers.HeaderTusVersion))
+			assert.Contains(t, rec.Header().Get(handlers.HeaderTusExtension), "creation")
+		}
+		{
+			req := test.NewRequest("POST", "/tus/", nil)
+			req.Header = map[string][]string{
+				echo.HeaderCookie: []string{SESSION_COOKIE + "=" + "sessionCookie"},
+			}
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+		}
+		{
+			rec := tusRequest("POST", "/tus/", nil, e, map[string]string{
+				handlers.HeaderUploadLength:   strconv.Itoa(len(dat)),
+				handlers.HeaderUploadMetadata: "filename " + base64.StdEncoding.EncodeToString([]byte(fileName)),
+			})
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			location = rec.Header().Get(echo.HeaderLocation)
+			assert.NotEmpty(t, location)
+			assert.NotEmpty(t, rec.Header().Get(handlers.HeaderUploadExpires))
+		}
+		path := location[strings.Index(location, "/tus/"):]
+		half := len(dat) / 2
+		{
+			rec := tusRequest("PATCH", path, bytes.NewReader(dat[:half]), e, map[string]string{
+				echo.HeaderContentType:      handlers.TusOffsetContentType,
+				handlers.HeaderUploadOffset: "0",
+			})
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+			assert.Equal(t, strconv.Itoa(half), rec.Header().Get(handlers.HeaderUploadOffset))
+		}
+		{
+			// file isn't visible until upload is completed
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.NotContains(t, b, fileName)
+		}
+		{
+			rec := tusRequest("PATCH", path, bytes.NewReader(dat[half:]), e, map[string]string{
+				echo.HeaderContentType:      handlers.TusOffsetContentType,
+				handlers.HeaderUploadOffset: "0",
+			})
+			assert.Equal(t, http.StatusConflict, rec.Code)
+		}
+		{
+			rec := tusRequest("HEAD", path, nil, e, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, strconv.Itoa(half), rec.Header().Get(handlers.HeaderUploadOffset))
+			assert.Equal(t, strconv.Itoa(len(dat)), rec.Header().Get(handlers.HeaderUploadLength))
+		}
+		{
+			rec := tusRequest("PATCH", path, bytes.NewReader(dat[half:]), e, map[string]string{
+				echo.HeaderContentType:      handlers.TusOffsetContentType,
+				handlers.HeaderUploadOffset: strconv.Itoa(half),
+			})
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+			assert.Equal(t, strconv.Itoa(len(dat)), rec.Header().Get(handlers.HeaderUploadOffset))
+		}
+		var fileId string
+		{
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			var arr = jsonPathHelper(b, "$.files[?(@.filename =~ /"+fileName+"/)].id").([]interface{})
+			assert.Equal(t, 1, len(arr))
+			fileId = arr[0].(string)
+		}
+		{
+			c, b, _ := request("GET", "/download/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, string(dat), b)
+		}
+		{
+			// late completion doesn't replace file of first one
+			completed, err := sessions.Complete(path[strings.LastIndex(path, "/")+1:], 1, primitive.NewObjectID().Hex())
+			assert.Nil(t, err)
+			assert.False(t, completed)
+		}
+	})
+}
+
+func TestTusTermination(t *testing.T) {
+	testServer := makeOkAuthServer()
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		rec := tusRequest("POST", "/tus/", nil, e, map[string]string{
+			handlers.HeaderUploadLength:   "100",
+			handlers.HeaderUploadMetadata: "filename " + base64.StdEncoding.EncodeToString([]byte("terminated.txt")),
+		})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		location := rec.Header().Get(echo.HeaderLocation)
+		path := location[strings.Index(location, "/tus/"):]
+
+		rec = tusRequest("DELETE", path, nil, e, nil)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		rec = tusRequest("HEAD", path, nil, e, nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestTusQuotaExceeded(t *testing.T) {
+	testServer := makeOkAuthServer()
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		rec := tusRequest("POST", "/tus/", nil, e, map[string]string{
+			handlers.HeaderUploadLength:   strconv.FormatInt(viper.GetInt64("limits.default.per.user.max")+1, 10),
+			handlers.HeaderUploadMetadata: "filename " + base64.StdEncoding.EncodeToString([]byte("huge.bin")),
+		})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+}
+
+// uploadRequest posts multipart form to /upload on behalf of sessionCookie
+func uploadRequest(e *echo.Echo, fileName string, opts uploadOptions) *test.ResponseRecorder {
+	body, contentType := getMultipartWithOptions(fileName, opts)
+
+	req := test.NewRequest("POST", "/upload", body)
+	headers := map[string][]string{
+		echo.HeaderContentType: {contentType},
+		echo.HeaderCookie:      []string{SESSION_COOKIE + "=" + "sessionCookie"},
+	}
+	req.Header = headers
+	rec := test.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func uploadTestFile(t *testing.T, e *echo.Echo, fileName string, opts ...uploadOptions) string {
+	var options uploadOptions
+	if len(opts) != 0 {
+		options = opts[0]
+	}
+	rec := uploadRequest(e, fileName, options)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	return getFileIdFromResp(rec, t)
+}
+
+func downloadRequest(e *echo.Echo, path string, headers map[string]string) *test.ResponseRecorder {
+	req := test.NewRequest("GET", path, nil)
+	req.Header = map[string][]string{
+		echo.HeaderCookie: []string{SESSION_COOKIE + "=" + "sessionCookie"},
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := test.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDownloadRangeAndConditional(t *testing.T) {
+	testServer := makeOkAuthServer()
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		dat := getBytea("test-file.yml")
+		fileId := uploadTestFile(t, e, "range_"+uuid.NewV4().String()+".yml")
+
+		var etag, lastModified string
+		{
+			rec := downloadRequest(e, "/download/"+fileId, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+			etag = rec.Header().Get(handlers.HeaderETag)
+			lastModified = rec.Header().Get(echo.HeaderLastModified)
+			assert.NotEmpty(t, etag)
+			assert.NotEmpty(t, lastModified)
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId, map[string]string{"Range": "bytes=2-11"})
+			assert.Equal(t, http.StatusPartialContent, rec.Code)
+			assert.Equal(t, "10", rec.Header().Get(echo.HeaderContentLength))
+			assert.Equal(t, "bytes 2-11/"+strconv.Itoa(len(dat)), rec.Header().Get("Content-Range"))
+			assert.Equal(t, string(dat[2:12]), rec.Body.String())
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId, map[string]string{"Range": "bytes=0-1,5-6"})
+			assert.Equal(t, http.StatusPartialContent, rec.Code)
+			assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), "multipart/byteranges"))
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId, map[string]string{"Range": "bytes=100000-"})
+			assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId, map[string]string{"If-None-Match": etag})
+			assert.Equal(t, http.StatusNotModified, rec.Code)
+			assert.Empty(t, rec.Body.String())
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId, map[string]string{"If-Modified-Since": lastModified})
+			assert.Equal(t, http.StatusNotModified, rec.Code)
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId, map[string]string{"Range": "bytes=0-9", "If-Range": etag})
+			assert.Equal(t, http.StatusPartialContent, rec.Code)
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId, map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`})
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, string(dat), rec.Body.String())
+		}
+		{
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+
+			req := test.NewRequest("GET", "/public/user1/"+fileId, nil)
+			req.Header.Set("Range", "bytes=0-9")
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusPartialContent, rec.Code)
+			assert.Equal(t, string(dat[0:10]), rec.Body.String())
+			assert.Equal(t, etag, rec.Header().Get(handlers.HeaderETag))
+		}
+	})
+}
+
+func TestUploadStoresMetadata(t *testing.T) {
+	testServer := makeOkAuthServer()
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		dat := getBytea("test-file.yml")
+		fileName := "meta_" + uuid.NewV4().String() + ".yml"
+		uploadTestFile(t, e, fileName)
+
+		c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+		assert.Equal(t, http.StatusOK, c)
+
+		sizes := jsonPathHelper(b, "$.files[?(@.filename =~ /"+fileName+"/)].size").([]interface{})
+		assert.Equal(t, float64(len(dat)), sizes[0])
+		contentTypes := jsonPathHelper(b, "$.files[?(@.filename =~ /"+fileName+"/)].contentType").([]interface{})
+		// declared application/octet-stream is replaced by sniffed type
+		assert.Equal(t, "text/plain; charset=utf-8", contentTypes[0])
+		checksums := jsonPathHelper(b, "$.files[?(@.filename =~ /"+fileName+"/)].sha256").([]interface{})
+		expectedChecksum := sha256.Sum256(dat)
+		assert.Equal(t, hex.EncodeToString(expectedChecksum[:]), checksums[0])
+		created := jsonPathHelper(b, "$.files[?(@.filename =~ /"+fileName+"/)].created").([]interface{})
+		assert.NotEmpty(t, created[0])
+	})
+}
+
+func getUsed(t *testing.T, e *echo.Echo) int64 {
+	c, b, _ := request("GET", "/limits", nil, e, "sessionCookie")
+	assert.Equal(t, http.StatusOK, c)
+	return int64(jsonPathHelper(b, "$.used").(float64))
+}
+
+func TestUsageIsTrackedOnUploadAndDelete(t *testing.T) {
+	testServer := makeAuthServerForUser(3)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		dat := getBytea("test-file.yml")
+		usedBefore := getUsed(t, e)
+
+		fileId := uploadTestFile(t, e, "usage_"+uuid.NewV4().String()+".yml")
+		assert.Equal(t, usedBefore+int64(len(dat)), getUsed(t, e))
+
+		c, _, _ := request("DELETE", "/delete/"+fileId, nil, e, "sessionCookie")
+		assert.Equal(t, http.StatusOK, c)
+		assert.Equal(t, usedBefore, getUsed(t, e))
+	})
+}
+
+func TestConcurrentUploadsCannotExceedLimit(t *testing.T) {
+	testServer := makeAuthServerForUser(4)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	defaultMax := viper.GetInt64("limits.default.per.user.max")
+	defer viper.Set("limits.default.per.user.max", defaultMax)
+
+	runTest(container, func(e *echo.Echo) {
+		dat := getBytea("test-file.yml")
+		// there is a room only for one file
+		viper.Set("limits.default.per.user.max", getUsed(t, e)+int64(len(dat))*3/2)
+
+		codes := make(chan int, 2)
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- uploadRequest(e, "concurrent_"+uuid.NewV4().String()+".yml", uploadOptions{content: dat}).Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		var received []int
+		for code := range codes {
+			received = append(received, code)
+		}
+		assert.ElementsMatch(t, []int{http.StatusOK, http.StatusRequestEntityTooLarge}, received)
+	})
+}
+
+func TestAdminSetsPlanAndFilesLimit(t *testing.T) {
+	testServer := makeAdminAuthServer(5)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		{
+			c, _, _ := request("PATCH", "/users?userId=5&plan=author", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusUnauthorized, c)
+		}
+		{
+			c, _, _ := request("PATCH", "/users?userId=5&plan=nonexistent", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusBadRequest, c)
+		}
+		{
+			c, b, _ := request("PATCH", "/users?userId=5&plan=author&maxFiles=1", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, "author", jsonPathHelper(b, "$.user.plan").(string))
+			assert.Equal(t, float64(viper.GetInt64("limits.plans.author.max")), jsonPathHelper(b, "$.user.limits.maxBytes").(float64))
+			assert.Equal(t, float64(1), jsonPathHelper(b, "$.user.limits.maxFiles").(float64))
+		}
+		{
+			c, b, _ := request("GET", "/limits", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, "author", jsonPathHelper(b, "$.plan").(string))
+			assert.Equal(t, float64(1), jsonPathHelper(b, "$.maxFiles").(float64))
+		}
+
+		uploadTestFile(t, e, "plan_"+uuid.NewV4().String()+".yml")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, uploadRequest(e, "plan_"+uuid.NewV4().String()+".yml", uploadOptions{}).Code)
+		{
+			c, b, _ := request("GET", "/users", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			plans := jsonPathHelper(b, "$.plans[*].name").([]interface{})
+			assert.Contains(t, plans, "author")
+			var arr = jsonPathHelper(b, "$.users[?(@.id == 5)].maxFiles").([]interface{})
+			assert.Equal(t, float64(1), arr[0])
+		}
+		{
+			c, b, _ := request("PATCH", "/users?userId=5&plan=&maxFiles=0", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, "", jsonPathHelper(b, "$.user.plan").(string))
+			assert.Equal(t, float64(viper.GetInt64("limits.default.per.user.max")), jsonPathHelper(b, "$.user.limits.maxBytes").(float64))
+		}
+	})
+}
+
+func TestTrashRestoreAndEmpty(t *testing.T) {
+	testServer := makeAuthServerForUser(6)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	var files *repository.UserFileRepository
+	container := fx.Options(setUpContainerForIntegrationTests(client.NewRestClient), fx.Populate(&files))
+
+	runTest(container, func(e *echo.Echo) {
+		fileName := "trash_" + uuid.NewV4().String() + ".yml"
+		usedBefore := getUsed(t, e)
+		fileId := uploadTestFile(t, e, fileName)
+		usedAfterUpload := getUsed(t, e)
+		{
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, _, _ := request("DELETE", "/delete/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.NotContains(t, b, fileName)
+		}
+		{
+			req := test.NewRequest("GET", "/public/user6/"+fileId, nil)
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		}
+		{
+			c, b, _ := request("GET", "/trash", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			var arr = jsonPathHelper(b, "$.files[?(@.id =~ /"+fileId+"/)].filename").([]interface{})
+			assert.Equal(t, fileName, arr[0])
+		}
+		// trash is counted by default
+		assert.Equal(t, usedAfterUpload, getUsed(t, e))
+		{
+			c, _, _ := request("PUT", "/restore/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Contains(t, b, fileName)
+		}
+		{
+			c, _, _ := request("PUT", "/restore/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusNotFound, c)
+		}
+		{
+			// purge which has read trash before restore doesn't remove restored file
+			id, _ := primitive.ObjectIDFromHex(fileId)
+			deleted, err := files.DeleteTrashed(id, 6)
+			assert.Nil(t, err)
+			assert.False(t, deleted)
+			assert.Equal(t, http.StatusOK, downloadRequest(e, "/download/"+fileId, nil).Code)
+		}
+		{
+			c, _, _ := request("DELETE", "/delete/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, b, _ := request("DELETE", "/trash", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(1), jsonPathHelper(b, "$.purged").(float64))
+		}
+		{
+			c, b, _ := request("GET", "/trash", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.NotContains(t, b, fileId)
+		}
+		assert.Equal(t, usedBefore, getUsed(t, e))
+	})
+}
+
+func replaceTestFile(t *testing.T, e *echo.Echo, fileId string, dat []byte) string {
+	body, contentType := getMultipart(dat, "replaced.yml")
+
+	req := test.NewRequest("PUT", "/replace/"+fileId, body)
+	req.Header = map[string][]string{
+		echo.HeaderContentType: {contentType},
+		echo.HeaderCookie:      []string{SESSION_COOKIE + "=" + "sessionCookie"},
+	}
+	rec := test.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	return jsonPathHelper(rec.Body.String(), "$.version").(string)
+}
+
+func TestReplaceAndRollbackVersion(t *testing.T) {
+	testServer := makeAuthServerForUser(7)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		dat := getBytea("test-file.yml")
+		newDat := []byte("replaced content")
+		usedBefore := getUsed(t, e)
+
+		fileId := uploadTestFile(t, e, "version_"+uuid.NewV4().String()+".yml")
+		versionId := replaceTestFile(t, e, fileId, newDat)
+		// previous content is retained and counted
+		assert.Equal(t, usedBefore+int64(len(dat)+len(newDat)), getUsed(t, e))
+		{
+			rec := downloadRequest(e, "/download/"+fileId, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, newDat, rec.Body.Bytes())
+		}
+		{
+			c, b, _ := request("GET", "/versions/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, versionId, jsonPathHelper(b, "$.versions[0].id").(string))
+			assert.Equal(t, float64(len(dat)), jsonPathHelper(b, "$.versions[0].size").(float64))
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId+"/"+versionId, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, dat, rec.Body.Bytes())
+		}
+
+		// rollback
+		var replacedVersionId string
+		{
+			c, b, _ := request("PUT", "/versions/"+fileId+"/"+versionId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			replacedVersionId = jsonPathHelper(b, "$.version").(string)
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, dat, rec.Body.Bytes())
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId+"/"+versionId, nil)
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		}
+		assert.Equal(t, usedBefore+int64(len(dat)+len(newDat)), getUsed(t, e))
+
+		{
+			c, _, _ := request("DELETE", "/versions/"+fileId+"/"+replacedVersionId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, b, _ := request("GET", "/versions/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, 0, len(jsonPathHelper(b, "$.versions").([]interface{})))
+		}
+		assert.Equal(t, usedBefore+int64(len(dat)), getUsed(t, e))
+	})
+}
+
+func shareTestFile(t *testing.T, e *echo.Echo, fileId string, query string) string {
+	c, b, _ := request("POST", "/share/"+fileId+query, nil, e, "sessionCookie")
+	assert.Equal(t, http.StatusOK, c)
+	shareUrl, err := url.Parse(jsonPathHelper(b, "$.url").(string))
+	assert.Nil(t, err)
+	return shareUrl.RequestURI()
+}
+
+func anonymousRequest(e *echo.Echo, path string) *test.ResponseRecorder {
+	req := test.NewRequest("GET", path, nil)
+	rec := test.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestShareLinks(t *testing.T) {
+	testServer := makeAuthServerForUser(8)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		dat := getBytea("test-file.yml")
+		fileId := uploadTestFile(t, e, "share_"+uuid.NewV4().String()+".yml")
+
+		limited := shareTestFile(t, e, fileId, "?maxDownloads=1")
+		{
+			rec := anonymousRequest(e, limited)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, dat, rec.Body.Bytes())
+		}
+		assert.Equal(t, http.StatusGone, anonymousRequest(e, limited).Code)
+		{
+			// partial requests take downloads too, otherwise limit is bypassed by ranges
+			ranged := shareTestFile(t, e, fileId, "?maxDownloads=1")
+			assert.Equal(t, http.StatusPartialContent, downloadRequest(e, ranged, map[string]string{"Range": "bytes=1-"}).Code)
+			assert.Equal(t, http.StatusGone, downloadRequest(e, ranged, map[string]string{"Range": "bytes=0-0"}).Code)
+		}
+
+		{
+			tampered := strings.Replace(shareTestFile(t, e, fileId, "?ttl=1h"), "expires=", "expires=1", 1)
+			assert.Equal(t, http.StatusForbidden, anonymousRequest(e, tampered).Code)
+		}
+		{
+			c, _, _ := request("POST", "/share/"+fileId+"?ttl=100000h", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusBadRequest, c)
+		}
+
+		// link signed by previous key remains valid after rotation
+		unlimited := shareTestFile(t, e, fileId, "")
+		previousKeys := viper.Get("share.keys")
+		viper.Set("share.keys", []map[string]interface{}{{"id": "k2", "secret": "rotated"}, {"id": "k1", "secret": "change-me-share-secret"}})
+		defer viper.Set("share.keys", previousKeys)
+		assert.Equal(t, http.StatusOK, anonymousRequest(e, unlimited).Code)
+		assert.Contains(t, shareTestFile(t, e, fileId, ""), "kid=k2")
+
+		{
+			c, _, _ := request("DELETE", "/share/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		assert.Equal(t, http.StatusGone, anonymousRequest(e, unlimited).Code)
+		assert.Equal(t, http.StatusOK, anonymousRequest(e, shareTestFile(t, e, fileId, "")).Code)
+	})
+}
+
+func publicRequest(e *echo.Echo, method, path string, body io.Reader, headers map[string]string) *test.ResponseRecorder {
+	req := test.NewRequest(method, path, body)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := test.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPasswordProtectedPublicFile(t *testing.T) {
+	testServer := makeAuthServerForUser(9)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		dat := getBytea("test-file.yml")
+		fileId := uploadTestFile(t, e, "password_"+uuid.NewV4().String()+".yml")
+		publicPath := "/public/user9/" + fileId
+		{
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, b, _ := request("PUT", "/password/"+fileId, strings.NewReader(`{"password": "secret"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, true, jsonPathHelper(b, "$.passwordProtected"))
+		}
+		{
+			rec := publicRequest(e, "GET", publicPath, nil, nil)
+			assert.Equal(t, http.StatusUnauthorized, rec.Code)
+			assert.Contains(t, rec.Header().Get(echo.HeaderWWWAuthenticate), "Basic")
+		}
+		{
+			rec := publicRequest(e, "GET", publicPath, nil, map[string]string{echo.HeaderAccept: "text/html"})
+			assert.Equal(t, http.StatusUnauthorized, rec.Code)
+			assert.Contains(t, rec.Body.String(), "<form")
+		}
+		wrongAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(":wrong"))
+		assert.Equal(t, http.StatusUnauthorized, publicRequest(e, "GET", publicPath, nil, map[string]string{echo.HeaderAuthorization: wrongAuth}).Code)
+
+		var unlockCookie string
+		{
+			rightAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(":secret"))
+			rec := publicRequest(e, "GET", publicPath, nil, map[string]string{echo.HeaderAuthorization: rightAuth})
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, dat, rec.Body.Bytes())
+			unlockCookie = strings.Split(rec.Header().Get(echo.HeaderSetCookie), ";")[0]
+		}
+		assert.Equal(t, http.StatusOK, publicRequest(e, "GET", publicPath, nil, map[string]string{echo.HeaderCookie: unlockCookie}).Code)
+		{
+			rec := publicRequest(e, "POST", publicPath, strings.NewReader("password=secret"), map[string]string{
+				echo.HeaderContentType: echo.MIMEApplicationForm,
+				echo.HeaderAccept:      "text/html",
+			})
+			assert.Equal(t, http.StatusSeeOther, rec.Code)
+		}
+		{
+			rec := publicRequest(e, "POST", publicPath, strings.NewReader(`{"password": "secret"}`), map[string]string{echo.HeaderContentType: echo.MIMEApplicationJSON})
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+
+		// changing password invalidates unlocks
+		{
+			c, _, _ := request("PUT", "/password/"+fileId, strings.NewReader(`{"password": "another"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		assert.Equal(t, http.StatusUnauthorized, publicRequest(e, "GET", publicPath, nil, map[string]string{echo.HeaderCookie: unlockCookie}).Code)
+
+		// one wrong attempt has already been made
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, http.StatusUnauthorized, publicRequest(e, "GET", publicPath, nil, map[string]string{echo.HeaderAuthorization: wrongAuth}).Code)
+		}
+		{
+			rec := publicRequest(e, "GET", publicPath, nil, map[string]string{echo.HeaderAuthorization: wrongAuth})
+			assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+			assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+		}
+
+		{
+			c, _, _ := request("DELETE", "/password/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		assert.Equal(t, http.StatusOK, publicRequest(e, "GET", publicPath, nil, nil).Code)
+	})
+}
+
+func TestDownloadStats(t *testing.T) {
+	testServer := makeAdminAuthServer(10)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		dat := getBytea("test-file.yml")
+		fileId := uploadTestFile(t, e, "stats_"+uuid.NewV4().String()+".yml")
+		{
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		for i := 0; i < 2; i++ {
+			rec := publicRequest(e, "GET", "/public/user10/"+fileId, nil, map[string]string{"Referer": "https://blog.example.com/post/1"})
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+		assert.Equal(t, http.StatusOK, downloadRequest(e, "/download/"+fileId, nil).Code)
+		// HEAD isn't counted
+		assert.Equal(t, http.StatusOK, publicRequest(e, "HEAD", "/public/user10/"+fileId, nil, nil).Code)
+		// range adds only bytes
+		assert.Equal(t, http.StatusPartialContent, downloadRequest(e, "/download/"+fileId, map[string]string{"Range": "bytes=0-9"}).Code)
+
+		{
+			c, b, _ := request("GET", "/stats/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(3), jsonPathHelper(b, "$.downloads"))
+			assert.Equal(t, float64(3*len(dat)+10), jsonPathHelper(b, "$.bytes"))
+			assert.Equal(t, float64(2), jsonPathHelper(b, "$.kinds[?(@.key =~ /public/)].downloads").([]interface{})[0])
+			assert.Equal(t, float64(2), jsonPathHelper(b, "$.referrers[?(@.key =~ /blog.example.com/)].downloads").([]interface{})[0])
+		}
+		{
+			c, b, _ := request("GET", "/stats", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(3), jsonPathHelper(b, "$.files[?(@.id =~ /"+fileId+"/)].downloads").([]interface{})[0])
+		}
+		{
+			c, _, _ := request("GET", "/stats/top", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusUnauthorized, c)
+		}
+		{
+			c, b, _ := request("GET", "/stats/top?limit=1000", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Contains(t, b, fileId)
+		}
+	})
+}
+
+func TestGrantAccessToUser(t *testing.T) {
+	testServer := makeTwoUsersAuthServer()
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		dat := getBytea("test-file.yml")
+		fileId := uploadTestFile(t, e, "grant_"+uuid.NewV4().String()+".yml")
+
+		downloadAsUser2 := func() int {
+			req := test.NewRequest("GET", "/download/"+fileId, nil)
+			req.Header.Set(echo.HeaderCookie, SESSION_COOKIE+"=sessionCookieUser2")
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		assert.Equal(t, http.StatusNotFound, downloadAsUser2())
+
+		{
+			c, _, _ := request("PUT", "/grants/"+fileId, strings.NewReader(`{"userId": 2}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, _, _ := request("PUT", "/grants/"+fileId, strings.NewReader(`{"userId": 1}`), e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusNotFound, c)
+		}
+		assert.Equal(t, http.StatusOK, downloadAsUser2())
+		{
+			c, b, _ := request("GET", "/ls/shared", nil, e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(1), jsonPathHelper(b, "$.files[?(@.id =~ /"+fileId+"/)].ownerId").([]interface{})[0])
+		}
+		// read only grant doesn't allow rename
+		{
+			c, _, _ := request("POST", "/rename/"+fileId, strings.NewReader(`{"newname": "renamed.yml"}`), e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusNotFound, c)
+		}
+		{
+			c, _, _ := request("PUT", "/grants/"+fileId, strings.NewReader(`{"userId": 2, "write": true}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, _, _ := request("POST", "/rename/"+fileId, strings.NewReader(`{"newname": "renamed.yml"}`), e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			body, contentType := getMultipart([]byte("content of grantee"), "renamed.yml")
+			req := test.NewRequest("PUT", "/replace/"+fileId, body)
+			req.Header.Set(echo.HeaderContentType, contentType)
+			req.Header.Set(echo.HeaderCookie, SESSION_COOKIE+"=sessionCookieUser2")
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+		{
+			rec := downloadRequest(e, "/download/"+fileId, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, []byte("content of grantee"), rec.Body.Bytes())
+		}
+		// replaced content is kept as owner's version
+		{
+			c, b, _ := request("GET", "/versions/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			versionId := jsonPathHelper(b, "$.versions[0].id").(string)
+			rec := downloadRequest(e, "/download/"+fileId+"/"+versionId, nil)
+			assert.Equal(t, dat, rec.Body.Bytes())
+		}
+		{
+			c, b, _ := request("GET", "/grants/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, true, jsonPathHelper(b, "$.grants[0].write"))
+		}
+		{
+			c, _, _ := request("DELETE", "/grants/"+fileId+"/2", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		assert.Equal(t, http.StatusNotFound, downloadAsUser2())
+		{
+			c, b, _ := request("GET", "/ls/shared", nil, e, "sessionCookieUser2")
+			assert.Equal(t, http.StatusOK, c)
+			assert.NotContains(t, b, fileId)
+		}
+	})
+}
+
+func TestFolders(t *testing.T) {
+	testServer := makeAuthServerForUser(11)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		rootName := "folder_" + uuid.NewV4().String()
+		var rootId string
+		{
+			c, b, _ := request("POST", "/folders", strings.NewReader(`{"name": "`+rootName+`"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			rootId = jsonPathHelper(b, "$.folder.id").(string)
+		}
+		{
+			c, _, _ := request("POST", "/folders", strings.NewReader(`{"name": "`+rootName+`"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusConflict, c)
+		}
+
+		// directory upload keeps relative path
+		fileId := uploadTestFile(t, e, "file.yml", uploadOptions{fields: map[string]string{handlers.FormFolderId: rootId, handlers.FormPath: "dir/sub/file.yml"}})
+		var subId string
+		{
+			c, b, _ := request("GET", "/ls?folder="+rootId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, "dir", jsonPathHelper(b, "$.folders[0].name"))
+			dirId := jsonPathHelper(b, "$.folders[0].id").(string)
+
+			c, b, _ = request("GET", "/ls?folder="+dirId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			subId = jsonPathHelper(b, "$.folders[0].id").(string)
+		}
+		{
+			c, b, _ := request("GET", "/ls?folder="+subId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, fileId, jsonPathHelper(b, "$.files[0].id"))
+			assert.Equal(t, "file.yml", jsonPathHelper(b, "$.files[0].filename"))
+			assert.Equal(t, rootName, jsonPathHelper(b, "$.breadcrumbs[0].name"))
+			assert.Equal(t, "sub", jsonPathHelper(b, "$.breadcrumbs[2].name"))
+		}
+		{
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.NotContains(t, b, fileId)
+			assert.Contains(t, b, rootName)
+		}
+
+		// folder cannot be moved into its descendant
+		{
+			c, _, _ := request("POST", "/folders/"+rootId+"/move", strings.NewReader(`{"folderId": "`+subId+`"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusBadRequest, c)
+		}
+		{
+			c, _, _ := request("POST", "/folders/"+subId+"/rename", strings.NewReader(`{"newname": "renamed"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, _, _ := request("POST", "/folders/"+subId+"/move", strings.NewReader(`{"folderId": "`+rootId+`"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, b, _ := request("GET", "/ls?folder="+subId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, "renamed", jsonPathHelper(b, "$.breadcrumbs[1].name"))
+		}
+
+		{
+			c, _, _ := request("POST", "/move/"+fileId, strings.NewReader(`{"folderId": "`+rootId+`"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, b, _ := request("DELETE", "/folders/"+rootId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(1), jsonPathHelper(b, "$.trashed"))
+		}
+		{
+			c, _, _ := request("GET", "/ls?folder="+subId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusNotFound, c)
+		}
+		// restored file goes to root because its folder has gone
+		{
+			c, _, _ := request("PUT", "/restore/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Contains(t, b, fileId)
+		}
+
+		// folder with pending resumable upload isn't deleted
+		{
+			c, b, _ := request("POST", "/folders", strings.NewReader(`{"name": "tus_`+uuid.NewV4().String()+`"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			tusFolderId := jsonPathHelper(b, "$.folder.id").(string)
+
+			dat := getBytea("test-file.yml")
+			fileName := "tus_" + uuid.NewV4().String() + ".yml"
+			rec := tusRequest("POST", "/tus/", nil, e, map[string]string{
+				handlers.HeaderUploadLength:   strconv.Itoa(len(dat)),
+				handlers.HeaderUploadMetadata: "filename " + base64.StdEncoding.EncodeToString([]byte(fileName)) + ",folderId " + base64.StdEncoding.EncodeToString([]byte(tusFolderId)),
+			})
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			location := rec.Header().Get(echo.HeaderLocation)
+			path := location[strings.Index(location, "/tus/"):]
+
+			c, _, _ = request("DELETE", "/folders/"+tusFolderId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusConflict, c)
+
+			rec = tusRequest("PATCH", path, bytes.NewReader(dat), e, map[string]string{
+				echo.HeaderContentType:      handlers.TusOffsetContentType,
+				handlers.HeaderUploadOffset: "0",
+			})
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+
+			c, b, _ = request("GET", "/ls?folder="+tusFolderId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Contains(t, b, fileName)
+
+			c, _, _ = request("DELETE", "/folders/"+tusFolderId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+	})
+}
+
+func TestLsPaginationSortingAndFiltering(t *testing.T) {
+	testServer := makeAuthServerForUser(12)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		prefix := "page_" + uuid.NewV4().String()
+		var ids []string
+		for _, suffix := range []string{"_a.yml", "_b.yml", "_c.yml"} {
+			ids = append(ids, uploadTestFile(t, e, prefix+suffix))
+		}
+		{
+			c, _, _ := request("PUT", "/publish/"+ids[1], nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+
+		var cursor string
+		{
+			c, b, _ := request("GET", "/ls?filename="+prefix+"&limit=2", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(3), jsonPathHelper(b, "$.total"))
+			assert.Equal(t, ids[0], jsonPathHelper(b, "$.files[0].id"))
+			assert.Equal(t, ids[1], jsonPathHelper(b, "$.files[1].id"))
+			cursor = jsonPathHelper(b, "$.nextCursor").(string)
+			assert.NotEmpty(t, cursor)
+		}
+		{
+			c, b, _ := request("GET", "/ls?filename="+prefix+"&limit=2&cursor="+cursor, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, 1, len(jsonPathHelper(b, "$.files").([]interface{})))
+			assert.Equal(t, ids[2], jsonPathHelper(b, "$.files[0].id"))
+			assert.Equal(t, "", jsonPathHelper(b, "$.nextCursor"))
+		}
+		// without limit and cursor all files are returned
+		{
+			c, b, _ := request("GET", "/ls?filename="+prefix, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, 3, len(jsonPathHelper(b, "$.files").([]interface{})))
+			assert.Equal(t, "", jsonPathHelper(b, "$.nextCursor"))
+		}
+		{
+			c, b, _ := request("GET", "/ls?filename="+strings.ToUpper(prefix)+"&sort=created&order=desc", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, ids[2], jsonPathHelper(b, "$.files[0].id"))
+		}
+		{
+			c, b, _ := request("GET", "/ls?filename="+prefix+"&published=true", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(1), jsonPathHelper(b, "$.total"))
+			assert.Equal(t, ids[1], jsonPathHelper(b, "$.files[0].id"))
+		}
+		{
+			c, b, _ := request("GET", "/ls?filename="+prefix+"&contentType=image/", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(0), jsonPathHelper(b, "$.total"))
+		}
+		{
+			c, _, _ := request("GET", "/ls?sort=owner", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusBadRequest, c)
+		}
+	})
+}
+
+func TestSearch(t *testing.T) {
+	testServer := makeAdminAuthServer(13)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		token := "tok" + strings.Replace(uuid.NewV4().String(), "-", "", -1)[:12]
+		fileId := uploadTestFile(t, e, "sunset "+token+".yml")
+		{
+			c, b, _ := request("GET", "/search?q="+token, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, fileId, jsonPathHelper(b, "$.files[0].id"))
+			assert.Equal(t, float64(7), jsonPathHelper(b, "$.files[0].highlights[0].start"))
+			assert.Equal(t, float64(7+len(token)), jsonPathHelper(b, "$.files[0].highlights[0].end"))
+		}
+		// prefix of word matches
+		{
+			c, b, _ := request("GET", "/search?q="+strings.ToUpper(token[:8]), nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, fileId, jsonPathHelper(b, "$.files[0].id"))
+		}
+		// middle of word doesn't match
+		{
+			c, b, _ := request("GET", "/search?q="+token[3:], nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.NotContains(t, b, fileId)
+		}
+		{
+			c, _, _ := request("GET", "/search?q=", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusBadRequest, c)
+		}
+		{
+			c, _, _ := request("GET", "/search/all?q="+token, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusUnauthorized, c)
+		}
+		{
+			c, b, _ := request("GET", "/search/all?q="+token, nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(13), jsonPathHelper(b, "$.files[0].ownerId"))
+		}
+	})
+}
+
+func TestSearchIsScopedToOwner(t *testing.T) {
+	testServer := makeTwoUsersAuthServer()
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		token := "tok" + strings.Replace(uuid.NewV4().String(), "-", "", -1)[:12]
+		fileId := uploadTestFile(t, e, token+".yml")
+		c, b, _ := request("GET", "/search?q="+token, nil, e, "sessionCookieUser2")
+		assert.Equal(t, http.StatusOK, c)
+		assert.NotContains(t, b, fileId)
+	})
+}
+
+func TestFileMetadata(t *testing.T) {
+	testServer := makeAuthServerForUser(14)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		fileId := uploadTestFile(t, e, "meta_"+uuid.NewV4().String()+".yml")
+		{
+			body := `{"tags": ["sea", " sea ", "sunset"], "description": "Evening", "altText": "Sun over the sea", "attributes": {"camera": "X100"}}`
+			c, b, _ := request("PATCH", "/meta/"+fileId, strings.NewReader(body), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, []interface{}{"sea", "sunset"}, jsonPathHelper(b, "$.file.tags"))
+			assert.Equal(t, "Sun over the sea", jsonPathHelper(b, "$.file.altText"))
+		}
+		// absent fields are kept, empty ones are removed
+		{
+			c, b, _ := request("PATCH", "/meta/"+fileId, strings.NewReader(`{"description": ""}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, "", jsonPathHelper(b, "$.file.description"))
+			assert.Equal(t, "X100", jsonPathHelper(b, "$.file.attributes.camera"))
+		}
+		{
+			c, _, _ := request("PATCH", "/meta/"+fileId, strings.NewReader(`{"attributes": {"a.b": "c"}}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusBadRequest, c)
+		}
+		{
+			c, _, _ := request("PATCH", "/meta/"+fileId, strings.NewReader(`{"altText": "`+strings.Repeat("a", 501)+`"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusBadRequest, c)
+		}
+		{
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, "Sun over the sea", jsonPathHelper(b, "$.files[?(@.id =~ /"+fileId+"/)].altText").([]interface{})[0])
+		}
+
+		{
+			rec := publicRequest(e, "GET", "/public/user14/"+fileId+"/meta", nil, nil)
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+			assert.Equal(t, "not found", jsonPathHelper(rec.Body.String(), "$.status"))
+		}
+		{
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			rec := publicRequest(e, "GET", "/public/user14/"+fileId+"/meta", nil, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "Sun over the sea", jsonPathHelper(rec.Body.String(), "$.file.altText"))
+		}
+	})
+}
+
+func makeTestPng(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	encoded := &bytes.Buffer{}
+	assert.Nil(t, png.Encode(encoded, img))
+	return encoded.Bytes()
+}
+
+func uploadTestImage(t *testing.T, e *echo.Echo, fileName string, width, height int) string {
+	return uploadTestFile(t, e, fileName, uploadOptions{content: makeTestPng(t, width, height), contentType: "image/png"})
+}
+
+func TestPublicImageResizing(t *testing.T) {
+	testServer := makeAuthServerForUser(15)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		imageId := uploadTestImage(t, e, "image_"+uuid.NewV4().String()+".png", 200, 100)
+		textId := uploadTestFile(t, e, "not_image_"+uuid.NewV4().String()+".yml")
+		for _, fileId := range []string{imageId, textId} {
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			rec := publicRequest(e, "GET", "/public/user15/"+imageId+"?w=50", nil, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "image/png", rec.Header().Get(echo.HeaderContentType))
+			config, _, err := image.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+			assert.Nil(t, err)
+			assert.Equal(t, 50, config.Width)
+			assert.Equal(t, 25, config.Height)
+		}
+		{
+			rec := publicRequest(e, "GET", "/public/user15/"+imageId+"?w=40&h=40&fit=cover&format=jpeg", nil, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "image/jpeg", rec.Header().Get(echo.HeaderContentType))
+			config, _, err := image.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+			assert.Nil(t, err)
+			assert.Equal(t, 40, config.Width)
+			assert.Equal(t, 40, config.Height)
+		}
+		assert.Equal(t, http.StatusBadRequest, publicRequest(e, "GET", "/public/user15/"+imageId+"?w=100000", nil, nil).Code)
+		assert.Equal(t, http.StatusBadRequest, publicRequest(e, "GET", "/public/user15/"+imageId+"?fit=stretch", nil, nil).Code)
+		assert.Equal(t, http.StatusUnsupportedMediaType, publicRequest(e, "GET", "/public/user15/"+textId+"?w=50", nil, nil).Code)
+
+		// derivatives of replaced original are not served anymore
+		replaceTestFile(t, e, imageId, []byte("replaced content"))
+		assert.Equal(t, http.StatusUnsupportedMediaType, publicRequest(e, "GET", "/public/user15/"+imageId+"?w=50", nil, nil).Code)
+	})
+}
+
+// withGpsChunk adds textual chunk right after IHDR, as some cameras and editors do
+func withGpsChunk(encoded []byte, gps string) []byte {
+	data := append([]byte("GPS\x00"), []byte(gps)...)
+	chunk := make([]byte, 8)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+	return append(append(append([]byte{}, encoded[:33]...), chunk...), encoded[33:]...)
+}
+
+func TestImageMetadataIsStripped(t *testing.T) {
+	testServer := makeAuthServerForUser(16)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	const gps = "55.7558N 37.6173E"
+	runTest(container, func(e *echo.Echo) {
+		// publish policy keeps private original
+		{
+			fileId := uploadTestFile(t, e, "gps_"+uuid.NewV4().String()+".png", uploadOptions{content: withGpsChunk(makeTestPng(t, 10, 10), gps), contentType: "image/png"})
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+
+			rec := publicRequest(e, "GET", "/public/user16/"+fileId, nil, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.NotContains(t, rec.Body.String(), gps)
+			_, _, err := image.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+			assert.Nil(t, err)
+
+			assert.Contains(t, downloadRequest(e, "/download/"+fileId, nil).Body.String(), gps)
+
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, true, jsonPathHelper(b, "$.files[?(@.id =~ /"+fileId+"/)].sanitized").([]interface{})[0])
+		}
+
+		viper.Set("images.sanitize", handlers.SanitizeOnUpload)
+		defer viper.Set("images.sanitize", handlers.SanitizeOnPublish)
+		{
+			fileId := uploadTestFile(t, e, "gps_"+uuid.NewV4().String()+".png", uploadOptions{content: withGpsChunk(makeTestPng(t, 10, 10), gps), contentType: "image/png"})
+			assert.NotContains(t, downloadRequest(e, "/download/"+fileId, nil).Body.String(), gps)
+
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, true, jsonPathHelper(b, "$.files[?(@.id =~ /"+fileId+"/)].sanitized").([]interface{})[0])
+		}
+	})
+}
+
+func TestUploadRules(t *testing.T) {
+	testServer := makeAuthServerForUser(17)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	defer viper.Set("uploads", viper.Get("uploads"))
+	defer viper.Set("limits.plans", viper.Get("limits.plans"))
+	defer viper.Set("limits.default.plan", viper.Get("limits.default.plan"))
+	runTest(container, func(e *echo.Echo) {
+		viper.Set("uploads", map[string]interface{}{"max": 100})
+		{
+			rec := uploadRequest(e, "big_"+uuid.NewV4().String()+".yml", uploadOptions{})
+			assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+			assert.Equal(t, float64(100), jsonPathHelper(rec.Body.String(), "$.maxSize"))
+		}
+
+		viper.Set("uploads", map[string]interface{}{"deny": map[string]interface{}{"extensions": []string{"YML"}}})
+		assert.Equal(t, http.StatusUnsupportedMediaType, uploadRequest(e, "denied_"+uuid.NewV4().String()+".yml", uploadOptions{}).Code)
+		{
+			viper.Set("uploads", map[string]interface{}{})
+			fileId := uploadTestFile(t, e, "renamed_"+uuid.NewV4().String()+".txt")
+			viper.Set("uploads", map[string]interface{}{"deny": map[string]interface{}{"extensions": []string{"exe"}}})
+
+			c, b, _ := request("POST", "/rename/"+fileId, strings.NewReader(`{"newname": "renamed.exe"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusUnsupportedMediaType, c)
+			assert.Equal(t, ".exe", jsonPathHelper(b, "$.extension"))
+			c, _, _ = request("POST", "/rename/"+fileId, strings.NewReader(`{"newname": "renamed.txt"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			viper.Set("uploads", map[string]interface{}{"deny": map[string]interface{}{"extensions": []string{"YML"}}})
+		}
+		{
+			rec := tusRequest("POST", "/tus/", nil, e, map[string]string{
+				handlers.HeaderUploadLength:   "10",
+				handlers.HeaderUploadMetadata: "filename " + base64.StdEncoding.EncodeToString([]byte("denied.yml")),
+			})
+			assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+		}
+
+		// type is sniffed, so text cannot pass as image
+		viper.Set("uploads", map[string]interface{}{"allow": map[string]interface{}{"types": []string{"image/*"}}})
+		{
+			rec := uploadRequest(e, "fake.png", uploadOptions{contentType: "image/png"})
+			assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+			assert.Equal(t, "text/plain", jsonPathHelper(rec.Body.String(), "$.contentType"))
+		}
+		uploadTestImage(t, e, "allowed_"+uuid.NewV4().String()+".png", 10, 10)
+
+		// plan's allow list replaces global one
+		viper.Set("limits.plans", map[string]interface{}{"texts": map[string]interface{}{
+			"max": 536870912, "uploads": map[string]interface{}{"allow": map[string]interface{}{"types": []string{"text/plain"}}},
+		}})
+		viper.Set("limits.default.plan", "texts")
+		assert.Equal(t, http.StatusOK, uploadRequest(e, "plan_"+uuid.NewV4().String()+".yml", uploadOptions{}).Code)
+	})
+}
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// startFakeClamd answers INSTREAM command, it finds only EICAR test string
+func startFakeClamd(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				command := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, command); err != nil {
+					return
+				}
+				var content bytes.Buffer
+				for {
+					var length uint32
+					if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+						return
+					}
+					if length == 0 {
+						break
+					}
+					if _, err := io.CopyN(&content, conn, int64(length)); err != nil {
+						return
+					}
+				}
+				if strings.Contains(content.String(), eicar) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func TestMalwareQuarantine(t *testing.T) {
+	testServer := makeAdminAuthServer(18)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	clamd := startFakeClamd(t)
+	defer clamd.Close()
+	viper.Set("scanner.type", scanner.TypeClamd)
+	viper.Set("scanner.clamd.address", "tcp:"+clamd.Addr().String())
+	defer viper.Set("scanner.type", scanner.TypeNone)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		uploadTestFile(t, e, "clean_"+uuid.NewV4().String()+".yml")
+
+		fileName := "infected_" + uuid.NewV4().String() + ".txt"
+		var fileId string
+		{
+			rec := uploadRequest(e, fileName, uploadOptions{content: []byte(eicar)})
+			assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+			assert.Equal(t, "Eicar-Test-Signature", jsonPathHelper(rec.Body.String(), "$.reason"))
+			fileId = jsonPathHelper(rec.Body.String(), "$.id").(string)
+		}
+		{
+			c, b, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.NotContains(t, b, fileName)
+		}
+		assert.Equal(t, http.StatusForbidden, downloadRequest(e, "/download/"+fileId, nil).Code)
+		{
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusForbidden, c)
+		}
+		{
+			c, _, _ := request("GET", "/quarantine", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusUnauthorized, c)
+		}
+		{
+			c, b, _ := request("GET", "/quarantine", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(18), jsonPathHelper(b, "$.files[?(@.id =~ /"+fileId+"/)].ownerId").([]interface{})[0])
+		}
+		{
+			c, _, _ := request("PUT", "/quarantine/"+fileId, nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		assert.Equal(t, http.StatusOK, downloadRequest(e, "/download/"+fileId, nil).Code)
+		{
+			c, _, _ := request("PUT", "/quarantine/"+fileId, nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusNotFound, c)
+		}
+
+		// published file quarantined on replace disappears from public endpoints
+		{
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		assert.Equal(t, http.StatusOK, publicRequest(e, "GET", "/public/user18/"+fileId+"/meta", nil, nil).Code)
+		{
+			body, contentType := getMultipart([]byte(eicar), fileName)
+			req := test.NewRequest("PUT", "/replace/"+fileId, body)
+			req.Header.Set(echo.HeaderContentType, contentType)
+			req.Header.Set(echo.HeaderCookie, SESSION_COOKIE+"=sessionCookie")
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		}
+		assert.Equal(t, http.StatusNotFound, publicRequest(e, "GET", "/public/user18/"+fileId, nil, nil).Code)
+		assert.Equal(t, http.StatusNotFound, publicRequest(e, "GET", "/public/user18/"+fileId+"/meta", nil, nil).Code)
+
+		// owner gets previous content of quarantined file back
+		{
+			c, b, _ := request("GET", "/versions/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, 1, len(jsonPathHelper(b, "$.versions").([]interface{})))
+			versionId := jsonPathHelper(b, "$.versions[0].id").(string)
+			assert.Equal(t, http.StatusOK, downloadRequest(e, "/download/"+fileId+"/"+versionId, nil).Code)
+
+			used := getUsed(t, e)
+			c, _, _ = request("PUT", "/versions/"+fileId+"/"+versionId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, used-int64(len(eicar)), getUsed(t, e))
+
+			c, b, _ = request("GET", "/versions/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, 0, len(jsonPathHelper(b, "$.versions").([]interface{})))
+		}
+		assert.Equal(t, http.StatusOK, downloadRequest(e, "/download/"+fileId, nil).Code)
+		assert.Equal(t, http.StatusOK, publicRequest(e, "GET", "/public/user18/"+fileId+"/meta", nil, nil).Code)
+		{
+			c, b, _ := request("GET", "/quarantine", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.NotContains(t, b, fileId)
+		}
+
+		// quarantined file isn't left in removed folder
+		{
+			c, b, _ := request("POST", "/folders", strings.NewReader(`{"name": "folder_`+uuid.NewV4().String()+`"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			folderId := jsonPathHelper(b, "$.folder.id").(string)
+
+			rec := uploadRequest(e, "infected_"+uuid.NewV4().String()+".txt", uploadOptions{content: []byte(eicar), fields: map[string]string{handlers.FormFolderId: folderId}})
+			assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+			c, b, _ = request("DELETE", "/folders/"+folderId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, float64(1), jsonPathHelper(b, "$.trashed"))
+		}
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	testServer := makeAdminAuthServer(19)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		fileId := uploadTestFile(t, e, "audit_"+uuid.NewV4().String()+".yml")
+		newName := "audited_" + uuid.NewV4().String() + ".yml"
+		{
+			c, _, _ := request("POST", "/rename/"+fileId, strings.NewReader(`{"newname": "`+newName+`"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, _, _ := request("PATCH", "/users?userId=19&maxFiles=1000", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+
+		{
+			c, _, _ := request("GET", "/audit", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusUnauthorized, c)
+		}
+		{
+			c, b, _ := request("GET", "/audit?userId=19&action=file.rename&from="+url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, fileId, jsonPathHelper(b, "$.entries[0].targetId"))
+			assert.Equal(t, newName, jsonPathHelper(b, "$.entries[0].after.filename"))
+			assert.Equal(t, float64(http.StatusOK), jsonPathHelper(b, "$.entries[0].status"))
+			assert.NotEmpty(t, jsonPathHelper(b, "$.entries[0].requestId"))
+		}
+		{
+			c, b, _ := request("GET", "/audit?userId=19&action=file.publish", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, false, jsonPathHelper(b, "$.entries[0].before.published"))
+			assert.Equal(t, true, jsonPathHelper(b, "$.entries[0].after.published"))
+		}
+		{
+			c, b, _ := request("GET", "/audit?userId=100&action=user.limits", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, "19", jsonPathHelper(b, "$.entries[0].targetId"))
+			assert.Equal(t, "admin", jsonPathHelper(b, "$.entries[0].actorLogin"))
+			assert.Equal(t, float64(1000), jsonPathHelper(b, "$.entries[0].after.maxFiles"))
+		}
+		{
+			c, _, _ := request("GET", "/audit?from=yesterday", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusBadRequest, c)
+		}
+
+		// forwarded address is taken only from trusted proxy
+		defer viper.Set("server.trustedProxies", viper.Get("server.trustedProxies"))
+		for _, trusted := range []bool{false, true} {
+			if trusted {
+				viper.Set("server.trustedProxies", []string{"192.0.2.0/24"})
+			}
+			req := test.NewRequest("POST", "/rename/"+fileId, strings.NewReader(`{"newname": "`+newName+`"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set(echo.HeaderCookie, SESSION_COOKIE+"=sessionCookie")
+			req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			c, b, _ := request("GET", "/audit?userId=19&action=file.rename", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			if trusted {
+				assert.Equal(t, "203.0.113.7", jsonPathHelper(b, "$.entries[0].ip"))
+			} else {
+				assert.Equal(t, "192.0.2.1", jsonPathHelper(b, "$.entries[0].ip"))
+			}
+		}
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	testServer := makeAdminAuthServer(20)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+
+	var mutex sync.Mutex
+	var received []*http.Request
+	var bodies []string
+	subscriber := test.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, req)
+		bodies = append(bodies, string(body))
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	defer subscriber.Close()
+	failingSubscriber := test.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingSubscriber.Close()
+
+	viper.Set("webhooks.subscriptions", []map[string]interface{}{
+		{"url": subscriber.URL, "secret": "s3cret", "events": []string{"file.uploaded", "file.renamed", "file.published", "file.unpublished", "file.deleted", "file.restored"}},
+		{"url": failingSubscriber.URL, "events": []string{"file.deleted"}},
+	})
+	viper.Set("webhooks.maxAttempts", 1)
+	defer viper.Set("webhooks.subscriptions", []map[string]interface{}{})
+	defer viper.Set("webhooks.maxAttempts", 10)
+
+	var fsh *handlers.FsHandler
+	container := fx.Options(setUpContainerForIntegrationTests(client.NewRestClient), fx.Populate(&fsh))
+
+	runTest(container, func(e *echo.Echo) {
+		fileName := "webhook_" + uuid.NewV4().String() + ".yml"
+		fileId := uploadTestFile(t, e, fileName)
+		{
+			c, _, _ := request("POST", "/rename/"+fileId, strings.NewReader(`{"newname": "renamed.yml"}`), e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, _, _ := request("PUT", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, _, _ := request("DELETE", "/publish/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, _, _ := request("DELETE", "/delete/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, _, _ := request("PUT", "/restore/"+fileId, nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+
+		delivered, failed, err := fsh.DeliverWebhooks()
+		assert.Nil(t, err)
+		assert.Equal(t, 6, delivered)
+		assert.Equal(t, 1, failed)
+
+		mutex.Lock()
+		assert.Len(t, received, 6)
+		var events []string
+		for i, req := range received {
+			events = append(events, jsonPathHelper(bodies[i], "$.event").(string))
+			assert.Equal(t, req.Header.Get("X-Webhook-Event"), jsonPathHelper(bodies[i], "$.event"))
+			mac := hmac.New(sha256.New, []byte("s3cret"))
+			mac.Write([]byte(req.Header.Get("X-Webhook-Timestamp") + "." + bodies[i]))
+			assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), req.Header.Get("X-Webhook-Signature"))
+			assert.Equal(t, fileId, jsonPathHelper(bodies[i], "$.file.id"))
+			assert.Equal(t, float64(20), jsonPathHelper(bodies[i], "$.userId"))
+		}
+		assert.Equal(t, []string{"file.uploaded", "file.renamed", "file.published", "file.unpublished", "file.deleted", "file.restored"}, events)
+		assert.Equal(t, fileName, jsonPathHelper(bodies[1], "$.file.previousFilename"))
+		assert.Equal(t, "renamed.yml", jsonPathHelper(bodies[1], "$.file.filename"))
+		assert.NotEmpty(t, jsonPathHelper(bodies[2], "$.file.publicUrl"))
+		mutex.Unlock()
+
+		{
+			c, _, _ := request("GET", "/webhooks/deliveries", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusUnauthorized, c)
+		}
+		var failedId string
+		{
+			c, b, _ := request("GET", "/webhooks/deliveries?status=failed", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, failingSubscriber.URL, jsonPathHelper(b, "$.deliveries[0].url"))
+			assert.Equal(t, "file.deleted", jsonPathHelper(b, "$.deliveries[0].event"))
+			assert.Equal(t, float64(http.StatusInternalServerError), jsonPathHelper(b, "$.deliveries[0].lastStatus"))
+			assert.Equal(t, float64(1), jsonPathHelper(b, "$.deliveries[0].attempts"))
+			failedId = jsonPathHelper(b, "$.deliveries[0].id").(string)
+		}
+		{
+			c, b, _ := request("GET", "/webhooks/deliveries?status=delivered&event=file.renamed", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, subscriber.URL, jsonPathHelper(b, "$.deliveries[0].url"))
+			assert.Equal(t, float64(http.StatusNoContent), jsonPathHelper(b, "$.deliveries[0].lastStatus"))
+		}
+		{
+			c, _, _ := request("POST", "/webhooks/deliveries/"+failedId+"/replay", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			c, b, _ := request("GET", "/webhooks/deliveries?status=pending", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, failedId, jsonPathHelper(b, "$.deliveries[0].id"))
+		}
+		{
+			// only failed delivery may be replayed
+			c, _, _ := request("POST", "/webhooks/deliveries/"+failedId+"/replay", nil, e, "adminSessionCookie")
+			assert.Equal(t, http.StatusNotFound, c)
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	testServer := makeAdminAuthServer(21)
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+
+	var fsh *handlers.FsHandler
+	container := fx.Options(setUpContainerForIntegrationTests(client.NewRestClient), fx.Populate(&fsh))
+
+	runTest(container, func(e *echo.Echo) {
+		uploadTestFile(t, e, "metrics_"+uuid.NewV4().String()+".yml")
+		{
+			c, _, _ := request("GET", "/ls", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusOK, c)
+		}
+		{
+			// without session cookie
+			req := test.NewRequest("GET", "/ls", nil)
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		}
+
+		users, err := fsh.GetUsersUsage()
+		assert.Nil(t, err)
+		metrics.SetUsersUsage(users)
+
+		// metrics aren't served on public address
+		{
+			req := test.NewRequest("GET", "/metrics", nil)
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusUnauthorized, rec.Code)
+			c, _, _ := request("GET", "/metrics", nil, e, "sessionCookie")
+			assert.Equal(t, http.StatusNotFound, c)
+		}
+
+		req := test.NewRequest("GET", "/metrics", nil)
+		rec := test.NewRecorder()
+		metrics.Handler().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		b := rec.Body.String()
+		assert.Contains(t, b, `blog_storage_http_requests_total{method="GET",route="/ls",status="200"}`)
+		assert.Contains(t, b, `blog_storage_http_requests_total{method="GET",route="/ls",status="401"}`)
+		assert.Contains(t, b, `blog_storage_uploaded_bytes_total{route="/upload"}`)
+		assert.Contains(t, b, `blog_storage_auth_request_duration_seconds_count`)
+		assert.Contains(t, b, `blog_storage_auth_failures_total{reason="unauthorized"}`)
+		assert.Contains(t, b, `blog_storage_storage_operation_duration_seconds_count{operation="put",result="ok"}`)
+		assert.Contains(t, b, `blog_storage_mongo_command_duration_seconds_count{command="insert",result="ok"}`)
+		assert.Contains(t, b, `blog_storage_user_used_bytes{user="21"}`)
+	})
+}
+
+func TestHealth(t *testing.T) {
+	testServer := makeOkAuthServer()
+	defer func() { testServer.Close() }()
+	viper.Set(AUTH_URL, testServer.URL)
+	container := setUpContainerForIntegrationTests(client.NewRestClient)
+
+	runTest(container, func(e *echo.Echo) {
+		// probes have no session
+		probe := func(path string) (int, string) {
+			req := test.NewRequest("GET", path, nil)
+			rec := test.NewRecorder()
+			e.ServeHTTP(rec, req)
+			return rec.Code, rec.Body.String()
+		}
+		{
+			c, b := probe("/health/live")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, "ok", jsonPathHelper(b, "$.status"))
+		}
+		{
+			c, b := probe("/health/ready")
+			assert.Equal(t, http.StatusOK, c)
+			assert.Equal(t, "ok", jsonPathHelper(b, "$.status"))
+			assert.Equal(t, "ok", jsonPathHelper(b, "$.checks.mongo.status"))
+			assert.Equal(t, "ok", jsonPathHelper(b, "$.checks.storage.status"))
+			assert.Equal(t, "ok", jsonPathHelper(b, "$.checks.auth.status"))
+			assert.Equal(t, "ok", jsonPathHelper(b, "$.checks.migrations.status"))
+			assert.NotZero(t, jsonPathHelper(b, "$.checks.migrations.version"))
+		}
+
+		viper.Set(AUTH_URL, "http://127.0.0.1:1/api/profile")
+		defer viper.Set(AUTH_URL, testServer.URL)
+		{
+			c, b := probe("/health/ready")
+			assert.Equal(t, http.StatusServiceUnavailable, c)
+			assert.Equal(t, "fail", jsonPathHelper(b, "$.status"))
+			assert.Equal(t, "fail", jsonPathHelper(b, "$.checks.auth.status"))
+			assert.NotEmpty(t, jsonPathHelper(b, "$.checks.auth.error"))
+			assert.Equal(t, "ok", jsonPathHelper(b, "$.checks.mongo.status"))
+		}
+		{
+			// liveness doesn't depend on auth backend
+			c, _ := probe("/health/live")
+			assert.Equal(t, http.StatusOK, c)
+		}
+	})
+}
+
+func TestServerAddressInUse(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer occupied.Close()
+
+	previous := viper.GetString("server.address")
+	viper.Set("server.address", occupied.Addr().String())
+	defer viper.Set("server.address", previous)
+
+	app := fx.New(fx.Provide(echo.New), fx.Invoke(runEcho))
+	startCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	err = app.Start(startCtx)
+	if assert.NotNil(t, err) {
+		var opErr *net.OpError
+		assert.True(t, errors.As(err, &opErr), "bind error is expected, got %v", err)
+		assert.Equal(t, "listen", opErr.Op)
+	}
+}
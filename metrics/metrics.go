@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const namespace = "blog_storage"
+
+const ResultOk = "ok"
+const ResultError = "error"
+const ResultNotFound = "not_found"
+
+// reasons of failed authentication
+const AuthUnauthorized = "unauthorized"
+const AuthError = "error"
+
+// jobs removing garbage
+const CleanupMongoOrphans = "mongo_orphans"
+const CleanupStorageOrphans = "storage_orphans"
+const CleanupExpiredUploads = "expired_uploads"
+const CleanupExpiredTrash = "expired_trash"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Count of HTTP requests by route and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	uploadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes of request bodies read by route.",
+	}, []string{"route"})
+	downloadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes of response bodies written by route.",
+	}, []string{"route"})
+
+	authDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "auth_request_duration_seconds",
+		Help:      "Latency of calls to auth backend.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Requests rejected by auth middleware, reason is unauthorized or error.",
+	}, []string{"reason"})
+
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Latency of object storage operations, for get it's time to open object.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mongo_command_duration_seconds",
+		Help:      "Latency of mongo commands.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command", "result"})
+
+	userUsedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "user_used_bytes",
+		Help:      "Bytes consumed by user, exported only when metrics.users.enabled.",
+	}, []string{"user"})
+	userMaxBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "user_max_bytes",
+		Help:      "Effective quota of user, exported only when metrics.users.enabled.",
+	}, []string{"user"})
+	userFiles = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "user_files",
+		Help:      "Count of user's files, exported only when metrics.users.enabled.",
+	}, []string{"user"})
+
+	cleanupRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleanup_runs_total",
+		Help:      "Runs of cleanup jobs by result.",
+	}, []string{"job", "result"})
+	cleanupRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleanup_removed_total",
+		Help:      "Items removed by cleanup jobs.",
+	}, []string{"job"})
+	cleanupLastRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cleanup_last_run_timestamp_seconds",
+		Help:      "Time of last finished run of cleanup job.",
+	}, []string{"job"})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func getResult(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultOk
+}
+
+func ObserveHttpRequest(method, route string, status int, duration time.Duration, in, out int64) {
+	httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	httpDuration.WithLabelValues(method, route).Observe(duration.Seconds())
+	if in > 0 {
+		uploadedBytes.WithLabelValues(route).Add(float64(in))
+	}
+	if out > 0 {
+		downloadedBytes.WithLabelValues(route).Add(float64(out))
+	}
+}
+
+func ObserveAuth(duration time.Duration) {
+	authDuration.Observe(duration.Seconds())
+}
+
+func CountAuthFailure(reason string) {
+	authFailures.WithLabelValues(reason).Inc()
+}
+
+func ObserveStorage(operation, result string, start time.Time) {
+	storageDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// NewMongoMonitor reports duration of every command sent by client
+func NewMongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, ResultOk).Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, ResultError).Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+	}
+}
+
+type UserUsage struct {
+	UserId   int
+	Used     int64
+	MaxBytes int64
+	Files    int64
+}
+
+// SetUsersUsage replaces gauges of all users, so removed users disappear
+func SetUsersUsage(users []UserUsage) {
+	userUsedBytes.Reset()
+	userMaxBytes.Reset()
+	userFiles.Reset()
+	for _, u := range users {
+		user := strconv.Itoa(u.UserId)
+		userUsedBytes.WithLabelValues(user).Set(float64(u.Used))
+		userMaxBytes.WithLabelValues(user).Set(float64(u.MaxBytes))
+		userFiles.WithLabelValues(user).Set(float64(u.Files))
+	}
+}
+
+func ObserveCleanup(job string, removed int, err error) {
+	cleanupRuns.WithLabelValues(job, getResult(err)).Inc()
+	cleanupRemoved.WithLabelValues(job).Add(float64(removed))
+	cleanupLastRun.WithLabelValues(job).SetToCurrentTime()
+}
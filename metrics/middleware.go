@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// label of requests which don't match any route, so raw paths don't blow up cardinality
+const unmatchedRoute = "unmatched"
+
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// Middleware measures requests by route pattern. It should be used before auth middleware, so rejected requests are counted too.
+func Middleware(e *echo.Echo) echo.MiddlewareFunc {
+	var once sync.Once
+	var routes map[string]bool
+	// routes are registered after middleware
+	getRoutes := func() map[string]bool {
+		once.Do(func() {
+			routes = map[string]bool{}
+			for _, r := range e.Routes() {
+				routes[r.Path] = true
+			}
+		})
+		return routes
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			body := &countingReader{ReadCloser: c.Request().Body}
+			c.Request().Body = body
+
+			err := next(c)
+			if err != nil {
+				// let error handler write response, so status is known
+				c.Error(err)
+			}
+
+			route := c.Path()
+			if !getRoutes()[route] {
+				route = unmatchedRoute
+			}
+			ObserveHttpRequest(c.Request().Method, route, c.Response().Status, time.Since(start), body.count, c.Response().Size)
+			return nil
+		}
+	}
+}
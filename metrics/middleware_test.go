@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareLabelsByRoute(t *testing.T) {
+	e := echo.New()
+	e.Use(Middleware(e))
+	e.POST("/upload/:file", func(c echo.Context) error {
+		body := make([]byte, 16)
+		n, _ := c.Request().Body.Read(body)
+		return c.String(http.StatusCreated, string(body[:n]))
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusForbidden)
+	})
+
+	for _, id := range []string{"a", "b"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upload/"+id, strings.NewReader("hello")))
+		assert.Equal(t, http.StatusCreated, rec.Code)
+	}
+	assert.Equal(t, float64(2), testutil.ToFloat64(httpRequests.WithLabelValues(http.MethodPost, "/upload/:file", "201")))
+	assert.Equal(t, float64(10), testutil.ToFloat64(uploadedBytes.WithLabelValues("/upload/:file")))
+	assert.Equal(t, float64(10), testutil.ToFloat64(downloadedBytes.WithLabelValues("/upload/:file")))
+
+	// status is set by error handler
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fail", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, float64(1), testutil.ToFloat64(httpRequests.WithLabelValues(http.MethodGet, "/fail", "403")))
+
+	// raw path of unknown url isn't used as label
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/no/such/path", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, float64(1), testutil.ToFloat64(httpRequests.WithLabelValues(http.MethodGet, unmatchedRoute, "404")))
+}
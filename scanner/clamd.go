@@ -0,0 +1,102 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// size of INSTREAM chunk, it should be less than StreamMaxLength of clamd
+const clamdChunkSize = 64 * 1024
+
+// clamdScanner streams content to ClamAV daemon with INSTREAM command
+type clamdScanner struct {
+	network string
+	address string
+	// for each network operation, so big files aren't limited by it
+	timeout time.Duration
+}
+
+// NewClamdScanner accepts address like unix:/var/run/clamav/clamd.ctl or tcp:127.0.0.1:3310
+func NewClamdScanner(address string, timeout time.Duration) (Scanner, error) {
+	parts := strings.SplitN(address, ":", 2)
+	if len(parts) != 2 || (parts[0] != "unix" && parts[0] != "tcp") || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("address '%v' should start with unix: or tcp:", address)
+	}
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &clamdScanner{network: parts[0], address: parts[1], timeout: timeout}, nil
+}
+
+func (s *clamdScanner) Scan(reader io.Reader) (*Result, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	// z prefix means null-terminated command and response
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(reader, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			conn.SetDeadline(time.Now().Add(s.timeout))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				// clamd drops connection when stream exceeds its limit, its reason is more useful
+				if response, responseErr := readClamdResponse(conn); responseErr == nil {
+					return parseClamdResponse(response)
+				}
+				return nil, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+	// zero-length chunk ends stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	response, err := readClamdResponse(conn)
+	if err != nil {
+		return nil, err
+	}
+	return parseClamdResponse(response)
+}
+
+func readClamdResponse(conn net.Conn) (string, error) {
+	response, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && len(response) == 0 {
+		return "", err
+	}
+	return strings.TrimRight(response, "\x00\n"), nil
+}
+
+// parseClamdResponse understands "stream: OK", "stream: Eicar-Signature FOUND" and "... ERROR"
+func parseClamdResponse(response string) (*Result, error) {
+	response = strings.TrimPrefix(response, "stream: ")
+	switch {
+	case response == "OK":
+		return &Result{}, nil
+	case strings.HasSuffix(response, " FOUND"):
+		return &Result{Infected: true, Signature: strings.TrimSuffix(response, " FOUND")}, nil
+	default:
+		return nil, errors.New("clamd: " + response)
+	}
+}
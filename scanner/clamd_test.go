@@ -0,0 +1,108 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// serveFakeClamd answers INSTREAM like clamd does, it finds EICAR test string and limits stream length
+func serveFakeClamd(listener net.Listener, maxLength int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			command := make([]byte, len("zINSTREAM\x00"))
+			if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+				conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				return
+			}
+			var content bytes.Buffer
+			for {
+				var length uint32
+				if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+					return
+				}
+				if length == 0 {
+					break
+				}
+				if _, err := io.CopyN(&content, conn, int64(length)); err != nil {
+					return
+				}
+				if content.Len() > maxLength {
+					conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+					return
+				}
+			}
+			if strings.Contains(content.String(), eicar) {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+		}(conn)
+	}
+}
+
+func TestClamdScanner(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer tcpListener.Close()
+	go serveFakeClamd(tcpListener, 1024*1024)
+
+	unixPath := filepath.Join(t.TempDir(), "clamd.sock")
+	unixListener, err := net.Listen("unix", unixPath)
+	assert.Nil(t, err)
+	defer unixListener.Close()
+	go serveFakeClamd(unixListener, 1024*1024)
+
+	for _, address := range []string{"tcp:" + tcpListener.Addr().String(), "unix:" + unixPath} {
+		s, err := NewClamdScanner(address, time.Second)
+		assert.Nil(t, err)
+
+		result, err := s.Scan(strings.NewReader("Hello world"))
+		assert.Nil(t, err, address)
+		assert.False(t, result.Infected)
+
+		// signature spans several chunks
+		infected := strings.Repeat("a", clamdChunkSize-10) + eicar + strings.Repeat("b", clamdChunkSize)
+		result, err = s.Scan(strings.NewReader(infected))
+		assert.Nil(t, err, address)
+		assert.True(t, result.Infected)
+		assert.Equal(t, "Eicar-Test-Signature", result.Signature)
+
+		result, err = s.Scan(strings.NewReader(""))
+		assert.Nil(t, err, address)
+		assert.False(t, result.Infected)
+	}
+}
+
+func TestClamdScannerErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go serveFakeClamd(listener, 10)
+
+	s, err := NewClamdScanner("tcp:"+listener.Addr().String(), time.Second)
+	assert.Nil(t, err)
+	_, err = s.Scan(strings.NewReader("longer than limit"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "size limit exceeded")
+
+	listener.Close()
+	_, err = s.Scan(strings.NewReader("Hello world"))
+	assert.NotNil(t, err)
+
+	_, err = NewClamdScanner("127.0.0.1:3310", time.Second)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,47 @@
+package scanner
+
+import (
+	"io"
+
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/spf13/viper"
+)
+
+const TypeNone = "none"
+const TypeClamd = "clamd"
+
+// Result of scan, Signature is name of found malware
+type Result struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner checks uploaded content before it becomes visible
+type Scanner interface {
+	Scan(reader io.Reader) (*Result, error)
+}
+
+func NewScanner() Scanner {
+	viper.SetDefault("scanner.type", TypeNone)
+	scannerType := viper.GetString("scanner.type")
+	switch scannerType {
+	case TypeNone:
+		return noneScanner{}
+	case TypeClamd:
+		s, err := NewClamdScanner(viper.GetString("scanner.clamd.address"), viper.GetDuration("scanner.clamd.timeout"))
+		if err != nil {
+			Logger.Fatalf("Wrong clamd address: %v", err)
+		}
+		return s
+	default:
+		Logger.Fatalf("Unknown scanner type '%v'", scannerType)
+		return nil
+	}
+}
+
+// noneScanner considers everything clean
+type noneScanner struct{}
+
+func (noneScanner) Scan(reader io.Reader) (*Result, error) {
+	return &Result{}, nil
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/nkonev/blog-storage/logger"
+)
+
+// directory inside root where object metadata (content type, etag) is kept
+const fsMetaDir = ".meta"
+
+type fsStorage struct {
+	root string
+}
+
+type fsObjectMeta struct {
+	ContentType string `json:"contentType"`
+	ETag        string `json:"etag"`
+}
+
+func NewFsStorage(root string) Storage {
+	if err := os.MkdirAll(filepath.Join(root, fsMetaDir), 0755); err != nil {
+		Logger.Fatalf("Cannot create storage root '%v': %v", root, err)
+	}
+	return &fsStorage{root: root}
+}
+
+func checkName(name string) error {
+	if len(name) == 0 || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || name == fsMetaDir {
+		return fmt.Errorf("invalid name '%v'", name)
+	}
+	return nil
+}
+
+func (s *fsStorage) bucketPath(bucketName string) (string, error) {
+	if err := checkName(bucketName); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, bucketName), nil
+}
+
+func (s *fsStorage) objectPaths(bucketName, objectName string) (string, string, error) {
+	if err := checkName(bucketName); err != nil {
+		return "", "", err
+	}
+	if err := checkName(objectName); err != nil {
+		return "", "", err
+	}
+	return filepath.Join(s.root, bucketName, objectName), filepath.Join(s.root, fsMetaDir, bucketName, objectName+".json"), nil
+}
+
+func (s *fsStorage) EnsureBucket(bucketName, location string) error {
+	bucketPath, err := s.bucketPath(bucketName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(bucketPath, 0755); err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(s.root, fsMetaDir, bucketName), 0755)
+}
+
+func (s *fsStorage) ListBuckets() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	var names = make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() && info.Name() != fsMetaDir {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *fsStorage) RemoveBucket(bucketName string) error {
+	bucketPath, err := s.bucketPath(bucketName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(bucketPath); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.root, fsMetaDir, bucketName))
+}
+
+func (s *fsStorage) PutObject(bucketName, objectName string, reader io.Reader, objectSize int64, contentType string) (int64, error) {
+	objectPath, metaPath, err := s.objectPaths(bucketName, objectName)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(filepath.Dir(objectPath)); err != nil {
+		return 0, err
+	}
+
+	// write to temporary file and rename in order to readers never see partially written object
+	tmp, err := ioutil.TempFile(filepath.Dir(objectPath), "."+objectName+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	var src = reader
+	if objectSize >= 0 {
+		src = io.LimitReader(reader, objectSize)
+	}
+	written, err := io.Copy(io.MultiWriter(tmp, hash), src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if objectSize >= 0 && written != objectSize {
+		return 0, fmt.Errorf("unexpected EOF: written %v of %v bytes", written, objectSize)
+	}
+
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	metaBytes, err := json.Marshal(fsObjectMeta{ContentType: contentType, ETag: hex.EncodeToString(hash.Sum(nil))})
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0755); err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(metaPath, metaBytes, 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), objectPath); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+func (s *fsStorage) GetObject(bucketName, objectName string) (Object, error) {
+	objectPath, _, err := s.objectPaths(bucketName, objectName)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(objectPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *fsStorage) stat(bucketName string, fileInfo os.FileInfo) ObjectInfo {
+	info := ObjectInfo{
+		Key:          fileInfo.Name(),
+		Size:         fileInfo.Size(),
+		LastModified: fileInfo.ModTime(),
+		ContentType:  "application/octet-stream",
+	}
+	_, metaPath, err := s.objectPaths(bucketName, fileInfo.Name())
+	if err != nil {
+		info.Err = err
+		return info
+	}
+	metaBytes, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		Logger.Warnf("Cannot read metadata of '%v' in bucket '%v': %v", fileInfo.Name(), bucketName, err)
+		return info
+	}
+	var meta fsObjectMeta
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		Logger.Warnf("Cannot parse metadata of '%v' in bucket '%v': %v", fileInfo.Name(), bucketName, err)
+		return info
+	}
+	info.ContentType = meta.ContentType
+	info.ETag = meta.ETag
+	return info
+}
+
+func (s *fsStorage) StatObject(bucketName, objectName string) (*ObjectInfo, error) {
+	objectPath, _, err := s.objectPaths(bucketName, objectName)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(objectPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	if fileInfo.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+	info := s.stat(bucketName, fileInfo)
+	return &info, info.Err
+}
+
+func (s *fsStorage) CopyObject(bucketName, srcObjectName, dstObjectName string) error {
+	info, err := s.StatObject(bucketName, srcObjectName)
+	if err != nil {
+		return err
+	}
+	src, err := s.GetObject(bucketName, srcObjectName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = s.PutObject(bucketName, dstObjectName, src, info.Size, info.ContentType)
+	return err
+}
+
+func (s *fsStorage) ListObjects(bucketName string, doneCh <-chan struct{}) <-chan ObjectInfo {
+	out := make(chan ObjectInfo)
+	go func() {
+		defer close(out)
+		send := func(info ObjectInfo) bool {
+			select {
+			case out <- info:
+				return true
+			case <-doneCh:
+				return false
+			}
+		}
+
+		bucketPath, err := s.bucketPath(bucketName)
+		if err != nil {
+			send(ObjectInfo{Err: err})
+			return
+		}
+		fileInfos, err := ioutil.ReadDir(bucketPath)
+		if err != nil {
+			send(ObjectInfo{Err: err})
+			return
+		}
+		for _, fileInfo := range fileInfos {
+			if fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), ".") {
+				continue
+			}
+			if !send(s.stat(bucketName, fileInfo)) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (s *fsStorage) RemoveObject(bucketName, objectName string) error {
+	objectPath, metaPath, err := s.objectPaths(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	// like S3 removing of absent object isn't an error
+	if err := os.Remove(objectPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
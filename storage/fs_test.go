@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsStorage(t *testing.T) {
+	s := NewFsStorage(t.TempDir())
+
+	assert.Nil(t, s.EnsureBucket("user1", "europe-east"))
+	assert.Nil(t, s.EnsureBucket("user1", "europe-east"))
+
+	content := "Hello world"
+	written, err := s.PutObject("user1", "obj1", strings.NewReader(content), int64(len(content)), "text/plain")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), written)
+
+	buckets, err := s.ListBuckets()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user1"}, buckets)
+
+	info, err := s.StatObject("user1", "obj1")
+	assert.Nil(t, err)
+	assert.Equal(t, "obj1", info.Key)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.Equal(t, "text/plain", info.ContentType)
+	assert.NotEmpty(t, info.ETag)
+
+	object, err := s.GetObject("user1", "obj1")
+	assert.Nil(t, err)
+	bytes, err := ioutil.ReadAll(object)
+	assert.Nil(t, err)
+	assert.Nil(t, object.Close())
+	assert.Equal(t, content, string(bytes))
+
+	assert.Nil(t, s.CopyObject("user1", "obj1", "obj2"))
+	copied, err := s.StatObject("user1", "obj2")
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size, copied.Size)
+	assert.Equal(t, "text/plain", copied.ContentType)
+	assert.Equal(t, info.ETag, copied.ETag)
+	assert.Nil(t, s.RemoveObject("user1", "obj2"))
+	assert.Equal(t, ErrObjectNotFound, s.CopyObject("user1", "absent", "obj3"))
+
+	var keys []string
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for objInfo := range s.ListObjects("user1", doneCh) {
+		assert.Nil(t, objInfo.Err)
+		keys = append(keys, objInfo.Key)
+	}
+	assert.Equal(t, []string{"obj1"}, keys)
+
+	assert.Nil(t, s.RemoveObject("user1", "obj1"))
+	_, err = s.StatObject("user1", "obj1")
+	assert.Equal(t, ErrObjectNotFound, err)
+	_, err = s.GetObject("user1", "obj1")
+	assert.Equal(t, ErrObjectNotFound, err)
+
+	assert.Nil(t, s.RemoveBucket("user1"))
+	buckets, err = s.ListBuckets()
+	assert.Nil(t, err)
+	assert.Empty(t, buckets)
+}
+
+func TestFsStorageRejectsPathTraversal(t *testing.T) {
+	s := NewFsStorage(t.TempDir())
+
+	assert.NotNil(t, s.EnsureBucket("../user1", "europe-east"))
+	assert.NotNil(t, s.EnsureBucket(fsMetaDir, "europe-east"))
+	_, err := s.PutObject("user1", "../../etc/passwd", strings.NewReader(""), 0, "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"io"
+	"time"
+
+	"github.com/nkonev/blog-storage/metrics"
+)
+
+// measuredStorage reports latency of each operation to metrics
+type measuredStorage struct {
+	delegate Storage
+}
+
+func getResult(err error) string {
+	switch err {
+	case nil:
+		return metrics.ResultOk
+	case ErrObjectNotFound:
+		return metrics.ResultNotFound
+	default:
+		return metrics.ResultError
+	}
+}
+
+func (s *measuredStorage) EnsureBucket(bucketName, location string) error {
+	start := time.Now()
+	err := s.delegate.EnsureBucket(bucketName, location)
+	metrics.ObserveStorage("ensure_bucket", getResult(err), start)
+	return err
+}
+
+func (s *measuredStorage) ListBuckets() ([]string, error) {
+	start := time.Now()
+	buckets, err := s.delegate.ListBuckets()
+	metrics.ObserveStorage("list_buckets", getResult(err), start)
+	return buckets, err
+}
+
+func (s *measuredStorage) RemoveBucket(bucketName string) error {
+	start := time.Now()
+	err := s.delegate.RemoveBucket(bucketName)
+	metrics.ObserveStorage("remove_bucket", getResult(err), start)
+	return err
+}
+
+// PutObject is measured including reading of source, which may be slow client
+func (s *measuredStorage) PutObject(bucketName, objectName string, reader io.Reader, objectSize int64, contentType string) (int64, error) {
+	start := time.Now()
+	written, err := s.delegate.PutObject(bucketName, objectName, reader, objectSize, contentType)
+	metrics.ObserveStorage("put", getResult(err), start)
+	return written, err
+}
+
+func (s *measuredStorage) GetObject(bucketName, objectName string) (Object, error) {
+	start := time.Now()
+	object, err := s.delegate.GetObject(bucketName, objectName)
+	metrics.ObserveStorage("get", getResult(err), start)
+	return object, err
+}
+
+func (s *measuredStorage) StatObject(bucketName, objectName string) (*ObjectInfo, error) {
+	start := time.Now()
+	info, err := s.delegate.StatObject(bucketName, objectName)
+	metrics.ObserveStorage("stat", getResult(err), start)
+	return info, err
+}
+
+func (s *measuredStorage) CopyObject(bucketName, srcObjectName, dstObjectName string) error {
+	start := time.Now()
+	err := s.delegate.CopyObject(bucketName, srcObjectName, dstObjectName)
+	metrics.ObserveStorage("copy", getResult(err), start)
+	return err
+}
+
+// ListObjects isn't measured, listing is consumed lazily by caller
+func (s *measuredStorage) ListObjects(bucketName string, doneCh <-chan struct{}) <-chan ObjectInfo {
+	return s.delegate.ListObjects(bucketName, doneCh)
+}
+
+func (s *measuredStorage) RemoveObject(bucketName, objectName string) error {
+	start := time.Now()
+	err := s.delegate.RemoveObject(bucketName, objectName)
+	metrics.ObserveStorage("remove", getResult(err), start)
+	return err
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"github.com/minio/minio-go"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/spf13/viper"
+	"io"
+)
+
+type minioStorage struct {
+	client *minio.Client
+}
+
+func NewMinioStorage() Storage {
+	endpoint := viper.GetString("minio.endpoint")
+	accessKeyID := viper.GetString("minio.accessKeyId")
+	secretAccessKey := viper.GetString("minio.secretAccessKey")
+	useSSL := false
+
+	// Initialize minio client object.
+	minioClient, err := minio.New(endpoint, accessKeyID, secretAccessKey, useSSL)
+	if err != nil {
+		Logger.Fatal(err)
+	}
+
+	return &minioStorage{client: minioClient}
+}
+
+func convertMinioError(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrObjectNotFound
+	}
+	return err
+}
+
+func convertObjectInfo(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		Err:          info.Err,
+	}
+}
+
+func (s *minioStorage) EnsureBucket(bucketName, location string) error {
+	err := s.client.MakeBucket(bucketName, location)
+	if err != nil {
+		// Check to see if we already own this bucket (which happens if you run this twice)
+		exists, err2 := s.client.BucketExists(bucketName)
+		if err2 == nil && exists {
+			Logger.Debugf("Bucket '%s' already present", bucketName)
+			return nil
+		}
+		return err
+	}
+	Logger.Infof("Successfully created bucket '%s'", bucketName)
+	return nil
+}
+
+func (s *minioStorage) ListBuckets() ([]string, error) {
+	infos, err := s.client.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+	var names = make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	return names, nil
+}
+
+func (s *minioStorage) RemoveBucket(bucketName string) error {
+	return s.client.RemoveBucket(bucketName)
+}
+
+func (s *minioStorage) PutObject(bucketName, objectName string, reader io.Reader, objectSize int64, contentType string) (int64, error) {
+	return s.client.PutObject(bucketName, objectName, reader, objectSize, minio.PutObjectOptions{ContentType: contentType})
+}
+
+func (s *minioStorage) GetObject(bucketName, objectName string) (Object, error) {
+	object, err := s.client.GetObject(bucketName, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, convertMinioError(err)
+	}
+	return object, nil
+}
+
+func (s *minioStorage) StatObject(bucketName, objectName string) (*ObjectInfo, error) {
+	info, err := s.client.StatObject(bucketName, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, convertMinioError(err)
+	}
+	converted := convertObjectInfo(info)
+	return &converted, nil
+}
+
+func (s *minioStorage) CopyObject(bucketName, srcObjectName, dstObjectName string) error {
+	dst, err := minio.NewDestinationInfo(bucketName, dstObjectName, nil, nil)
+	if err != nil {
+		return err
+	}
+	return convertMinioError(s.client.CopyObject(dst, minio.NewSourceInfo(bucketName, srcObjectName, nil)))
+}
+
+func (s *minioStorage) ListObjects(bucketName string, doneCh <-chan struct{}) <-chan ObjectInfo {
+	out := make(chan ObjectInfo)
+	go func() {
+		defer close(out)
+		recursive := true
+		for objInfo := range s.client.ListObjects(bucketName, "", recursive, doneCh) {
+			select {
+			case out <- convertObjectInfo(objInfo):
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (s *minioStorage) RemoveObject(bucketName, objectName string) error {
+	return s.client.RemoveObject(bucketName, objectName)
+}
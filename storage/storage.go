@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"errors"
+	. "github.com/nkonev/blog-storage/logger"
+	"github.com/spf13/viper"
+	"io"
+	"time"
+)
+
+const TypeMinio = "minio"
+const TypeFs = "fs"
+
+var ErrObjectNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	// set when listing fails
+	Err error
+}
+
+type Object interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// Storage is an object store backend. Buckets are flat, keys are mongo object ids.
+type Storage interface {
+	EnsureBucket(bucketName, location string) error
+	ListBuckets() ([]string, error)
+	RemoveBucket(bucketName string) error
+	PutObject(bucketName, objectName string, reader io.Reader, objectSize int64, contentType string) (int64, error)
+	GetObject(bucketName, objectName string) (Object, error)
+	StatObject(bucketName, objectName string) (*ObjectInfo, error)
+	// CopyObject copies object with its content type inside bucket
+	CopyObject(bucketName, srcObjectName, dstObjectName string) error
+	// ListObjects behaves like minio's one - it closes returned channel after last object or after doneCh closed
+	ListObjects(bucketName string, doneCh <-chan struct{}) <-chan ObjectInfo
+	RemoveObject(bucketName, objectName string) error
+}
+
+func NewStorage() Storage {
+	viper.SetDefault("storage.type", TypeMinio)
+	storageType := viper.GetString("storage.type")
+	switch storageType {
+	case TypeMinio:
+		return &measuredStorage{NewMinioStorage()}
+	case TypeFs:
+		return &measuredStorage{NewFsStorage(viper.GetString("storage.fs.root"))}
+	default:
+		Logger.Fatalf("Unknown storage type '%v'", storageType)
+		return nil
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"github.com/nkonev/blog-storage/metrics"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -11,6 +12,7 @@ import (
 	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
 	"golang.org/x/crypto/bcrypt"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -59,19 +61,22 @@ func GetMongoDatabase(client *mongo.Client) *mongo.Database {
 	return client.Database(GetMongoDbName(GetMongoUrl()))
 }
 
-func InitFlag(defaultLocation string) (string, bool, bool) {
+func InitFlag(defaultLocation string) (string, bool, bool, bool) {
 	configFile := flag.String("config", defaultLocation, "Path to config file")
 	var mongo1 = flag.Bool("mongo", false, "clear orphans from mongo")
 	var minio = flag.Bool("minio", false, "clear orphans from minio")
+	var usage = flag.Bool("usage", false, "recalculate users' storage usage from object storage")
 
 	flag.Parse()
-	return *configFile, *mongo1, *minio
+	return *configFile, *mongo1, *minio, *usage
 }
 
 func InitViper(configFile string) {
 	viper.SetConfigFile(configFile)
 	// call multiple times to add many search paths
 	viper.SetEnvPrefix("BLOG_STORE")
+	// nested keys are overridden too, e. g. BLOG_STORE_STORAGE_TYPE=fs
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 	// Find and read the config file
 	if err := viper.ReadInConfig(); err != nil { // Handle errors reading the config file
@@ -82,14 +87,28 @@ func InitViper(configFile string) {
 const USER_ID = "userId"
 const USER_ADMIN = "userAdmin"
 const USER_LOGIN = "userLogin"
+const AUDIT = "audit"
 const DOWNLOAD_PREFIX = "/download/"
 const PUBLIC_PREFIX = "/public"
 const USER_PREFIX = "user"
 const LIMITED = "limited"
+const PLAN = "plan"
+const MAX_BYTES = "maxBytes"
+const MAX_FILES = "maxFiles"
+const TUS_PREFIX = "/tus/"
+const SHARED_PREFIX = "/shared/"
+const TTL = "ttl"
+const MAX_DOWNLOADS = "maxDownloads"
+
+// bucket for parts of unfinished resumable uploads
+const UPLOADS_BUCKET = "uploads"
+
+// bucket for cached resized images
+const DERIVATIVES_BUCKET = "derivatives"
 
 func GetMongoClient() *mongo.Client {
 	mongoUrl := GetMongoUrl()
-	client, err := mongo.NewClient(options.Client().ApplyURI(mongoUrl))
+	client, err := mongo.NewClient(options.Client().ApplyURI(mongoUrl).SetMonitor(metrics.NewMongoMonitor()))
 	if err != nil {
 		log.Panicf("Error during create mongo client: %v", err)
 	}